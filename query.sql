@@ -29,13 +29,29 @@ FROM worker_metric;
 SELECT *
 FROM db_conn_err;
 
--- name: GetFreeMigrationWorker :one
-(SELECT id
- FROM migration_worker
- EXCEPT
- SELECT m_worker_id
- FROM db_migration)
-    LIMIT 1;
+-- name: ClaimFreeMigrationWorker :one
+SELECT w.id
+FROM migration_worker w
+WHERE w.last_heartbeat >= sqlc.arg(alive_since)
+  AND NOT EXISTS (SELECT 1
+                  FROM db_migration m
+                  WHERE m.m_worker_id = w.id
+                    AND m.status IN ('waiting', 'running'))
+ORDER BY w.last_heartbeat DESC
+LIMIT 1 FOR UPDATE OF w SKIP LOCKED;
+
+-- name: LockDbInstance :one
+SELECT *
+FROM db_instance
+WHERE url = $1
+FOR SHARE;
+
+-- name: ClaimQueuedMigrationJob :one
+SELECT *
+FROM db_migration
+WHERE id = $1
+  AND status = 'queued'
+    FOR UPDATE SKIP LOCKED;
 
 -- name: GetAllDbInstances :many
 SELECT *
@@ -65,11 +81,6 @@ DELETE
 FROM migration_worker
 WHERE id = $1;
 
--- name: DeleteWorkerJob :execresult
-DELETE
-FROM db_migration
-WHERE m_worker_id = $1;
-
 -- name: DeleteWorkerJobJoin :execresult
 DELETE
 FROM migration_worker_jobs
@@ -88,17 +99,169 @@ VALUES ($1, $2, $3, 0);
 INSERT INTO db_migration (id, url, m_worker_id, "from", "to", status)
 VALUES ($1, $2, $3, $4, $5, $6);
 
--- name: DeleteDBConnError :execresult
+-- name: RenewControllerHeartbeat :execresult
+UPDATE controller_status
+SET last_heartbeat = now()
+WHERE controller_id = sqlc.arg(controller_id);
+
+-- name: ClaimControllerLeadership :execresult
+UPDATE controller_status
+SET controller_id  = sqlc.arg(controller_id),
+    last_heartbeat = now()
+WHERE controller_id IS NOT DISTINCT FROM sqlc.narg(old_controller_id)
+  AND last_heartbeat < now() - make_interval(secs => sqlc.arg(timeout_seconds)::float8);
+
+-- name: CreateControllerLeadership :execresult
+INSERT INTO controller_status(scaling, last_heartbeat, controller_id)
+VALUES (false, now(), sqlc.arg(controller_id))
+ON CONFLICT DO NOTHING;
+
+-- name: GetActiveMigrationJobs :many
+SELECT *
+FROM db_migration
+WHERE status NOT IN ('done', 'failed', 'queued');
+
+-- name: GetSingleMWorkerState :one
+SELECT *
+FROM migration_worker
+WHERE id = $1
+LIMIT 1;
+
+-- name: ReassignMigrationJob :execresult
+UPDATE db_migration
+SET m_worker_id     = $2,
+    status          = 'waiting',
+    status_reason   = $3,
+    attempts        = attempts + 1,
+    next_attempt_at = NULL
+WHERE id = $1;
+
+-- name: SetMigrationJobReason :execresult
+UPDATE db_migration
+SET status_reason = $2
+WHERE id = $1;
+
+-- name: FailMigrationJob :execresult
+UPDATE db_migration
+SET status          = 'failed',
+    status_reason   = $2,
+    m_worker_id     = NULL,
+    next_attempt_at = NULL
+WHERE id = $1;
+
+-- name: GetDatabaseTime :one
+SELECT now()::timestamptz;
+
+-- name: MarkDbInstanceUnhealthy :execresult
+UPDATE db_instance
+SET unhealthy_since  = now(),
+    unhealthy_reason = $2
+WHERE url = $1
+  AND unhealthy_since IS NULL;
+
+-- name: ClearDbInstanceUnhealthy :execresult
+UPDATE db_instance
+SET unhealthy_since  = NULL,
+    unhealthy_reason = NULL
+WHERE url = $1;
+
+-- name: CreateFailureReport :execresult
+INSERT INTO failure_report (id, generated_at, flagged_count, report)
+VALUES ($1, $2, $3, $4);
+
+-- name: GetFailureReportsSince :many
+SELECT *
+FROM failure_report
+WHERE generated_at >= $1
+ORDER BY generated_at;
+
+-- name: DeleteFailureReportsBefore :execresult
 DELETE
+FROM failure_report
+WHERE generated_at < $1;
+
+-- name: DeleteDBConnErrorsBatch :execresult
+DELETE
+FROM db_conn_err
+WHERE ctid = ANY (ARRAY(SELECT ctid
+                        FROM db_conn_err
+                        WHERE fail_time < sqlc.arg(before)
+                        LIMIT sqlc.arg(batch_size)));
+
+-- name: GetDBConnErrorBuckets :many
+SELECT worker_id,
+       db_url,
+       to_timestamp(floor(extract(EPOCH FROM fail_time) / sqlc.arg(bucket_seconds)::float8) *
+                    sqlc.arg(bucket_seconds)::float8)::timestamptz AS bucket_start,
+       COUNT(*)::int4                                              AS error_count
 FROM db_conn_err
-WHERE db_url = $1
-  AND worker_id = $2
-  AND fail_time = $3;
+WHERE fail_time >= sqlc.arg(since)
+GROUP BY worker_id, db_url, bucket_start;
+
+-- name: RequeueMigrationJob :execresult
+UPDATE db_migration
+SET status          = 'queued',
+    status_reason   = $3,
+    m_worker_id     = NULL,
+    next_attempt_at = $2
+WHERE id = $1;
+
+-- name: GetDueMigrationJobs :many
+SELECT *
+FROM db_migration
+WHERE status = 'queued'
+  AND next_attempt_at <= now()
+ORDER BY next_attempt_at;
+
+-- name: GetAllMigrationJobs :many
+SELECT *
+FROM db_migration;
+
+-- name: UpsertDbProbe :execresult
+INSERT INTO db_probe (url, reachable, latency_ms, error, probed_at, consecutive_failures)
+VALUES ($1, $2, $3, $4, now(), CASE WHEN $2 THEN 0 ELSE 1 END)
+ON CONFLICT (url) DO UPDATE
+    SET reachable            = excluded.reachable,
+        latency_ms           = excluded.latency_ms,
+        error                = excluded.error,
+        probed_at            = excluded.probed_at,
+        consecutive_failures = CASE WHEN excluded.reachable THEN 0 ELSE db_probe.consecutive_failures + 1 END;
+
+-- name: GetAllDbProbes :many
+SELECT *
+FROM db_probe;
 
--- name: DeleteOldControllerHeartbeat :execresult
+-- name: DeleteDbProbesExcept :execresult
 DELETE
-FROM controller_status;
+FROM db_probe
+WHERE NOT (url = ANY ($1::text[]));
 
--- name: CreateNewControllerHeartbeat :execresult
-INSERT INTO controller_status(scaling, last_heartbeat)
-VALUES ($1, $2);
+-- name: UpdateMapping :execresult
+UPDATE db_mapping
+SET url    = $2,
+    "from" = $3
+WHERE id = $1;
+
+-- name: DeleteMapping :execresult
+DELETE
+FROM db_mapping
+WHERE id = $1;
+
+-- name: CreateAuditEntry :execresult
+INSERT INTO audit_log (actor, action, subject, controller_id, trace_id, reason, before, after)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8);
+
+-- name: GetAuditEntries :many
+SELECT *
+FROM audit_log
+WHERE id < sqlc.arg(before_id)
+  AND (sqlc.narg(subject)::text IS NULL OR subject = sqlc.narg(subject)::text)
+ORDER BY id DESC
+LIMIT sqlc.arg(page_size);
+
+-- name: GetReplicationLag :one
+SELECT (CASE
+            WHEN NOT pg_is_in_recovery() THEN 0
+            WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+            ELSE COALESCE(extract(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+    END)::float8 AS lag_seconds;
@@ -0,0 +1,143 @@
+package components
+
+import (
+	"context"
+	"controller/src/database"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"math"
+	"time"
+)
+
+// Actors and actions that are written to the audit log
+const (
+	actorReconciler = "reconciler"
+	actorScheduler  = "scheduler"
+
+	auditWorkerEvict            = "worker.evict"
+	auditMigrationWorkerCreate  = "migration-worker.create"
+	auditMigrationWorkerRemove  = "migration-worker.remove"
+	auditMigrationCreate        = "migration.create"
+	auditMigrationRequeue       = "migration.requeue"
+	auditMigrationFail          = "migration.fail"
+	auditMigrationDispatch      = "migration.dispatch"
+	auditMappingCreate          = "mapping.create"
+	auditMappingUpdate          = "mapping.update"
+	auditMappingDelete          = "mapping.delete"
+	auditDatabaseMarkUnhealthy  = "database.mark-unhealthy"
+	auditDatabaseClearUnhealthy = "database.clear-unhealthy"
+)
+
+// Auditor appends every action the reconciler and the scheduler take to the audit log,
+// together with the instance of the controller that took it and the trace id of the request or loop run.
+// Failing to write an entry is logged but never fails the action itself.
+type Auditor struct {
+	logger       *zap.Logger
+	writer       database.WriteStore
+	reader       database.ReadStore
+	controllerID string
+}
+
+// AuditEntry is a single entry of the audit log as returned by the /audit endpoint
+type AuditEntry struct {
+	ID           int64
+	OccurredAt   time.Time
+	Actor        string
+	Action       string
+	Subject      string
+	ControllerID string
+	TraceID      string
+	Reason       string
+	Before       json.RawMessage `json:",omitempty"`
+	After        json.RawMessage `json:",omitempty"`
+}
+
+// AuditPage is one page of the audit log. NextBefore is passed as "before" to get the next page and is 0 on the last page.
+type AuditPage struct {
+	Entries    []AuditEntry
+	NextBefore int64
+}
+
+func NewAuditor(logger *zap.Logger, writer database.WriteStore, reader database.ReadStore, controllerID string) *Auditor {
+	return &Auditor{
+		logger:       logger,
+		writer:       writer,
+		reader:       reader,
+		controllerID: controllerID,
+	}
+}
+
+// Record appends an action to the audit log. before and after describe the subject around the action and may be nil.
+func (a *Auditor) Record(ctx context.Context, actor, action, subject, reason string, before, after any) {
+
+	entry := database.AuditEntry{
+		Actor:        actor,
+		Action:       action,
+		Subject:      subject,
+		ControllerID: a.controllerID,
+		Reason:       reason,
+		Before:       a.marshal(action, before),
+		After:        a.marshal(action, after),
+	}
+
+	if traceId := ctx.Value("traceID"); traceId != nil {
+		entry.TraceID = fmt.Sprint(traceId)
+	}
+
+	if err := a.writer.AppendAuditEntry(ctx, entry); err != nil {
+		a.logger.Warn("could not append action to audit log", zap.String("action", action), zap.String("subject", subject), zap.Error(err))
+	}
+}
+
+// Page returns up to pageSize entries of the audit log, newest first, that are older than the entry with the id before.
+// A before of 0 starts at the newest entry.
+func (a *Auditor) Page(ctx context.Context, before int64, subject string, pageSize int32) (AuditPage, error) {
+
+	if before <= 0 {
+		before = math.MaxInt64
+	}
+
+	rows, err := a.reader.GetAuditEntries(ctx, before, subject, pageSize)
+	if err != nil {
+		return AuditPage{}, err
+	}
+
+	page := AuditPage{Entries: make([]AuditEntry, 0, len(rows))}
+
+	for _, row := range rows {
+		page.Entries = append(page.Entries, AuditEntry{
+			ID:           row.ID,
+			OccurredAt:   row.OccurredAt.Time,
+			Actor:        row.Actor,
+			Action:       row.Action,
+			Subject:      row.Subject,
+			ControllerID: row.ControllerID,
+			TraceID:      row.TraceID.String,
+			Reason:       row.Reason.String,
+			Before:       row.Before,
+			After:        row.After,
+		})
+	}
+
+	if len(rows) == int(pageSize) {
+		page.NextBefore = rows[len(rows)-1].ID
+	}
+
+	return page, nil
+}
+
+func (a *Auditor) marshal(action string, v any) []byte {
+
+	if v == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		a.logger.Warn("could not serialize audit data", zap.String("action", action), zap.Error(err))
+		return nil
+	}
+
+	return data
+}
@@ -0,0 +1,171 @@
+package components
+
+import (
+	"context"
+	"controller/src/database"
+	"go.uber.org/zap"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DbClock evaluates heartbeats against the clock of the database instead of the clock of the controller host.
+// It measures the offset between the local and the database clock on every Sync, and estimates for every worker
+// by how much its clock is off: whenever a worker writes a new heartbeat, the age of that heartbeat at the time it is
+// first seen is recorded, and the smallest age in the window is taken as the workers offset. If that offset exceeds
+// the tolerance, heartbeat ages of that worker are corrected by it, so a drifting clock does not trigger a timeout.
+type DbClock struct {
+	logger    *zap.Logger
+	reader    database.ReadStore
+	tolerance time.Duration
+	window    int
+
+	mu         sync.Mutex
+	offset     time.Duration
+	measuredAt time.Time
+	workers    map[string]*workerClock
+}
+
+type workerClock struct {
+	lastHeartbeat time.Time
+	samples       []time.Duration
+}
+
+// WorkerClockSkew is the estimated clock skew of a single worker as shown in the system state.
+// A positive Offset means the workers clock is ahead of the database clock.
+type WorkerClockSkew struct {
+	WorkerID string
+	Offset   string
+	Samples  int
+	Skewed   bool
+}
+
+// ClockReport is the clock information that is shown in the system state
+type ClockReport struct {
+	ControllerOffset string
+	MeasuredAt       time.Time
+	Tolerance        string
+	Workers          []WorkerClockSkew
+}
+
+func NewDbClock(logger *zap.Logger, reader database.ReadStore, tolerance time.Duration, window int) *DbClock {
+	return &DbClock{
+		logger:    logger,
+		reader:    reader,
+		tolerance: tolerance,
+		window:    window,
+		workers:   make(map[string]*workerClock),
+	}
+}
+
+// Sync reads the current time from the database and updates the offset to the local clock.
+// Half of the round trip time is attributed to the way back, so the offset is not skewed by the query latency.
+func (c *DbClock) Sync(ctx context.Context) (time.Time, error) {
+
+	before := time.Now()
+
+	dbNow, err := c.reader.GetDatabaseTime(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	after := time.Now()
+	localAtRead := before.Add(after.Sub(before) / 2)
+
+	c.mu.Lock()
+	c.offset = dbNow.Sub(localAtRead)
+	c.measuredAt = after
+	c.mu.Unlock()
+
+	c.logger.Debug("synced with database clock", zap.Duration("offset", dbNow.Sub(localAtRead)), zap.Duration("roundTrip", after.Sub(before)))
+
+	return dbNow, nil
+}
+
+// Now returns the current time of the database clock, estimated from the local clock and the last measured offset
+func (c *DbClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return time.Now().Add(c.offset)
+}
+
+// Observe records the heartbeat of a worker seen at the given database time and returns the correction
+// that has to be subtracted from the heartbeats age. The correction is zero while the skew is within the tolerance.
+func (c *DbClock) Observe(workerId string, heartbeat, dbNow time.Time) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	w, ok := c.workers[workerId]
+	if !ok {
+		//the first heartbeat we see may be arbitrarily old, so it only becomes the reference for the next one
+		c.workers[workerId] = &workerClock{lastHeartbeat: heartbeat}
+		return 0
+	}
+
+	if !heartbeat.Equal(w.lastHeartbeat) {
+		w.lastHeartbeat = heartbeat
+		w.samples = append(w.samples, dbNow.Sub(heartbeat))
+
+		if len(w.samples) > c.window {
+			w.samples = w.samples[len(w.samples)-c.window:]
+		}
+	}
+
+	skew := w.skew()
+	if skew.Abs() <= c.tolerance {
+		return 0
+	}
+
+	return skew
+}
+
+// Forget drops everything known about the clock of a worker, e.g. after it was removed
+func (c *DbClock) Forget(workerId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.workers, workerId)
+}
+
+// Report returns the measured controller offset and the estimated skew of all workers
+func (c *DbClock) Report() ClockReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	report := ClockReport{
+		ControllerOffset: (-c.offset).String(),
+		MeasuredAt:       c.measuredAt,
+		Tolerance:        c.tolerance.String(),
+		Workers:          make([]WorkerClockSkew, 0, len(c.workers)),
+	}
+
+	for id, w := range c.workers {
+		skew := w.skew()
+		report.Workers = append(report.Workers, WorkerClockSkew{
+			WorkerID: id,
+			Offset:   (-skew).String(),
+			Samples:  len(w.samples),
+			Skewed:   skew.Abs() > c.tolerance,
+		})
+	}
+
+	sort.Slice(report.Workers, func(i, j int) bool { return report.Workers[i].WorkerID < report.Workers[j].WorkerID })
+
+	return report
+}
+
+// skew is the smallest heartbeat age seen in the window, which is as close as we get to the workers clock offset
+func (w *workerClock) skew() time.Duration {
+
+	if len(w.samples) == 0 {
+		return 0
+	}
+
+	skew := w.samples[0]
+	for _, sample := range w.samples[1:] {
+		skew = min(skew, sample)
+	}
+
+	return skew
+}
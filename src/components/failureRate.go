@@ -0,0 +1,199 @@
+package components
+
+import (
+	sqlc "controller/src/database/sqlc"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// FailureRateConfig configures how CheckFailureRate scores db_conn_err rows.
+// Every error contributes 0.5^(age/HalfLife) to the scores of its worker, its database and the pair of both,
+// so recent errors weigh more than old ones. Errors older than Window are not scored at all and purged by PurgeConnErrors
+// in batches of PurgeBatchSize. Errors are counted per Bucket in postgres, all errors of a bucket are weighted by the age of its middle.
+// A score strictly greater than its threshold is flagged.
+// A flagged database is excluded from placement while it stays flagged, see FailureReports.Excluded. It is only marked unhealthy,
+// which outlasts the report and can get its ranges evacuated, if errors were reported by at least DatabaseMinWorkers distinct workers,
+// so a single broken worker does not empty a database. The mark is cleared once the score of the
+// database drops below DatabaseRecoveryThreshold. Every report is kept in the history for Retention.
+type FailureRateConfig struct {
+	Window                    time.Duration
+	HalfLife                  time.Duration
+	Bucket                    time.Duration
+	PurgeBatchSize            int
+	WorkerThreshold           float64
+	DatabaseThreshold         float64
+	PairThreshold             float64
+	DatabaseMinWorkers        int
+	DatabaseRecoveryThreshold float64
+	Retention                 time.Duration
+}
+
+// DatabaseRemediation lists the database instances whose health mark was changed by RemediateDatabases
+type DatabaseRemediation struct {
+	MarkedUnhealthy []string
+	Recovered       []string
+}
+
+// FailureScore is the decayed failure score of a worker, a database or a worker-database pair.
+// For workers DbUrl is empty, for databases WorkerID is empty.
+type FailureScore struct {
+	WorkerID string
+	DbUrl    string
+	Count    int
+	Score    float64
+	Flagged  bool
+}
+
+// FailureReport is the result of a single CheckFailureRate run
+type FailureReport struct {
+	GeneratedAt time.Time
+	Window      string
+	HalfLife    string
+	Workers     []FailureScore
+	Databases   []FailureScore
+	Pairs       []FailureScore
+	Flagged     []FailureScore
+}
+
+// FailureReports keeps the latest failure report. It is shared by the reconciler, which stores every new report,
+// and the scheduler, which keeps the databases flagged by it out of placement.
+type FailureReports struct {
+	latest atomic.Pointer[FailureReport]
+}
+
+func NewFailureReports() *FailureReports {
+	return &FailureReports{}
+}
+
+// Store replaces the latest report
+func (f *FailureReports) Store(report FailureReport) {
+	f.latest.Store(&report)
+}
+
+// Latest returns the latest report and false if there is none yet
+func (f *FailureReports) Latest() (FailureReport, bool) {
+
+	report := f.latest.Load()
+	if report == nil {
+		return FailureReport{}, false
+	}
+
+	return *report, true
+}
+
+// Excluded returns the score of the database if the latest report flagged it. An excluded database gets no new ranges
+// and is not picked as a migration target, but keeps the ranges it has, those are only evacuated once RemediateDatabases
+// marks it unhealthy as well. The exclusion ends with the first report that does not flag the database anymore.
+func (f *FailureReports) Excluded(url string) (FailureScore, bool) {
+
+	report := f.latest.Load()
+	if report == nil {
+		return FailureScore{}, false
+	}
+
+	for _, score := range report.Databases {
+		if score.DbUrl == url && score.Flagged {
+			return score, true
+		}
+	}
+
+	return FailureScore{}, false
+}
+
+type pairKey struct {
+	workerID string
+	dbUrl    string
+}
+
+// scoreFailures scores the connection errors within the window, counted per worker, database and time bucket, into a failure report
+func scoreFailures(buckets []sqlc.GetDBConnErrorBucketsRow, now time.Time, config FailureRateConfig) FailureReport {
+
+	workers := make(map[string]*FailureScore)
+	databases := make(map[string]*FailureScore)
+	pairs := make(map[pairKey]*FailureScore)
+
+	for _, bucket := range buckets {
+
+		//the bucket holding now is only partly over, its middle may still lie in the future
+		age := max(now.Sub(bucket.BucketStart.Time.Add(config.Bucket/2)), 0)
+		count := int(bucket.ErrorCount)
+
+		workerID := bucket.WorkerID.String()
+		dbUrl := bucket.DbUrl.String
+
+		add(workers, workerID, FailureScore{WorkerID: workerID}, count, decay(age, config.HalfLife))
+		add(databases, dbUrl, FailureScore{DbUrl: dbUrl}, count, decay(age, config.HalfLife))
+		add(pairs, pairKey{workerID: workerID, dbUrl: dbUrl}, FailureScore{WorkerID: workerID, DbUrl: dbUrl}, count, decay(age, config.HalfLife))
+	}
+
+	report := FailureReport{
+		GeneratedAt: now,
+		Window:      config.Window.String(),
+		HalfLife:    config.HalfLife.String(),
+		Workers:     flag(workers, config.WorkerThreshold),
+		Databases:   flag(databases, config.DatabaseThreshold),
+		Pairs:       flag(pairs, config.PairThreshold),
+		Flagged:     make([]FailureScore, 0),
+	}
+
+	for _, scores := range [][]FailureScore{report.Pairs, report.Workers, report.Databases} {
+		for _, score := range scores {
+			if score.Flagged {
+				report.Flagged = append(report.Flagged, score)
+			}
+		}
+	}
+
+	return report
+}
+
+// reportingWorkers counts the distinct workers that reported errors for every database
+func reportingWorkers(pairs []FailureScore) map[string]int {
+
+	workers := make(map[string]int)
+	for _, pair := range pairs {
+		workers[pair.DbUrl]++
+	}
+
+	return workers
+}
+
+// decay returns the weight of an error of the given age. Without a half-life every error weighs 1.
+func decay(age, halfLife time.Duration) float64 {
+
+	if halfLife <= 0 {
+		return 1
+	}
+
+	return math.Pow(0.5, age.Seconds()/halfLife.Seconds())
+}
+
+// add adds count errors of the given weight each to the score of key
+func add[K comparable](scores map[K]*FailureScore, key K, empty FailureScore, count int, weight float64) {
+
+	score, ok := scores[key]
+	if !ok {
+		score = &empty
+		scores[key] = score
+	}
+
+	score.Count += count
+	score.Score += float64(count) * weight
+}
+
+// flag marks all scores above the threshold and returns them sorted by score, highest first
+func flag[K comparable](scores map[K]*FailureScore, threshold float64) []FailureScore {
+
+	flagged := make([]FailureScore, 0, len(scores))
+
+	for _, score := range scores {
+		score.Flagged = score.Score > threshold
+		flagged = append(flagged, *score)
+	}
+
+	sort.Slice(flagged, func(i, j int) bool { return flagged[i].Score > flagged[j].Score })
+
+	return flagged
+}
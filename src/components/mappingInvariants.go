@@ -0,0 +1,256 @@
+package components
+
+import (
+	sqlc "controller/src/database/sqlc"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// keySpaceStart is the smallest key that has to be covered by a mapping, the startup mapping begins its first range here
+const keySpaceStart = "a"
+
+// MappingViolationKind names an invariant of db_mapping that is violated.
+// A range starts at its "from" and ends where the next range starts, so the mappings cover the key space exactly once
+// if the smallest "from" is at most keySpaceStart, no "from" appears twice and every url is a registered database instance.
+// Since ranges have no explicit end, two ranges can only overlap by sharing the same "from".
+type MappingViolationKind string
+
+const (
+	MappingGap           MappingViolationKind = "gap"
+	MappingDuplicateFrom MappingViolationKind = "duplicate-from"
+	MappingUnknownUrl    MappingViolationKind = "unknown-url"
+)
+
+// MappingViolation is a single violated invariant and the mappings involved
+type MappingViolation struct {
+	Kind       MappingViolationKind
+	MappingIDs []string
+	From       string
+	Url        string
+	Detail     string
+}
+
+// MappingCheck is the result of the last invariant check
+type MappingCheck struct {
+	CheckedAt  time.Time
+	Violations []MappingViolation
+}
+
+// MappingRepairAction is a single fix proposed for a violation.
+// Only safe actions are applied automatically, all others move or drop data and need a migration instead.
+type MappingRepairAction struct {
+	Kind      MappingViolationKind
+	Action    string
+	MappingID string
+	Url       string
+	From      string
+	NewUrl    string
+	NewFrom   string
+	Safe      bool
+	Reason    string
+	Applied   bool
+	Error     string
+}
+
+const (
+	repairActionUpdate = "update"
+	repairActionDelete = "delete"
+)
+
+// MappingRepair is the result of the repair endpoint: the violations found and the actions proposed or applied for them
+type MappingRepair struct {
+	Violations []MappingViolation
+	Actions    []MappingRepairAction
+	Applied    bool
+}
+
+// checkMappingInvariants validates that the mappings cover the key space exactly once and only point to registered databases.
+// An empty mapping table is not a violation, the system has not been started up yet in that case.
+func checkMappingInvariants(mappings []sqlc.DbMapping, instances []sqlc.DbInstance) []MappingViolation {
+
+	violations := make([]MappingViolation, 0)
+
+	if len(mappings) == 0 {
+		return violations
+	}
+
+	sorted := sortedMappings(mappings)
+
+	if sorted[0].From > keySpaceStart {
+		violations = append(violations, MappingViolation{
+			Kind:       MappingGap,
+			MappingIDs: []string{sorted[0].ID.String()},
+			From:       sorted[0].From,
+			Url:        sorted[0].Url,
+			Detail:     fmt.Sprintf("keys from %q up to %q are not covered by any mapping", keySpaceStart, sorted[0].From),
+		})
+	}
+
+	for _, group := range duplicateGroups(sorted) {
+
+		ids := make([]string, 0, len(group))
+		for _, mapping := range group {
+			ids = append(ids, mapping.ID.String())
+		}
+
+		violations = append(violations, MappingViolation{
+			Kind:       MappingDuplicateFrom,
+			MappingIDs: ids,
+			From:       group[0].From,
+			Detail:     fmt.Sprintf("the range starting at %q is mapped %d times", group[0].From, len(group)),
+		})
+	}
+
+	known := make(map[string]struct{}, len(instances))
+	for _, instance := range instances {
+		known[instance.Url] = struct{}{}
+	}
+
+	for _, mapping := range sorted {
+		if _, ok := known[mapping.Url]; !ok {
+			violations = append(violations, MappingViolation{
+				Kind:       MappingUnknownUrl,
+				MappingIDs: []string{mapping.ID.String()},
+				From:       mapping.From,
+				Url:        mapping.Url,
+				Detail:     fmt.Sprintf("the range starting at %q is mapped to %s, which is not a registered database instance", mapping.From, mapping.Url),
+			})
+		}
+	}
+
+	return violations
+}
+
+// planMappingRepair proposes a fix for every violation:
+// duplicates are reduced to the mapping holding the most data, the first range is extended down to keySpaceStart,
+// and mappings of unknown databases are moved to the target with the most free space.
+func planMappingRepair(mappings []sqlc.DbMapping, instances, targets []sqlc.DbInstance) []MappingRepairAction {
+
+	actions := make([]MappingRepairAction, 0)
+
+	if len(mappings) == 0 {
+		return actions
+	}
+
+	known := make(map[string]struct{}, len(instances))
+	for _, instance := range instances {
+		known[instance.Url] = struct{}{}
+	}
+
+	deleted := make(map[string]struct{})
+
+	for _, group := range duplicateGroups(sortedMappings(mappings)) {
+
+		//keep the mapping with the most data, preferring registered databases
+		sort.SliceStable(group, func(i, j int) bool {
+			_, iKnown := known[group[i].Url]
+			_, jKnown := known[group[j].Url]
+			if group[i].Size != group[j].Size {
+				return group[i].Size > group[j].Size
+			}
+			return iKnown && !jKnown
+		})
+
+		for _, mapping := range group[1:] {
+			actions = append(actions, MappingRepairAction{
+				Kind:      MappingDuplicateFrom,
+				Action:    repairActionDelete,
+				MappingID: mapping.ID.String(),
+				Url:       mapping.Url,
+				From:      mapping.From,
+				Safe:      mapping.Size == 0,
+				Reason:    fmt.Sprintf("range %q is kept on %s, this mapping holds %d bytes", mapping.From, group[0].Url, mapping.Size),
+			})
+			deleted[mapping.ID.String()] = struct{}{}
+		}
+	}
+
+	remaining := make([]sqlc.DbMapping, 0, len(mappings))
+	for _, mapping := range sortedMappings(mappings) {
+		if _, ok := deleted[mapping.ID.String()]; !ok {
+			remaining = append(remaining, mapping)
+		}
+	}
+
+	if first := remaining[0]; first.From > keySpaceStart {
+		//nothing can be stored below the first range yet, so extending it does not move any data
+		actions = append(actions, MappingRepairAction{
+			Kind:      MappingGap,
+			Action:    repairActionUpdate,
+			MappingID: first.ID.String(),
+			Url:       first.Url,
+			From:      first.From,
+			NewUrl:    first.Url,
+			NewFrom:   keySpaceStart,
+			Safe:      true,
+			Reason:    fmt.Sprintf("extend the first range down to %q", keySpaceStart),
+		})
+	}
+
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].MaxSpace-targets[i].OccupiedSpace.Int64 > targets[j].MaxSpace-targets[j].OccupiedSpace.Int64
+	})
+
+	for _, mapping := range remaining {
+
+		if _, ok := known[mapping.Url]; ok {
+			continue
+		}
+
+		action := MappingRepairAction{
+			Kind:      MappingUnknownUrl,
+			Action:    repairActionUpdate,
+			MappingID: mapping.ID.String(),
+			Url:       mapping.Url,
+			From:      mapping.From,
+			NewFrom:   mapping.From,
+		}
+
+		if len(targets) == 0 {
+			action.Reason = "there is no healthy database instance to move the range to"
+			actions = append(actions, action)
+			continue
+		}
+
+		action.NewUrl = targets[0].Url
+		action.Safe = mapping.Size == 0
+		action.Reason = fmt.Sprintf("move the range to %s, the mapping holds %d bytes", targets[0].Url, mapping.Size)
+		actions = append(actions, action)
+	}
+
+	return actions
+}
+
+func sortedMappings(mappings []sqlc.DbMapping) []sqlc.DbMapping {
+
+	sorted := make([]sqlc.DbMapping, len(mappings))
+	copy(sorted, mappings)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].From < sorted[j].From })
+
+	return sorted
+}
+
+// duplicateGroups returns all groups of mappings that share the same "from", the mappings have to be sorted
+func duplicateGroups(sorted []sqlc.DbMapping) [][]sqlc.DbMapping {
+
+	groups := make([][]sqlc.DbMapping, 0)
+
+	for start := 0; start < len(sorted); {
+
+		end := start + 1
+		for end < len(sorted) && sorted[end].From == sorted[start].From {
+			end++
+		}
+
+		if end-start > 1 {
+			group := make([]sqlc.DbMapping, end-start)
+			copy(group, sorted[start:end])
+			groups = append(groups, group)
+		}
+
+		start = end
+	}
+
+	return groups
+}
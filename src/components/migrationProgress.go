@@ -0,0 +1,104 @@
+package components
+
+import (
+	sqlc "controller/src/database/sqlc"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MigrationProgressTracker remembers for every active migration job when its status, progress counter or migration worker last changed.
+// A job whose migration worker keeps heartbeating without the job changing is stuck.
+// The tracker only lives in memory, so after a failover every job gets the full stuck timeout again.
+type MigrationProgressTracker struct {
+	mu   sync.Mutex
+	jobs map[string]*jobProgress
+}
+
+type jobProgress struct {
+	workerId  string
+	status    string
+	progress  int64
+	changedAt time.Time
+}
+
+// MigrationProgressReport is the progress of a single migration job as shown in the system state
+type MigrationProgressReport struct {
+	JobID         string
+	WorkerID      string
+	Status        string
+	Progress      int64
+	LastChange    time.Time
+	NoChangeSince string
+}
+
+func NewMigrationProgressTracker() *MigrationProgressTracker {
+	return &MigrationProgressTracker{
+		jobs: make(map[string]*jobProgress),
+	}
+}
+
+// Observe records the current state of the job and returns for how long it has not changed
+func (t *MigrationProgressTracker) Observe(job sqlc.DbMigration, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	jobId := job.ID.String()
+	workerId := job.MWorkerID.String()
+
+	p, ok := t.jobs[jobId]
+	if !ok || p.workerId != workerId || p.status != job.Status || p.progress != job.Progress {
+		t.jobs[jobId] = &jobProgress{
+			workerId:  workerId,
+			status:    job.Status,
+			progress:  job.Progress,
+			changedAt: now,
+		}
+		return 0
+	}
+
+	return now.Sub(p.changedAt)
+}
+
+// Forget drops the progress of a job, e.g. after it was reassigned or failed
+func (t *MigrationProgressTracker) Forget(jobId string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.jobs, jobId)
+}
+
+// Retain drops the progress of all jobs that are not active anymore
+func (t *MigrationProgressTracker) Retain(active map[string]struct{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for id := range t.jobs {
+		if _, ok := active[id]; !ok {
+			delete(t.jobs, id)
+		}
+	}
+}
+
+// Report returns the progress of all tracked jobs
+func (t *MigrationProgressTracker) Report(now time.Time) []MigrationProgressReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	reports := make([]MigrationProgressReport, 0, len(t.jobs))
+
+	for id, p := range t.jobs {
+		reports = append(reports, MigrationProgressReport{
+			JobID:         id,
+			WorkerID:      p.workerId,
+			Status:        p.status,
+			Progress:      p.progress,
+			LastChange:    p.changedAt,
+			NoChangeSince: now.Sub(p.changedAt).Round(time.Second).String(),
+		})
+	}
+
+	sort.Slice(reports, func(i, j int) bool { return reports[i].JobID < reports[j].JobID })
+
+	return reports
+}
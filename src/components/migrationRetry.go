@@ -0,0 +1,25 @@
+package components
+
+import (
+	"time"
+)
+
+// MigrationRetryConfig configures how often and how fast migration jobs of dead or stuck migration workers are retried.
+// The n-th attempt of a job is started Backoff * 2^(n-1) after the previous one failed, but at most MaxBackoff after it.
+// A job that failed MaxAttempts times is failed for good.
+type MigrationRetryConfig struct {
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+}
+
+// backoff returns the delay before the next attempt of a job that already used the given number of attempts
+func (c MigrationRetryConfig) backoff(attempts int32) time.Duration {
+
+	backoff := c.Backoff
+	for i := int32(1); i < attempts && backoff < c.MaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	return min(backoff, c.MaxBackoff)
+}
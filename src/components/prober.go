@@ -0,0 +1,123 @@
+package components
+
+import (
+	"context"
+	"controller/src/database"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMongoPort is used for database urls that do not specify a port
+const defaultMongoPort = "27017"
+
+// probeAddresses extracts the host:port pairs from a database url.
+// Mongo connection strings can list several hosts of a replica set, e.g. mongodb://a:27017,b:27017/db,
+// urls without a scheme are treated as a plain host or host:port.
+func probeAddresses(rawUrl string) ([]string, error) {
+
+	hosts := rawUrl
+
+	if strings.Contains(rawUrl, "://") {
+		parsed, err := url.Parse(rawUrl)
+		if err != nil {
+			//url.Parse rejects some valid multi-host connection strings, so the host list is cut out by hand
+			rest := rawUrl[strings.Index(rawUrl, "://")+3:]
+			if at := strings.LastIndex(rest, "@"); at >= 0 {
+				rest = rest[at+1:]
+			}
+			if end := strings.IndexAny(rest, "/?"); end >= 0 {
+				rest = rest[:end]
+			}
+			hosts = rest
+		} else {
+			hosts = parsed.Host
+		}
+	}
+
+	addresses := make([]string, 0)
+
+	for _, host := range strings.Split(hosts, ",") {
+
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, defaultMongoPort)
+		}
+
+		addresses = append(addresses, host)
+	}
+
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no host found in database url %q", rawUrl)
+	}
+
+	return addresses, nil
+}
+
+// probeDatabase opens a TCP connection to every host of the database url and measures how long that takes.
+// The database counts as reachable if any of its hosts accepts a connection, the latency is the one of the fastest host.
+func probeDatabase(ctx context.Context, rawUrl string, timeout time.Duration) database.DbProbeResult {
+
+	result := database.DbProbeResult{Url: rawUrl}
+
+	addresses, err := probeAddresses(rawUrl)
+	if err != nil {
+		result.Err = err.Error()
+		return result
+	}
+
+	dialer := net.Dialer{Timeout: timeout}
+	errs := make([]string, 0)
+
+	for _, address := range addresses {
+
+		start := time.Now()
+
+		conn, dialErr := dialer.DialContext(ctx, "tcp", address)
+		if dialErr != nil {
+			errs = append(errs, dialErr.Error())
+			continue
+		}
+
+		latency := time.Since(start)
+		_ = conn.Close()
+
+		if !result.Reachable || latency < result.Latency {
+			result.Latency = latency
+		}
+		result.Reachable = true
+	}
+
+	if !result.Reachable {
+		result.Err = strings.Join(errs, "; ")
+	}
+
+	return result
+}
+
+// probeDatabases probes all given urls concurrently, so one unreachable database does not delay the others
+func probeDatabases(ctx context.Context, urls []string, timeout time.Duration) []database.DbProbeResult {
+
+	results := make([]database.DbProbeResult, len(urls))
+
+	var wg sync.WaitGroup
+
+	for i, u := range urls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = probeDatabase(ctx, u, timeout)
+		}()
+	}
+
+	wg.Wait()
+
+	return results
+}
@@ -0,0 +1,76 @@
+package components
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestProbeDatabases probes a local TCP stand-in for a database. The refused case dials a port nobody listens on,
+// the timeout case dials the live listener with a context whose deadline has already passed.
+func TestProbeDatabases(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer listener.Close()
+
+	//a listener that is closed right away leaves a port nobody listens on
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	refusedAddress := closed.Addr().String()
+	_ = closed.Close()
+
+	reachable := "mongodb://" + listener.Addr().String() + "/db"
+	refused := "mongodb://" + refusedAddress + "/db"
+
+	tests := []struct {
+		name      string
+		url       string
+		expired   bool
+		reachable bool
+		err       string
+	}{
+		{name: "reachable", url: reachable, reachable: true},
+		{name: "refused", url: refused, err: "refused"},
+		{name: "timeout", url: reachable, expired: true, err: "timeout"},
+		{name: "one host of a replica set is enough", url: "mongodb://" + refusedAddress + "," + listener.Addr().String() + "/db", reachable: true},
+		{name: "no host", url: "mongodb:///db", err: "no host found"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			ctx := context.Background()
+			if test.expired {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithDeadline(ctx, time.Now().Add(-time.Second))
+				defer cancel()
+			}
+
+			results := probeDatabases(ctx, []string{test.url}, time.Second)
+			if len(results) != 1 {
+				t.Fatalf("expected 1 result, got %d", len(results))
+			}
+
+			result := results[0]
+
+			if result.Url != test.url || result.Reachable != test.reachable {
+				t.Errorf("expected %s to be reachable=%t, got reachable=%t", test.url, test.reachable, result.Reachable)
+			}
+
+			if (result.Latency > 0) != test.reachable {
+				t.Errorf("expected a latency only for a reachable database, got %s", result.Latency)
+			}
+
+			if !strings.Contains(result.Err, test.err) || (result.Err == "") != test.reachable {
+				t.Errorf("expected error containing %q, got %q", test.err, result.Err)
+			}
+		})
+	}
+}
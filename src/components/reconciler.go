@@ -3,43 +3,99 @@ package components
 import (
 	"context"
 	"controller/src/database"
+	sqlc "controller/src/database/sqlc"
 	"controller/src/docker"
 	ownErrors "controller/src/errors"
+	"controller/src/utils"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgtype"
 	goutils "github.com/linusgith/goutils/pkg/env_utils"
 	"go.uber.org/zap"
 	"time"
 )
 
+// LeadershipConfig identifies this controller in the controller row. ControllerId has to be unique per process,
+// the leader is the controller whose id is in the row, and a shadow may only take over once the heartbeat is older than HeartbeatTimeout.
+type LeadershipConfig struct {
+	ControllerId     string
+	HeartbeatTimeout time.Duration
+}
+
 // Reconciler handles all tasks concerning the health of the overall system.
 // Meaning it checks for controller, worker, migration_worker, monitor health and reconciles when there is a failure
 type Reconciler struct {
 	logger     *zap.Logger
-	reader     *database.Reader
-	readerPerf *database.ReaderPerfectionist
-	writer     *database.Writer
-	writerPerf *database.WriterPerfectionist
+	reader     database.ReadStore
+	writer     database.WriteStore
 	dInterface docker.DInterface
+	clock      *DbClock
+	health     *WorkerHealthTracker
+	progress   *MigrationProgressTracker
+	audit      *Auditor
+
+	//heartbeatTimeout is how old the heartbeat of a worker or migration worker may get before it counts as dead
+	heartbeatTimeout time.Duration
+	leadership       LeadershipConfig
+
+	failureRate FailureRateConfig
+	failures    *FailureReports
+	retry       MigrationRetryConfig
+}
+
+// ReconcilerDeps are the stores, trackers and settings a Reconciler works with. Clock, Health, Progress, Audit and Failures
+// are shared with the Scheduler. HeartbeatTimeout is how old the heartbeat of a worker or migration worker may get before it counts as dead.
+type ReconcilerDeps struct {
+	Logger   *zap.Logger
+	Reader   database.ReadStore
+	Writer   database.WriteStore
+	Docker   docker.DInterface
+	Clock    *DbClock
+	Health   *WorkerHealthTracker
+	Progress *MigrationProgressTracker
+	Audit    *Auditor
+	Failures *FailureReports
+
+	HeartbeatTimeout time.Duration
+	Leadership       LeadershipConfig
+	FailureRate      FailureRateConfig
+	Retry            MigrationRetryConfig
 }
 
-func NewReconciler(logger *zap.Logger, dbReader *database.Reader, readerPerf *database.ReaderPerfectionist, dbWriter *database.Writer, writerPerf *database.WriterPerfectionist, dInterface docker.DInterface) Reconciler {
+func NewReconciler(deps ReconcilerDeps) Reconciler {
+	//postgres cannot divide by a zero bucket
+	deps.FailureRate.Bucket = max(deps.FailureRate.Bucket, time.Second)
+
 	return Reconciler{
-		logger:     logger,
-		reader:     dbReader,
-		readerPerf: readerPerf,
-		writer:     dbWriter,
-		writerPerf: writerPerf,
-		dInterface: dInterface,
+		logger:     deps.Logger,
+		reader:     deps.Reader,
+		writer:     deps.Writer,
+		dInterface: deps.Docker,
+		clock:      deps.Clock,
+		health:     deps.Health,
+		progress:   deps.Progress,
+		audit:      deps.Audit,
+
+		heartbeatTimeout: deps.HeartbeatTimeout,
+		leadership:       deps.Leadership,
+
+		failureRate: deps.FailureRate,
+		failures:    deps.Failures,
+		retry:       deps.Retry,
 	}
 }
 
+// PingDB checks if the database is reachable. Failing to reach it is left to the caller to handle,
+// the supervisor takes care of demoting the leader if the database stays unreachable.
 func (r *Reconciler) PingDB(ctx context.Context) error {
 
-	err := r.readerPerf.Ping(ctx)
+	err := r.reader.Ping(ctx)
 	if err != nil {
-		//We kill the controller so the shadow can step in
-		r.logger.Fatal("pinging the database failed; deactivating as leader", zap.Error(err))
+		r.logger.Warn("pinging the database failed", zap.Error(err))
+		return err
 	}
 
 	return nil
@@ -47,8 +103,9 @@ func (r *Reconciler) PingDB(ctx context.Context) error {
 
 func (r *Reconciler) Heartbeat(ctx context.Context) error {
 
-	//We don't make the controller terminate here since its trying to ping the database every second anyway, and if that fails it will shut off
-	heartbeatErr := r.writerPerf.Heartbeat(ctx)
+	//Failing heartbeats are handled by the supervisor, which demotes the controller if it cannot write anymore
+	//or right away if another controller took over the row
+	heartbeatErr := r.writer.Heartbeat(ctx, r.leadership.ControllerId)
 	if heartbeatErr != nil {
 		return heartbeatErr
 	}
@@ -56,9 +113,11 @@ func (r *Reconciler) Heartbeat(ctx context.Context) error {
 	return nil
 }
 
+// RegisterController makes this controller the leader if there was none or the previous one stopped heartbeating.
+// If another controller is alive or won the takeover, the returned error wraps ErrLeadershipLost.
 func (r *Reconciler) RegisterController(ctx context.Context) error {
 
-	if err := r.writerPerf.RegisterController(ctx); err != nil {
+	if err := r.writer.RegisterController(ctx, r.leadership.ControllerId, r.leadership.HeartbeatTimeout); err != nil {
 		return err
 	}
 
@@ -66,18 +125,24 @@ func (r *Reconciler) RegisterController(ctx context.Context) error {
 
 }
 
-// CheckControllerUp checks if the controller has a valid heartbeat and if not, activates the shadow as the new controller
+// CheckControllerUp checks if the controller has a valid heartbeat and if not, activates the shadow as the new controller.
+// The heartbeat is written and evaluated with the database clock, so clock drift between the controller hosts does not matter.
 func (r *Reconciler) CheckControllerUp(ctx context.Context) error {
 
-	timeout := goutils.Log().ParseEnvDurationDefault("CONTROLLER_HEARTBEAT_TIMEOUT", 10*time.Second, r.logger)
+	timeout := r.leadership.HeartbeatTimeout
 
-	state, err := r.readerPerf.GetControllerState(ctx)
+	state, err := r.reader.GetControllerState(ctx)
 	if err != nil {
 		errW := fmt.Errorf("checking if controller is running failed: %w", err)
 		return errW
 	}
 
-	timeSinceHeartbeat := time.Now().Sub(state.LastHeartbeat.Time)
+	dbNow, err := r.clock.Sync(ctx)
+	if err != nil {
+		return fmt.Errorf("reading database clock failed: %w", err)
+	}
+
+	timeSinceHeartbeat := dbNow.Sub(state.LastHeartbeat.Time)
 
 	r.logger.Debug("time since last heartbeat from controller", zap.Float64("seconds", timeSinceHeartbeat.Seconds()))
 
@@ -91,12 +156,13 @@ func (r *Reconciler) CheckControllerUp(ctx context.Context) error {
 
 }
 
-// EvaluateWorkerState evaluates if all workers have a valid heartbeat and uptime;
-// if that is not the case, the workers are removed from the "workers" table and hence no longer belong to the system
-// This function should be called in a goroutine to be executed in the background
-func (r *Reconciler) EvaluateWorkerState(ctx context.Context, timeout time.Duration) error {
+// EvaluateWorkerState evaluates if all workers have a valid heartbeat and uptime and moves them through the worker health
+// state machine (healthy -> suspect -> quarantined -> evicted). Every worker is evaluated exactly once per call.
+// Evicted workers are removed from the "workers" table and hence no longer belong to the system.
+// This function should be called periodically in the background
+func (r *Reconciler) EvaluateWorkerState(ctx context.Context) error {
 
-	state, err := r.readerPerf.GetControllerState(ctx)
+	state, err := r.reader.GetControllerState(ctx)
 	if err != nil {
 		return err
 	}
@@ -109,62 +175,65 @@ func (r *Reconciler) EvaluateWorkerState(ctx context.Context, timeout time.Durat
 		minimumUptime = goutils.Log().ParseEnvDurationDefault("MINIMUM_WORKER_UPTIME", 5*time.Second, r.logger)
 	}
 
-	workers, err := r.readerPerf.GetAllWorkerState(ctx)
+	workers, err := r.reader.GetAllWorkerState(ctx)
 	if err != nil {
 		r.logger.Error("error evaluating worker state", zap.Error(err))
 		return err
 	}
 
-	for _, worker := range workers {
-
-		r.logger.Debug("Reading data for worker", zap.String("uuid", worker.ID.String()))
+	dbNow, err := r.clock.Sync(ctx)
+	if err != nil {
+		return fmt.Errorf("reading database clock failed: %w", err)
+	}
 
-		//Delay = time_since_last_heartbeat - specified_heartbeat_frequency
-		err = workerHeartbeatOK(worker.LastHeartbeat, timeout)
-		if err != nil {
+	now := time.Now()
+	present := make(map[string]struct{}, len(workers))
 
-			go func() {
-				r.logger.Warn("Detected delayed worker heartbeat, trying again", zap.Error(err), zap.String("workerId", worker.ID.String()))
+	for _, worker := range workers {
 
-				//Recheck the state of the worker to see if it still recovers, if it doesn't remove it
-				workerState, dbErr := r.readerPerf.GetSingleWorkerState(ctx, worker.ID.String())
-				if dbErr != nil || workerHeartbeatOK(workerState.LastHeartbeat, timeout) != nil {
+		workerId := worker.ID.String()
+		present[workerId] = struct{}{}
 
-					r.logger.Warn("worker did not recover or could not be fetched from db; removing...", zap.String("workerId", worker.ID.String()), zap.NamedError("dbErr", err), zap.Bool("heartBeatOk", workerHeartbeatOK(worker.LastHeartbeat, timeout) == nil))
+		r.logger.Debug("Reading data for worker", zap.String("uuid", workerId))
 
-					if removeErr := r.writerPerf.RemoveWorker(worker.ID, ctx); err != nil {
-						r.logger.Error("could not remove non-functional worker from table", zap.String("workerId", worker.ID.String()), zap.Error(removeErr))
-					}
+		//the heartbeat age is corrected by the estimated clock skew of the worker
+		skew := r.clock.Observe(workerId, worker.LastHeartbeat.Time, dbNow)
 
-				}
-			}()
+		//Delay = time_since_last_heartbeat - specified_heartbeat_frequency
+		problem := workerHeartbeatOK(worker.LastHeartbeat, dbNow.Add(-skew), r.heartbeatTimeout)
 
+		if problem == nil && !isScaling && worker.Uptime.Microseconds < minimumUptime.Microseconds() {
+			problem = fmt.Errorf("uptime of worker is lower than the minimum uptime of %v", minimumUptime)
 		}
 
-		if !isScaling && worker.Uptime.Microseconds < minimumUptime.Microseconds() {
-
-			r.logger.Warn("Detected worker with unusually low uptime, trying again", zap.String("workerID", worker.ID.String()), zap.Duration("retryTimeout", time.Second))
+		transition := r.health.Evaluate(workerId, problem, now)
 
-			go func() {
-				workerState, dbErr := r.readerPerf.GetSingleWorkerState(ctx, worker.ID.String())
-				if dbErr != nil || workerState.Uptime.Microseconds < minimumUptime.Microseconds() {
-
-					r.logger.Warn("worker did not recover or could not be fetched from db; removing...", zap.String("workerId", worker.ID.String()), zap.NamedError("dbErr", err), zap.Bool("uptimeOk", !isScaling && workerState.Uptime.Microseconds < minimumUptime.Microseconds()))
+		if transition.Changed() {
+			r.logger.Warn("worker changed health state", zap.String("workerId", workerId), zap.String("from", string(transition.From)), zap.String("to", string(transition.To)), zap.String("reason", transition.Reason), zap.Bool("flapping", transition.Flapping))
+		} else if transition.Flapping {
+			r.logger.Debug("worker is flapping", zap.String("workerId", workerId), zap.String("state", string(transition.To)))
+		}
 
-					if removeErr := r.writerPerf.RemoveWorker(worker.ID, ctx); err != nil {
-						r.logger.Error("could not remove non-functional worker from table", zap.String("workerId", worker.ID.String()), zap.Error(removeErr))
-						return
-					}
-				}
+		if transition.To != WorkerEvicted {
+			continue
+		}
 
-				if removeErr := r.writerPerf.RemoveWorker(worker.ID, ctx); err != nil {
-					r.logger.Error("could not remove non-functional worker from table", zap.String("workerId", worker.ID.String()), zap.Error(removeErr))
-				}
-			}()
+		//if removing fails the worker stays evicted and removing it is tried again in the next cycle
+		if removeErr := r.writer.RemoveWorker(worker.ID, ctx); removeErr != nil {
+			r.logger.Error("could not remove evicted worker from table", zap.String("workerId", workerId), zap.Error(removeErr))
+			continue
 		}
 
+		r.logger.Warn("removed evicted worker", zap.String("workerId", workerId), zap.String("reason", transition.Reason))
+		r.audit.Record(ctx, actorReconciler, auditWorkerEvict, workerId, transition.Reason, worker, nil)
+
+		r.health.Forget(workerId)
+		r.clock.Forget(workerId)
 	}
 
+	//workers that disappeared from the table on their own should not be tracked anymore
+	r.health.Retain(present)
+
 	return nil
 
 }
@@ -174,30 +243,60 @@ func (r *Reconciler) EvaluateWorkerState(ctx context.Context, timeout time.Durat
 // This function should be called in a goroutine to be executed in the background
 func (r *Reconciler) EvaluateMigrationWorkerState(ctx context.Context) error {
 
-	migrationWorkerState, err := r.readerPerf.GetAllMWorkerState(ctx)
+	migrationWorkerState, err := r.reader.GetAllMWorkerState(ctx)
 	if err != nil {
 		r.logger.Error("error getting the migration worker state")
 		return err
 	}
 
-	maxAgeHeartbeat := goutils.Log().ParseEnvDurationDefault("WORKER_HEARTBEAT_TIMEOUT", 10*time.Second, r.logger)
+	dbNow, err := r.clock.Sync(ctx)
+	if err != nil {
+		return fmt.Errorf("reading database clock failed: %w", err)
+	}
+
+	//the jobs are only loaded once a dead migration worker is found
+	var activeJobs []sqlc.DbMigration
 
 	workersPresent := false
 	for _, worker := range migrationWorkerState {
 
 		workersPresent = true
 
-		r.logger.Debug("time and migration worker heartbeat", zap.String("workerId", worker.ID.String()), zap.Time("current", time.Now()), zap.Time("heartbeat", worker.LastHeartbeat.Time))
+		r.logger.Debug("time and migration worker heartbeat", zap.String("workerId", worker.ID.String()), zap.Time("current", dbNow), zap.Time("heartbeat", worker.LastHeartbeat.Time))
+
+		skew := r.clock.Observe(worker.ID.String(), worker.LastHeartbeat.Time, dbNow)
 
-		err = workerHeartbeatOK(worker.LastHeartbeat, maxAgeHeartbeat)
+		err = workerHeartbeatOK(worker.LastHeartbeat, dbNow.Add(-skew), r.heartbeatTimeout)
 		if err != nil {
-			r.logger.Warn("heartbeat for migration worker was not ok, removing from the database", zap.String("workerId", worker.ID.String()))
+			r.logger.Warn("heartbeat for migration worker was not ok, requeueing its jobs and removing it from the database", zap.String("workerId", worker.ID.String()))
 
-			err = r.writerPerf.RemoveMWorkerAndJobs(ctx, worker.ID.String())
+			//a worker that stopped heartbeating may still be running, its jobs are only handed on once it is gone for sure
+			if stopErr := r.dInterface.StopMigrationWorker(ctx, worker.ID.String()); stopErr != nil {
+				r.logger.Error("could not stop container of dead migration worker, keeping it until the next cycle", zap.String("workerId", worker.ID.String()), zap.Error(stopErr))
+				continue
+			}
+
+			if activeJobs == nil {
+				activeJobs, err = r.reader.GetActiveMigrationJobs(ctx)
+				if err != nil {
+					return fmt.Errorf("loading active migration jobs failed: %w", err)
+				}
+			}
+
+			if requeueErr := r.requeueWorkerJobs(ctx, worker.ID.String(), activeJobs, "migration worker "+worker.ID.String()+" died"); requeueErr != nil {
+				r.logger.Error("could not requeue jobs of dead migration worker, keeping it until the next cycle", zap.String("workerId", worker.ID.String()), zap.Error(requeueErr))
+				continue
+			}
+
+			err = r.writer.RetireMigrationWorker(ctx, worker.ID.String())
 			if err != nil {
 				r.logger.Error("could not remove migration worker from the table", zap.Error(err))
+				continue
 			}
 
+			r.audit.Record(ctx, actorReconciler, auditMigrationWorkerRemove, worker.ID.String(), "heartbeat timed out", worker, nil)
+
+			r.clock.Forget(worker.ID.String())
 		}
 
 	}
@@ -209,132 +308,518 @@ func (r *Reconciler) EvaluateMigrationWorkerState(ctx context.Context) error {
 	return nil
 }
 
-// CheckFailureRate queries all rows from the corresponding table in the database and runs some simple data aggregation to determine whether there is an unusually high failure rate in the last half hour (this goes for dbs, workers or db-worker-relationships)
-func (r *Reconciler) CheckFailureRate(ctx context.Context) error {
-	now := time.Now()
-
-	r.logger.Debug("checking if there are unusually high failure rates in the last 30 minutes")
+// ResumeMigrations is called when this controller takes over as leader. It loads all migration jobs that have not reached a
+// terminal state and checks whether their migration worker is still alive (heartbeat in the database and running container).
+// Jobs with a live worker are resumed, jobs with a dead worker are requeued for another attempt,
+// or failed if they used up all attempts. The decision for every job is recorded in its status reason.
+func (r *Reconciler) ResumeMigrations(ctx context.Context) error {
 
-	connErrorStructList, err := r.readerPerf.GetDBConnErrors(ctx)
+	jobs, err := r.reader.GetActiveMigrationJobs(ctx)
 	if err != nil {
-		return err
+		return fmt.Errorf("loading active migration jobs failed: %w", err)
 	}
 
-	// Maps to track unique workers and databases
-	workerToIndex := make(map[string]int)
-	dbToIndex := make(map[string]int)
-	workerList := []string{}
-	dbList := []string{}
+	r.logger.Info("resuming in-flight migrations after takeover", zap.Int("jobCount", len(jobs)))
 
-	// First pass: collect unique workers and databases from recent errors and delete old ones
-	for _, connError := range connErrorStructList {
-		failureTime := connError.FailTime.Time
+	if _, clockErr := r.clock.Sync(ctx); clockErr != nil {
+		return fmt.Errorf("reading database clock failed: %w", clockErr)
+	}
+
+	for _, job := range jobs {
 
-		// Delete errors older than 30 minutes
-		if !failureTime.After(now.Add(-30 * time.Minute)) {
-			if err := r.writerPerf.DeleteDBConnErrors(ctx, connError.DbUrl, connError.WorkerID, connError.FailTime); err != nil {
-				r.logger.Error("failed to delete old connection error", zap.Error(err))
+		jobId := job.ID.String()
+		workerId := job.MWorkerID.String()
 
-				return err
+		alive, deadReason := r.migrationWorkerAlive(ctx, workerId, r.heartbeatTimeout)
+		if alive {
+			r.logger.Info("migration worker of in-flight job is alive, resuming", zap.String("jobId", jobId), zap.String("workerId", workerId))
+
+			if reasonErr := r.writer.SetMigrationJobReason(ctx, jobId, "resumed after controller failover, migration worker "+workerId+" is alive"); reasonErr != nil {
+				r.logger.Warn("could not record reason for resumed migration job", zap.String("jobId", jobId), zap.Error(reasonErr))
 			}
 			continue
 		}
 
-		workerID := connError.WorkerID.String()
-		dbURL := connError.DbUrl.String
+		r.logger.Warn("migration worker of in-flight job is dead, requeueing", zap.String("jobId", jobId), zap.String("workerId", workerId), zap.String("reason", deadReason))
 
-		// Add worker if not seen before
-		if _, exists := workerToIndex[workerID]; !exists {
-			workerToIndex[workerID] = len(workerList)
-			workerList = append(workerList, workerID)
+		//the job is left alone until the worker state check gets to it, so it never runs on two workers
+		if stopErr := r.dInterface.StopMigrationWorker(ctx, workerId); stopErr != nil {
+			r.logger.Error("could not stop container of dead migration worker, not requeueing its job", zap.String("jobId", jobId), zap.String("workerId", workerId), zap.Error(stopErr))
+			continue
 		}
 
-		// Add database if not seen before
-		if _, exists := dbToIndex[dbURL]; !exists {
-			dbToIndex[dbURL] = len(dbList)
-			dbList = append(dbList, dbURL)
+		if requeueErr := r.requeueOrFail(ctx, job, "after controller failover", deadReason); requeueErr != nil {
+			r.logger.Error("could not requeue migration job of dead worker", zap.String("jobId", jobId), zap.Error(requeueErr))
 		}
 	}
 
-	// Initialize 2D slice with zeros
-	errorToFrequency := make([][]int, len(workerList))
-	for i := range errorToFrequency {
-		errorToFrequency[i] = make([]int, len(dbList))
+	return nil
+}
+
+// CheckStuckMigrations flags active migration jobs whose status, progress counter and migration worker did not change
+// for longer than stuckTimeout, even though their migration worker may still be heartbeating.
+// The container of the stuck worker is stopped first, so the job never runs on two workers once it is dispatched again.
+// Then the job is requeued for another attempt, or failed if it used up all attempts, and the stuck worker is retired.
+// If the container cannot be stopped, the job stays where it is and is tried again in the next cycle.
+func (r *Reconciler) CheckStuckMigrations(ctx context.Context, stuckTimeout time.Duration) error {
+
+	jobs, err := r.reader.GetActiveMigrationJobs(ctx)
+	if err != nil {
+		return fmt.Errorf("loading active migration jobs failed: %w", err)
 	}
 
-	// Second pass: populate the 2D matrix with error counts
-	for _, connError := range connErrorStructList {
-		failureTime := connError.FailTime.Time
+	now := r.clock.Now()
+	active := make(map[string]struct{}, len(jobs))
+
+	for _, job := range jobs {
 
-		// Skip errors that are not in the last 30 minutes
-		if !failureTime.After(now.Add(-30 * time.Minute)) {
+		jobId := job.ID.String()
+		active[jobId] = struct{}{}
+
+		stalled := r.progress.Observe(job, now)
+		if stalled <= stuckTimeout {
 			continue
 		}
 
-		workerID := connError.WorkerID.String()
-		dbURL := connError.DbUrl.String
+		workerId := job.MWorkerID.String()
+		cause := fmt.Sprintf("no progress on migration worker %s for %s (status %s, progress %d)", workerId, stalled.Round(time.Second), job.Status, job.Progress)
 
-		workerIdx := workerToIndex[workerID]
-		dbIdx := dbToIndex[dbURL]
+		r.logger.Warn("migration job is stuck, requeueing", zap.String("jobId", jobId), zap.String("workerId", workerId), zap.Duration("stalled", stalled))
 
-		errorToFrequency[workerIdx][dbIdx]++
+		if stopErr := r.dInterface.StopMigrationWorker(ctx, workerId); stopErr != nil {
+			r.logger.Error("could not stop container of stuck migration worker, not requeueing its job", zap.String("jobId", jobId), zap.String("workerId", workerId), zap.Error(stopErr))
+			continue
+		}
+
+		if requeueErr := r.requeueOrFail(ctx, job, "because it was stuck", cause); requeueErr != nil {
+			r.logger.Error("could not requeue stuck migration job", zap.String("jobId", jobId), zap.Error(requeueErr))
+			continue
+		}
+
+		r.progress.Forget(jobId)
+
+		//a worker without a job would look free, so the stuck worker is retired before it is handed the next job
+		if retireErr := r.writer.RetireMigrationWorker(ctx, workerId); retireErr != nil {
+			r.logger.Warn("could not retire stuck migration worker", zap.String("workerId", workerId), zap.Error(retireErr))
+			continue
+		}
+
+		r.audit.Record(ctx, actorReconciler, auditMigrationWorkerRemove, workerId, cause, nil, nil)
+
+		r.clock.Forget(workerId)
+	}
+
+	r.progress.Retain(active)
+
+	return nil
+}
+
+// DispatchQueuedMigrations hands every queued migration job whose next attempt is due to a live migration worker,
+// spawning a new one if there is none. Jobs that cannot be dispatched stay queued and are tried again after the backoff,
+// this does not count as an attempt.
+func (r *Reconciler) DispatchQueuedMigrations(ctx context.Context) error {
+
+	jobs, err := r.reader.GetDueMigrationJobs(ctx)
+	if err != nil {
+		return fmt.Errorf("loading due migration jobs failed: %w", err)
 	}
 
-	// Collect all warnings for final report
-	var warnings []string
+	for _, job := range jobs {
 
-	// Evaluate individual cells (worker-database combinations)
-	for i, workerID := range workerList {
-		for j, dbURL := range dbList {
-			errorCount := errorToFrequency[i][j]
-			if errorCount > 3 {
-				warnings = append(warnings, fmt.Sprintf("Worker %s + Database %s: %d errors", workerID, dbURL, errorCount))
+		jobId := job.ID.String()
+
+		workerId, claimed, dispatchErr := r.dispatchMigrationJob(ctx, job)
+		if errors.Is(dispatchErr, pgx.ErrNoRows) {
+			//there is no live worker without a job, so one is started and claimed right away
+			if _, dispatchErr = r.spawnMigrationWorker(ctx, job.From, job.To); dispatchErr == nil {
+				workerId, claimed, dispatchErr = r.dispatchMigrationJob(ctx, job)
+			}
+		}
+
+		if dispatchErr != nil {
+			r.logger.Warn("no migration worker available for queued job", zap.String("jobId", jobId), zap.Error(dispatchErr))
+
+			nextAttemptAt := r.clock.Now().Add(r.retry.backoff(job.Attempts))
+			reason := fmt.Sprintf("attempt %d is waiting for a migration worker: %v", job.Attempts+1, dispatchErr)
+
+			if requeueErr := r.writer.RequeueMigrationJob(ctx, jobId, nextAttemptAt, reason); requeueErr != nil {
+				r.logger.Error("could not postpone queued migration job", zap.String("jobId", jobId), zap.Error(requeueErr))
+				continue
 			}
+
+			r.audit.Record(ctx, actorReconciler, auditMigrationRequeue, jobId, reason, job, map[string]any{"status": database.MigrationStatusQueued, "nextAttemptAt": nextAttemptAt})
+			continue
+		}
+
+		if !claimed {
+			r.logger.Debug("queued migration job was claimed elsewhere or is not queued anymore", zap.String("jobId", jobId))
+			continue
+		}
+
+		reason := dispatchReason(job, workerId, r.retry.MaxAttempts)
+
+		r.logger.Info("dispatched queued migration job", zap.String("jobId", jobId), zap.String("workerId", workerId), zap.Int32("attempt", job.Attempts+1))
+		r.audit.Record(ctx, actorReconciler, auditMigrationDispatch, jobId, reason, job, map[string]any{"status": database.MigrationStatusWaiting, "workerId": workerId, "attempts": job.Attempts + 1})
+	}
+
+	return nil
+}
+
+// dispatchMigrationJob claims the queued job and a live migration worker without a job in one transaction and assigns the job to it.
+// claimed is false if the job is not queued anymore or locked by someone else. If there is no free worker, the error wraps pgx.ErrNoRows.
+func (r *Reconciler) dispatchMigrationJob(ctx context.Context, job sqlc.DbMigration) (workerId string, claimed bool, err error) {
+
+	jobId := job.ID.String()
+	aliveSince := r.clock.Now().Add(-r.heartbeatTimeout)
+
+	err = r.writer.Transaction(ctx, "DispatchQueuedMigration", func(uow database.TxWriter) ownErrors.DbError {
+
+		claimed = false
+
+		claimedJob, oeErr := uow.ClaimQueuedMigrationJob(jobId)
+		if oeErr.Kind == ownErrors.DbErrNoRows {
+			return ownErrors.DbError{Err: nil}
+		}
+		if oeErr.Err != nil {
+			return oeErr
+		}
+
+		workerId, oeErr = uow.ClaimFreeMigrationWorker(aliveSince)
+		if oeErr.Err != nil {
+			return oeErr
+		}
+
+		claimed = true
+		return uow.ReassignMigrationJob(jobId, workerId, dispatchReason(claimedJob, workerId, r.retry.MaxAttempts))
+	})
+
+	return workerId, claimed, err
+}
+
+// dispatchReason is the status reason of a job that is dispatched to a migration worker
+func dispatchReason(job sqlc.DbMigration, workerId string, maxAttempts int) string {
+	return fmt.Sprintf("attempt %d of %d dispatched to migration worker %s", job.Attempts+1, maxAttempts, workerId)
+}
+
+// requeueOrFail detaches the job from its migration worker and queues it for another attempt after an exponential backoff,
+// or fails it for good if it used up all attempts. occasion and cause are recorded in the status reason of the job.
+func (r *Reconciler) requeueOrFail(ctx context.Context, job sqlc.DbMigration, occasion, cause string) error {
+
+	jobId := job.ID.String()
+
+	if int(job.Attempts) >= r.retry.MaxAttempts {
+		failReason := fmt.Sprintf("failed %s after %d of %d attempts: %s", occasion, job.Attempts, r.retry.MaxAttempts, cause)
+
+		r.logger.Warn("migration job used up all attempts, failing it", zap.String("jobId", jobId), zap.Int32("attempts", job.Attempts))
+		if err := r.writer.FailMigrationJob(ctx, jobId, failReason); err != nil {
+			return err
+		}
+
+		r.audit.Record(ctx, actorReconciler, auditMigrationFail, jobId, failReason, job, map[string]any{"status": database.MigrationStatusFailed})
+		return nil
+	}
+
+	nextAttemptAt := r.clock.Now().Add(r.retry.backoff(job.Attempts))
+	reason := fmt.Sprintf("requeued %s after attempt %d of %d: %s", occasion, job.Attempts, r.retry.MaxAttempts, cause)
+
+	if err := r.writer.RequeueMigrationJob(ctx, jobId, nextAttemptAt, reason); err != nil {
+		return err
+	}
+
+	r.audit.Record(ctx, actorReconciler, auditMigrationRequeue, jobId, reason, job, map[string]any{"status": database.MigrationStatusQueued, "nextAttemptAt": nextAttemptAt})
+	return nil
+}
+
+// requeueWorkerJobs requeues or fails all active jobs of the given migration worker
+func (r *Reconciler) requeueWorkerJobs(ctx context.Context, workerId string, activeJobs []sqlc.DbMigration, cause string) error {
+
+	for _, job := range activeJobs {
+
+		if job.MWorkerID.String() != workerId {
+			continue
+		}
+
+		if err := r.requeueOrFail(ctx, job, "after its migration worker died", cause); err != nil {
+			return err
 		}
+
+		r.progress.Forget(job.ID.String())
+	}
+
+	return nil
+}
+
+// migrationWorkerAlive checks if the migration worker with the given id still has a valid heartbeat and a running container.
+// If it is not alive, the returned string describes why.
+// If the docker daemon cannot be queried, the heartbeat alone decides.
+func (r *Reconciler) migrationWorkerAlive(ctx context.Context, workerId string, timeout time.Duration) (bool, string) {
+
+	worker, err := r.reader.GetSingleMWorkerState(ctx, workerId)
+	if err != nil {
+		return false, fmt.Sprintf("migration worker %s could not be fetched from the database: %v", workerId, err)
+	}
+
+	if hbErr := workerHeartbeatOK(worker.LastHeartbeat, r.clock.Now(), timeout); hbErr != nil {
+		return false, fmt.Sprintf("migration worker %s has no valid heartbeat: %v", workerId, hbErr)
+	}
+
+	running, dockerErr := r.dInterface.MigrationWorkerRunning(ctx, workerId)
+	if dockerErr != nil {
+		r.logger.Warn("could not check container of migration worker, relying on heartbeat", zap.String("workerId", workerId), zap.Error(dockerErr))
+		return true, ""
+	}
+
+	if !running {
+		return false, fmt.Sprintf("no running container found for migration worker %s", workerId)
 	}
 
-	// Evaluate rows (per worker across all databases)
-	for i, workerID := range workerList {
-		rowSum := 0
-		for j := 0; j < len(dbList); j++ {
-			rowSum += errorToFrequency[i][j]
+	return true, ""
+}
+
+// spawnMigrationWorker adds a new migration worker to the database and starts its container.
+// If the container cannot be started, the worker is removed from the database again.
+func (r *Reconciler) spawnMigrationWorker(ctx context.Context, from, to string) (string, error) {
+
+	workerId := uuid.New().String()
+
+	if err := r.writer.AddMigrationWorker(workerId, from, to, ctx); err != nil {
+		return "", fmt.Errorf("could not add migration worker (id : %s) to table: %w", workerId, err)
+	}
+
+	req := r.dInterface.SendMWorkerRequest(ctx, workerId)
+	if responseErr := utils.ChanWihTimeout(req); responseErr != nil {
+
+		if removeErr := r.writer.RemoveMigrationWorker(workerId, ctx); removeErr != nil {
+			r.logger.Error("could not remove migration worker from database after starting its container failed", zap.String("workerId", workerId), zap.Error(removeErr))
 		}
-		if rowSum > 3 {
-			warnings = append(warnings, fmt.Sprintf("Worker %s (all databases): %d errors", workerID, rowSum))
+
+		return "", fmt.Errorf("spawning migration worker failed: %w", responseErr)
+	}
+
+	r.logger.Info("spawned new migration worker", zap.String("workerId", workerId))
+	r.audit.Record(ctx, actorReconciler, auditMigrationWorkerCreate, workerId, "no free migration worker for a queued job", nil, map[string]any{"from": from, "to": to})
+	return workerId, nil
+}
+
+// CheckFailureRate scores all connection errors within the configured window per worker, per database and per worker-database pair.
+// Errors decay exponentially with their age, so a burst of recent errors is flagged while the same number of old errors is not.
+// It only reads them, errors older than the window are deleted by the conn-error-retention task, see PurgeConnErrors.
+// The resulting report is persisted in the failure report history, returned and kept as the latest report.
+func (r *Reconciler) CheckFailureRate(ctx context.Context) (FailureReport, error) {
+	now := r.clock.Now()
+
+	r.logger.Debug("checking if there are unusually high failure rates", zap.Duration("window", r.failureRate.Window), zap.Duration("halfLife", r.failureRate.HalfLife))
+
+	buckets, err := r.reader.GetDBConnErrorBuckets(ctx, now.Add(-r.failureRate.Window), r.failureRate.Bucket)
+	if err != nil {
+		return FailureReport{}, err
+	}
+
+	report := scoreFailures(buckets, now, r.failureRate)
+	r.failures.Store(report)
+
+	serialized, err := json.Marshal(report)
+	if err != nil {
+		return report, fmt.Errorf("serializing failure report failed: %w", err)
+	}
+
+	if err := r.writer.StoreFailureReport(ctx, report.GeneratedAt, len(report.Flagged), serialized, now.Add(-r.failureRate.Retention)); err != nil {
+		r.logger.Error("failed to store failure report", zap.Error(err))
+
+		return report, err
+	}
+
+	if len(report.Flagged) == 0 {
+		r.logger.Info("no high failure rates detected", zap.Duration("window", r.failureRate.Window))
+		return report, nil
+	}
+
+	for _, score := range report.Flagged {
+		r.logger.Warn("high failure rate detected",
+			zap.String("workerID", score.WorkerID),
+			zap.String("dbUrl", score.DbUrl),
+			zap.Int("errors", score.Count),
+			zap.Float64("score", score.Score),
+		)
+	}
+
+	return report, nil
+}
+
+// FailureHistory returns all persisted failure reports generated at or after since, oldest first
+func (r *Reconciler) FailureHistory(ctx context.Context, since time.Time) ([]FailureReport, error) {
+
+	rows, err := r.reader.GetFailureReportsSince(ctx, since)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make([]FailureReport, 0, len(rows))
+
+	for _, row := range rows {
+		var report FailureReport
+		if unmarshalErr := json.Unmarshal(row.Report, &report); unmarshalErr != nil {
+			r.logger.Warn("skipping failure report that could not be deserialized", zap.String("id", row.ID.String()), zap.Error(unmarshalErr))
+			continue
 		}
+
+		reports = append(reports, report)
 	}
 
-	// Evaluate columns (per database across all workers)
-	for j, dbURL := range dbList {
-		colSum := 0
-		for i := 0; i < len(workerList); i++ {
-			colSum += errorToFrequency[i][j]
+	return reports, nil
+}
+
+// PurgeConnErrors deletes all connection errors that are older than the failure rate window and therefore not scored anymore.
+// They are deleted in batches of PurgeBatchSize, each in its own transaction, until none are left or ctx ends.
+func (r *Reconciler) PurgeConnErrors(ctx context.Context) (int64, error) {
+
+	before := r.clock.Now().Add(-r.failureRate.Window)
+	batchSize := max(r.failureRate.PurgeBatchSize, 1)
+
+	var purged int64
+
+	for ctx.Err() == nil {
+
+		deleted, err := r.writer.PurgeDBConnErrors(ctx, before, batchSize)
+		if err != nil {
+			r.logger.Error("failed to delete old connection errors", zap.Int64("purged", purged), zap.Error(err))
+			return purged, err
 		}
-		if colSum > 3 {
-			warnings = append(warnings, fmt.Sprintf("Database %s (all workers): %d errors", dbURL, colSum))
+
+		purged += deleted
+
+		if deleted < int64(batchSize) {
+			break
+		}
+	}
+
+	if purged > 0 {
+		r.logger.Info("purged old connection errors", zap.Int64("purged", purged), zap.Time("before", before))
+	}
+
+	return purged, ctx.Err()
+}
+
+// LatestFailureReport returns the report of the last successful CheckFailureRate run and false if there is none yet
+func (r *Reconciler) LatestFailureReport() (FailureReport, bool) {
+
+	return r.failures.Latest()
+}
+
+// ProbeDatabases connects to every registered database instance directly and stores reachability and latency.
+// Together with the connection errors reported by workers, this tells a dead database apart from a misbehaving worker.
+func (r *Reconciler) ProbeDatabases(ctx context.Context, timeout time.Duration) error {
+
+	instances, err := r.reader.GetAllDbInstanceInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	urls := make([]string, 0, len(instances))
+	for _, instance := range instances {
+		urls = append(urls, instance.Url)
+	}
+
+	results := probeDatabases(ctx, urls, timeout)
+
+	for _, result := range results {
+		if !result.Reachable {
+			r.logger.Warn("database instance is not reachable from the controller", zap.String("url", result.Url), zap.String("error", result.Err))
+			continue
 		}
+
+		r.logger.Debug("probed database instance", zap.String("url", result.Url), zap.Duration("latency", result.Latency))
 	}
 
-	// Log final report
-	if len(warnings) > 0 {
-		r.logger.Warn("high failure rates detected in the last 30 minutes",
-			zap.Strings("warnings", warnings))
+	return r.writer.StoreDbProbes(ctx, results)
+}
+
+// RemediateDatabases marks databases as unhealthy that the failure report flagged and that fail for several workers,
+// and clears the mark of unhealthy databases whose score dropped below the recovery threshold.
+// Unhealthy databases are excluded from placement by the scheduler.
+func (r *Reconciler) RemediateDatabases(ctx context.Context, report FailureReport) (DatabaseRemediation, error) {
+
+	remediation := DatabaseRemediation{
+		MarkedUnhealthy: make([]string, 0),
+		Recovered:       make([]string, 0),
+	}
+
+	instances, err := r.reader.GetAllDbInstanceInfo(ctx)
+	if err != nil {
+		return remediation, err
+	}
+
+	scores := make(map[string]FailureScore, len(report.Databases))
+	for _, score := range report.Databases {
+		scores[score.DbUrl] = score
+	}
+
+	workers := reportingWorkers(report.Pairs)
+
+	//the probes only add context to the reason, so remediation works without them
+	probes := make(map[string]sqlc.DbProbe)
+	if probeList, probeErr := r.reader.GetAllDbProbes(ctx); probeErr == nil {
+		for _, probe := range probeList {
+			probes[probe.Url] = probe
+		}
 	} else {
-		r.logger.Info("no high failure rates detected in the last 30 minutes")
+		r.logger.Warn("could not get database probes for remediation", zap.Error(probeErr))
 	}
 
-	return nil
+	for _, instance := range instances {
+
+		score := scores[instance.Url]
+
+		switch {
+		case !instance.UnhealthySince.Valid && score.Flagged && workers[instance.Url] >= r.failureRate.DatabaseMinWorkers:
+
+			reason := fmt.Sprintf("failure score %.2f from %d workers within %s", score.Score, workers[instance.Url], report.Window)
+			if probe, ok := probes[instance.Url]; ok {
+				reason += "; " + probeSummary(probe)
+			}
+			if markErr := r.writer.MarkDbInstanceUnhealthy(ctx, instance.Url, reason); markErr != nil {
+				return remediation, markErr
+			}
+
+			r.logger.Warn("marked database as unhealthy", zap.String("url", instance.Url), zap.String("reason", reason))
+			r.audit.Record(ctx, actorReconciler, auditDatabaseMarkUnhealthy, instance.Url, reason, instance, map[string]any{"unhealthy": true})
+			remediation.MarkedUnhealthy = append(remediation.MarkedUnhealthy, instance.Url)
+
+		case instance.UnhealthySince.Valid && score.Score < r.failureRate.DatabaseRecoveryThreshold:
+
+			if clearErr := r.writer.ClearDbInstanceUnhealthy(ctx, instance.Url); clearErr != nil {
+				return remediation, clearErr
+			}
+
+			r.logger.Info("database recovered, cleared unhealthy mark", zap.String("url", instance.Url), zap.Float64("score", score.Score), zap.Duration("unhealthyFor", r.clock.Now().Sub(instance.UnhealthySince.Time)))
+			r.audit.Record(ctx, actorReconciler, auditDatabaseClearUnhealthy, instance.Url, fmt.Sprintf("failure score dropped to %.2f", score.Score), instance, map[string]any{"unhealthy": false})
+			remediation.Recovered = append(remediation.Recovered, instance.Url)
+		}
+	}
+
+	return remediation, nil
+}
+
+// probeSummary describes the last direct probe of a database instance
+func probeSummary(probe sqlc.DbProbe) string {
+
+	if probe.Reachable {
+		return fmt.Sprintf("reachable from the controller with %.1fms latency", probe.LatencyMs.Float64)
+	}
+
+	return fmt.Sprintf("unreachable from the controller for %d probes (%s)", probe.ConsecutiveFailures, probe.Error.String)
 }
 
 // workerHeartbeatOK checks if a worker's last heartbeat is valid and within the allowed timeout.
+// now is the current time of the database clock, corrected by the estimated skew of the worker.
 // Returns an error if the heartbeat is invalid or delayed beyond the timeout, otherwise returns nil.
-func workerHeartbeatOK(heartbeat pgtype.Timestamptz, timeout time.Duration) error {
+func workerHeartbeatOK(heartbeat pgtype.Timestamptz, now time.Time, timeout time.Duration) error {
 
 	if heartbeat.Valid == false {
 		return fmt.Errorf("heartbeat of worker does not have a valid return from pg")
 	}
 
-	timeSinceHeartbeat := time.Now().Sub(heartbeat.Time)
+	timeSinceHeartbeat := now.Sub(heartbeat.Time)
 
 	if timeSinceHeartbeat > timeout {
 		delay := timeSinceHeartbeat - timeout
@@ -5,24 +5,35 @@ import (
 	"controller/src/database"
 	sqlc "controller/src/database/sqlc"
 	"controller/src/docker"
+	ownErrors "controller/src/errors"
 	"controller/src/utils"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
-	"github.com/jackc/pgx/v5"
 	"go.uber.org/zap"
 	"math"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 // Scheduler handles all tasks concerning scaling the system, like calculating ranges, running migrations and getting load of the system
 type Scheduler struct {
 	logger          *zap.Logger
-	reader          *database.Reader
-	readerPerf      *database.ReaderPerfectionist
-	writer          *database.Writer
-	writerPerf      *database.WriterPerfectionist
+	reader          database.ReadStore
+	writer          database.WriteStore
 	dockerInterface docker.DInterface
+	cache           *StateCache
+	clock           *DbClock
+	health          *WorkerHealthTracker
+	progress        *MigrationProgressTracker
+	mappingCheck    *atomic.Pointer[MappingCheck]
+	audit           *Auditor
+	failures        *FailureReports
+
+	//heartbeatTimeout is how old the heartbeat of a migration worker may get before it is not handed new jobs anymore
+	heartbeatTimeout time.Duration
 }
 
 // MigrationInfo contains all information about a migration that is relevant for the controller to display in the Terminal after an HTTP request
@@ -32,16 +43,52 @@ type MigrationInfo struct {
 	CollectionCount int64
 	LastQueried     time.Time
 	Ranges          []sqlc.DbMapping
+	Unhealthy       bool
+	UnhealthySince  time.Time
+	UnhealthyReason string
+	Probe           *ProbeInfo
 }
 
-func NewScheduler(logger *zap.Logger, dbReader *database.Reader, readerPerf *database.ReaderPerfectionist, dbWriter *database.Writer, writerPerf *database.WriterPerfectionist, dInterface docker.DInterface) Scheduler {
+// ProbeInfo is the result of the last direct probe of a database instance by the controller
+type ProbeInfo struct {
+	Reachable           bool
+	LatencyMs           float64
+	Error               string
+	ProbedAt            time.Time
+	ConsecutiveFailures int32
+}
+
+// SchedulerDeps are the stores, trackers and settings a Scheduler works with. Clock, Health, Progress, Audit and Failures
+// are shared with the Reconciler. HeartbeatTimeout is how old the heartbeat of a migration worker may get before it is not handed new jobs anymore.
+type SchedulerDeps struct {
+	Logger   *zap.Logger
+	Reader   database.ReadStore
+	Writer   database.WriteStore
+	Docker   docker.DInterface
+	Clock    *DbClock
+	Health   *WorkerHealthTracker
+	Progress *MigrationProgressTracker
+	Audit    *Auditor
+	Failures *FailureReports
+
+	HeartbeatTimeout time.Duration
+}
+
+func NewScheduler(deps SchedulerDeps) Scheduler {
 	return Scheduler{
-		logger:          logger,
-		reader:          dbReader,
-		readerPerf:      readerPerf,
-		writer:          dbWriter,
-		writerPerf:      writerPerf,
-		dockerInterface: dInterface,
+		logger:          deps.Logger,
+		reader:          deps.Reader,
+		writer:          deps.Writer,
+		dockerInterface: deps.Docker,
+		cache:           NewStateCache(),
+		clock:           deps.Clock,
+		health:          deps.Health,
+		progress:        deps.Progress,
+		mappingCheck:    &atomic.Pointer[MappingCheck]{},
+		audit:           deps.Audit,
+		failures:        deps.Failures,
+
+		heartbeatTimeout: deps.HeartbeatTimeout,
 	}
 }
 
@@ -53,7 +100,11 @@ type UrlToRangeStartMap map[string][]string
 // Since there is no data yet, this does not have to be considered when mapping the ranges
 func (s *Scheduler) CalculateStartupMapping(ctx context.Context) (UrlToRangeStartMap, error) {
 
-	dbInfos, err := s.readerPerf.GetAllDbInstanceInfo(ctx)
+	if err := s.Writable(); err != nil {
+		return nil, err
+	}
+
+	dbInfos, dbMappings, err := s.readPlacement(ctx, "CalculateStartupMapping")
 	if err != nil {
 		s.logger.Error("error when calculating startup", zap.Error(err))
 		return nil, err
@@ -61,15 +112,12 @@ func (s *Scheduler) CalculateStartupMapping(ctx context.Context) (UrlToRangeStar
 
 	s.logger.Info("got db instance info when calculating startup mapping", zap.Int("dbCount", len(dbInfos)))
 
-	dbMappings, err := s.readerPerf.GetAllDbMappingInfo(ctx)
-	if err != nil {
-		return nil, err
-	}
+	dbInfos = s.placementTargets(dbInfos)
 
 	s.logger.Info("got mapping info when calculating startup mapping", zap.Int("mappingCount", len(dbMappings)))
 
 	if len(dbInfos) == 0 {
-		return nil, fmt.Errorf("calculating startup mapping failed: %w", errors.New("no database instances are registered"))
+		return nil, fmt.Errorf("calculating startup mapping failed: %w", errors.New("no healthy database instances are registered"))
 	}
 
 	if len(dbInfos) > 26 {
@@ -123,126 +171,672 @@ func (s *Scheduler) ExecuteStartUpMapping(ctx context.Context, rangeMap UrlToRan
 
 			s.logger.Info("trying to add database mapping from startup", zap.String("url", url), zap.String("from", dbRangeStart))
 
-			err = s.writerPerf.AddDatabaseMapping(dbRangeStart, url, ctx)
+			err = s.writer.AddDatabaseMapping(dbRangeStart, url, ctx)
 			if err != nil {
 				s.logger.Warn("Could not write mapping to database", zap.String("url", url), zap.String("from", dbRangeStart))
+				continue
 			}
 
+			s.audit.Record(ctx, actorScheduler, auditMappingCreate, dbRangeStart, "startup mapping", nil, map[string]string{"url": url, "from": dbRangeStart})
+
 		}
 	}
 }
 
-// RunMigration creates a new migration job for the given rangeId. This range will be moved to the db with the provided url. For that a new migration worker will be created, or if there are available instances, one will be chosen
+// RunMigration creates a new migration job for the given rangeId. This range will be moved to the db with the provided url. For that a new migration worker will be created, or if there are available instances, one will be chosen.
+// The target database is checked, the worker claimed and the new worker, the job and their join row are written in one transaction,
+// so the database cannot be marked unhealthy in between. If the container of a new worker cannot be started,
+// the worker is removed again and the job is queued, so the reconciler dispatches it once a worker is available.
 func (s *Scheduler) RunMigration(ctx context.Context, from, to, goalUrl string) error {
 
+	if err := s.Writable(); err != nil {
+		return err
+	}
+
 	traceId := ctx.Value("traceID")
 
 	var migrationWorkerId string
-	newWorker := true
+	var newWorker bool
+	var addReq database.MigrationJobAddReq
+	var placementErr error
+
+	migrationUUID := uuid.New()
+	aliveSince := s.clock.Now().Add(-s.heartbeatTimeout)
+
+	//the worker is claimed in the same transaction that assigns the job to it, so concurrent migrations never share a worker
+	txErr := s.writer.Transaction(ctx, "RunMigration", func(uow database.TxWriter) ownErrors.DbError {
 
-	worker, err := s.reader.GetFreeMigrationWorker(ctx)
+		//the instance stays locked until the job is written, marking it unhealthy waits for this transaction
+		instance, lockErr := uow.LockDbInstance(goalUrl)
+		switch {
+		case lockErr.Err == nil:
+			if placementErr = s.placeable(instance); placementErr != nil {
+				return ownErrors.DbError{Err: placementErr, Kind: ownErrors.DbErrInvalid, Reconcilable: false}
+			}
+		case lockErr.Kind != ownErrors.DbErrNoRows:
+			return lockErr
+		}
 
-	switch {
-	case errors.Is(err, pgx.ErrNoRows):
-		//if there is no available migration worker, create a new one (also add entry for it to db)
+		//a worker that stopped heartbeating would never pick the job up, if it dies after the claim the reconciler requeues its job
+		workerId, claimErr := uow.ClaimFreeMigrationWorker(aliveSince)
+
+		switch {
+		case claimErr.Err == nil:
+			migrationWorkerId, newWorker = workerId, false
+		case claimErr.Kind == ownErrors.DbErrNoRows:
+			//if there is no available migration worker, create a new one (also add entry for it to db)
+			migrationWorkerId, newWorker = uuid.New().String(), true
+			if oeErr := uow.AddMigrationWorker(migrationWorkerId, from, to); oeErr.Err != nil {
+				return oeErr
+			}
+		default:
+			return claimErr
+		}
 
-		migrationWorkerId = uuid.New().String()
-		err = s.writerPerf.AddMigrationWorker(migrationWorkerId, from, to, ctx)
-		if err != nil {
-			s.logger.Error("could not add migration worker to table", zap.String("workerUUID", migrationWorkerId), zap.Error(err))
-			return fmt.Errorf("could not add migration worker (id : %s) to table: %v", migrationWorkerId, err)
+		addReq = database.MigrationJobAddReq{
+			From:      from,
+			To:        to,
+			Url:       goalUrl,
+			MWorkerId: migrationWorkerId,
 		}
 
-		s.logger.Info("created uuid for new worker and added it to migration worker table", zap.Any("traceID", traceId), zap.String("workerId", migrationWorkerId))
+		if oeErr := uow.AddMigrationJob(addReq, migrationUUID); oeErr.Err != nil {
+			return oeErr
+		}
 
-	case err == nil:
-		s.logger.Info("migration worker exists, assigning migration job to it", zap.String("workerId", worker.String()))
-		migrationWorkerId = worker.String()
-		newWorker = false
-	default:
-		s.logger.Error("could not get migration worker from database", zap.Error(err))
-		return fmt.Errorf("could not get migration worker from database, but error was NOT sql.NoRows: %w", err)
+		return uow.AddWorkerJobJoin(migrationWorkerId, migrationUUID.String())
+	})
+	if placementErr != nil {
+		return placementErr
 	}
-
-	addReq := database.MigrationJobAddReq{
-		From:      from,
-		To:        to,
-		Url:       goalUrl,
-		MWorkerId: migrationWorkerId,
+	if txErr != nil {
+		s.logger.Error("could not migrate db-range", zap.Any("traceID", traceId), zap.Error(txErr))
+		return fmt.Errorf("could not add migration job (worker id: %s) to database: %w", migrationWorkerId, txErr)
 	}
 
+	s.logger.Info("assigned migration job to migration worker", zap.Any("traceID", traceId), zap.String("workerId", migrationWorkerId), zap.Bool("newWorker", newWorker))
+
 	if newWorker {
+		s.audit.Record(ctx, actorScheduler, auditMigrationWorkerCreate, migrationWorkerId, "no free migration worker for a new migration", nil, map[string]string{"from": from, "to": to})
+	}
+	s.audit.Record(ctx, actorScheduler, auditMigrationCreate, migrationUUID.String(), "migration requested", nil, addReq)
+	s.logger.Info("successfully added migration job to database", zap.Any("traceID", traceId), zap.String("jobId", migrationUUID.String()))
 
-		s.logger.Info("sending request to dockerClient to create a new migration worker", zap.Any("traceID", traceId))
+	if !newWorker {
+		return nil
+	}
 
-		req := s.dockerInterface.SendMWorkerRequest(ctx, migrationWorkerId)
-		responseErr := utils.ChanWihTimeout(req)
-		if responseErr != nil {
-			errW := fmt.Errorf("spawning migration worker failed: %w", responseErr)
-			s.logger.Error("could not migrate db-range", zap.Error(errW))
+	//after creating the worker and its job in the db, we start the container of the worker
+	s.logger.Info("sending request to dockerClient to create a new migration worker", zap.Any("traceID", traceId))
 
-			//remove it from the db again if it could not be started
-			err = s.writerPerf.RemoveMigrationWorker(migrationWorkerId, ctx)
-			if err != nil {
-				s.logger.Error("could not remove migration worker from database", zap.Error(err))
-				return fmt.Errorf("could not remove migration worker from database, but error was NOT sql.NoRows: %w", err)
-			}
+	req := s.dockerInterface.SendMWorkerRequest(ctx, migrationWorkerId)
+	responseErr := utils.ChanWihTimeout(req)
+	if responseErr == nil {
+		s.logger.Info("successfully created new migration worker", zap.Any("traceID", traceId))
+		return nil
+	}
 
-			s.logger.Info("successfully removed migration worker from database starting the container failed")
+	errW := fmt.Errorf("spawning migration worker failed: %w", responseErr)
+	s.logger.Error("could not start migration worker, queueing its job", zap.Any("traceID", traceId), zap.Error(errW))
+
+	//remove the worker again and hand its job to the reconciler, which dispatches it once a worker is available
+	reason := "queued because its migration worker could not be started: " + responseErr.Error()
+	nextAttemptAt := s.clock.Now()
+
+	requeueErr := s.writer.Transaction(ctx, "RunMigration", func(uow database.TxWriter) ownErrors.DbError {
+
+		if oeErr := uow.RequeueMigrationJob(migrationUUID.String(), nextAttemptAt, reason); oeErr.Err != nil {
+			return oeErr
 		}
 
-		s.logger.Info("successfully created new migration worker", zap.Any("traceID", traceId))
+		return uow.RetireMigrationWorker(migrationWorkerId)
+	})
+	if requeueErr != nil {
+		s.logger.Error("could not queue migration job after its worker failed to start", zap.String("jobId", migrationUUID.String()), zap.Error(requeueErr))
+		return fmt.Errorf("%w, queueing its job failed as well: %v", errW, requeueErr)
 	}
 
-	//after creating the worker in docker and db, we create the migration job for it
+	s.audit.Record(ctx, actorScheduler, auditMigrationWorkerRemove, migrationWorkerId, errW.Error(), nil, nil)
+	s.audit.Record(ctx, actorScheduler, auditMigrationRequeue, migrationUUID.String(), reason, addReq, map[string]any{"status": database.MigrationStatusQueued, "nextAttemptAt": nextAttemptAt})
 
-	migrationUUID := uuid.New()
+	return fmt.Errorf("%w (job %s): %v", ownErrors.ErrMigrationQueued, migrationUUID.String(), errW)
+}
+
+// placeable returns an error wrapping ErrDatabaseUnhealthy if the database instance is marked unhealthy or flagged by the latest failure report
+func (s *Scheduler) placeable(instance sqlc.DbInstance) error {
+
+	if instance.UnhealthySince.Valid {
+		return fmt.Errorf("%w: %s is unhealthy since %s (%s)", ownErrors.ErrDatabaseUnhealthy, instance.Url, instance.UnhealthySince.Time.Format(time.RFC3339), instance.UnhealthyReason.String)
+	}
+
+	if score, ok := s.failures.Excluded(instance.Url); ok {
+		return fmt.Errorf("%w: %s is flagged by the latest failure report, its failure score is %.2f", ownErrors.ErrDatabaseUnhealthy, instance.Url, score.Score)
+	}
+
+	return nil
+}
+
+// EvacuateDatabase schedules migrations of all ranges hosted on the given database to the healthy databases with the most free space.
+// The range of a mapping ends where the next mapping starts, the last range is open-ended and migrated with an empty "to".
+func (s *Scheduler) EvacuateDatabase(ctx context.Context, url string) error {
 
-	jobErr := s.writerPerf.AddMigrationJob(ctx, addReq, migrationUUID)
-	if jobErr != nil {
-		s.logger.Error("could not migrate db-range", zap.Error(err))
+	if err := s.Writable(); err != nil {
 		return err
 	}
-	s.logger.Info("successfully added migration job to database", zap.Any("traceID", traceId))
 
-	joinErr := s.writerPerf.AddWorkerJobJoin(ctx, addReq.MWorkerId, migrationUUID.String())
-	if joinErr != nil {
-		s.logger.Error("could not migrate db-range", zap.Error(err))
+	dbInfos, mappings, err := s.readPlacement(ctx, "EvacuateDatabase")
+	if err != nil {
 		return err
 	}
 
+	targets := make([]sqlc.DbInstance, 0, len(dbInfos))
+	for _, instance := range s.placementTargets(dbInfos) {
+		if instance.Url != url {
+			targets = append(targets, instance)
+		}
+	}
+
+	if len(targets) == 0 {
+		return fmt.Errorf("cannot evacuate %s: %w", url, errors.New("no healthy database instance left to migrate to"))
+	}
+
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].MaxSpace-targets[i].OccupiedSpace.Int64 > targets[j].MaxSpace-targets[j].OccupiedSpace.Int64
+	})
+
+	sort.Slice(mappings, func(i, j int) bool { return mappings[i].From < mappings[j].From })
+
+	scheduled := 0
+
+	for i, mapping := range mappings {
+
+		if mapping.Url != url {
+			continue
+		}
+
+		to := ""
+		if i+1 < len(mappings) {
+			to = mappings[i+1].From
+		}
+
+		//spread the ranges over the targets, starting with the one with the most free space
+		target := targets[scheduled%len(targets)].Url
+
+		//a queued migration is dispatched by the reconciler later on, the range is still on its way out
+		if migrationErr := s.RunMigration(ctx, mapping.From, to, target); migrationErr != nil && !errors.Is(migrationErr, ownErrors.ErrMigrationQueued) {
+			return fmt.Errorf("evacuating range %s of %s to %s failed: %w", mapping.From, url, target, migrationErr)
+		}
+
+		s.logger.Info("scheduled evacuation of range", zap.String("from", mapping.From), zap.String("to", to), zap.String("source", url), zap.String("target", target))
+		scheduled++
+	}
+
+	s.logger.Info("scheduled evacuation of unhealthy database", zap.String("url", url), zap.Int("ranges", scheduled))
+
 	return nil
 }
 
-func (s *Scheduler) GetSystemState(ctx context.Context) ([]MigrationInfo, error) {
-	dbInstances, instanceErr := s.readerPerf.GetAllDbInstanceInfo(ctx)
-	if instanceErr != nil {
-		return nil, instanceErr
+// placementTargets filters out all database instances that are marked unhealthy or flagged by the latest failure report
+func (s *Scheduler) placementTargets(dbInfos []sqlc.DbInstance) []sqlc.DbInstance {
+
+	targets := make([]sqlc.DbInstance, 0, len(dbInfos))
+	for _, instance := range healthyInstances(dbInfos) {
+		if _, excluded := s.failures.Excluded(instance.Url); !excluded {
+			targets = append(targets, instance)
+		}
 	}
 
-	mappings, mappingsErr := s.readerPerf.GetAllDbMappingInfo(ctx)
-	if mappingsErr != nil {
-		return nil, mappingsErr
+	return targets
+}
+
+// healthyInstances filters out all database instances that are marked unhealthy
+func healthyInstances(dbInfos []sqlc.DbInstance) []sqlc.DbInstance {
+
+	healthy := make([]sqlc.DbInstance, 0, len(dbInfos))
+	for _, instance := range dbInfos {
+		if !instance.UnhealthySince.Valid {
+			healthy = append(healthy, instance)
+		}
+	}
+
+	return healthy
+}
+
+// SystemState is the view of the system that is returned by the /state endpoint.
+// If Stale is set, postgres was unreachable or a read replica served the state, which is as old as SnapshotTakenAt.
+// Clock contains the measured offset of the controller to the database clock and the estimated skew of every worker,
+// WorkerHealth the state of every worker in the health state machine, including whether it is flapping,
+// MigrationProgress when every active migration job last changed, and MappingViolations the mapping invariants that do not hold.
+type SystemState struct {
+	Databases         []MigrationInfo
+	Workers           []WorkerInfo
+	MigrationWorkers  []MigrationWorkerInfo
+	Clock             ClockReport
+	WorkerHealth      []WorkerHealthReport
+	MigrationProgress []MigrationProgressReport
+	MappingViolations []MappingViolation
+	Stale             bool
+	SnapshotTakenAt   time.Time
+	SnapshotAge       string
+}
+
+// WorkerInfo contains the information about a worker that is displayed in the system state
+type WorkerInfo struct {
+	ID            string
+	LastHeartbeat time.Time
+}
+
+// MigrationWorkerInfo contains the information about a migration worker that is displayed in the system state
+type MigrationWorkerInfo struct {
+	ID            string
+	LastHeartbeat time.Time
+	WorkingOnFrom string
+	WorkingOnTo   string
+}
+
+// MigrationJobInfo contains the information about a migration job that is returned by the /migrations endpoint.
+// WorkerID is empty while the job is queued or after it failed, NextAttemptAt is only set while it is queued.
+type MigrationJobInfo struct {
+	ID            string
+	Url           string
+	From          string
+	To            string
+	Status        string
+	StatusReason  string
+	WorkerID      string
+	Attempts      int32
+	NextAttemptAt *time.Time
+	Progress      int64
+}
+
+// RangeLookup is the result of resolving a key to the range and database it is stored in
+type RangeLookup struct {
+	Key         string
+	From        string
+	Url         string
+	Stale       bool
+	SnapshotAge string
+}
+
+// RefreshSnapshot reads all tables needed to serve read requests and stores them in the state cache.
+// If any read fails, postgres is marked as unavailable and the old snapshot is kept. If a replica served the read,
+// the primary is pinged, since only the primary decides whether mutating requests can be accepted.
+func (s *Scheduler) RefreshSnapshot(ctx context.Context) (StateSnapshot, error) {
+
+	snapshot, err := s.readSnapshot(ctx)
+	if err != nil {
+		s.cache.MarkUnavailable(err)
+		return StateSnapshot{}, err
 	}
 
-	infos := make([]MigrationInfo, 0)
+	s.cache.Store(snapshot)
+
+	if snapshot.Replica == "" {
+		s.cache.MarkAvailable()
+	} else if pingErr := s.reader.Ping(ctx); pingErr != nil {
+		s.cache.MarkUnavailable(pingErr)
+	} else {
+		s.cache.MarkAvailable()
+	}
+
+	return snapshot, nil
+}
+
+// readSnapshot reads the state from a read replica if there is one, the state cache tolerates data as old as the replica lag limit
+func (s *Scheduler) readSnapshot(ctx context.Context) (StateSnapshot, error) {
+
+	var snapshot StateSnapshot
+
+	origin, err := s.reader.StaleSnapshot(ctx, "ReadStateSnapshot", func(tx database.SnapshotReader) error {
+
+		var err error
+
+		if snapshot.DbInstances, err = tx.GetAllDbInstanceInfo(); err != nil {
+			return err
+		}
+
+		if snapshot.Mappings, err = tx.GetAllDbMappingInfo(); err != nil {
+			return err
+		}
+
+		if snapshot.Workers, err = tx.GetAllWorkerState(); err != nil {
+			return err
+		}
+
+		if snapshot.MigrationWorkers, err = tx.GetAllMWorkerState(); err != nil {
+			return err
+		}
+
+		snapshot.Probes, err = tx.GetAllDbProbes()
+		return err
+	})
+	if err != nil {
+		return StateSnapshot{}, err
+	}
+
+	//a replica shows the state of the primary from as long ago as it lags behind
+	snapshot.TakenAt = time.Now().Add(-origin.Lag)
+	snapshot.Replica = origin.Replica
+
+	return snapshot, nil
+}
+
+// readPlacement reads all database instances and mappings in one snapshot, so planners never see
+// a mapping pointing to a database that was registered or changed after the instances were read, or the other way around
+func (s *Scheduler) readPlacement(ctx context.Context, operation string) ([]sqlc.DbInstance, []sqlc.DbMapping, error) {
+
+	var instances []sqlc.DbInstance
+	var mappings []sqlc.DbMapping
+
+	err := s.reader.Snapshot(ctx, operation, func(tx database.SnapshotReader) error {
+
+		var err error
+
+		if instances, err = tx.GetAllDbInstanceInfo(); err != nil {
+			return err
+		}
+
+		mappings, err = tx.GetAllDbMappingInfo()
+		return err
+	})
+
+	return instances, mappings, err
+}
+
+// Writable returns an error wrapping ErrDegradedMode if postgres is currently unreachable, and nil otherwise.
+// All requests that mutate the system have to check this first.
+func (s *Scheduler) Writable() error {
+
+	available, since, lastErr := s.cache.Available()
+	if available {
+		return nil
+	}
+
+	return fmt.Errorf("%w: postgres is unreachable since %s (%v), mutating requests are refused until connectivity returns", ownErrors.ErrDegradedMode, since.Format(time.RFC3339), lastErr)
+}
+
+// GetSystemState returns the current state of the system.
+// If postgres is unreachable, the last snapshot is returned and marked as stale, as is a state that a read replica served.
+func (s *Scheduler) GetSystemState(ctx context.Context) (SystemState, error) {
+
+	snapshot, err := s.RefreshSnapshot(ctx)
+	stale := snapshot.Replica != ""
+
+	if err != nil {
+		cached, ok := s.cache.Snapshot()
+		if !ok {
+			return SystemState{}, fmt.Errorf("reading system state failed and there is no snapshot to fall back to: %w", err)
+		}
+
+		s.logger.Warn("postgres is unreachable, serving system state from snapshot", zap.Time("takenAt", cached.TakenAt), zap.Error(err))
+
+		snapshot = cached
+		stale = true
+	}
+
+	state := buildSystemState(snapshot, stale)
+	state.Clock = s.clock.Report()
+	state.WorkerHealth = s.health.Report()
+	state.MigrationProgress = s.progress.Report(s.clock.Now())
+	state.MappingViolations = checkMappingInvariants(snapshot.Mappings, snapshot.DbInstances)
+
+	return state, nil
+}
+
+// CheckMappings validates that db_mapping covers the key space exactly once and only points to registered databases.
+// The result is kept as the latest mapping check, so the health endpoint can report it without reading the tables.
+func (s *Scheduler) CheckMappings(ctx context.Context) (MappingCheck, error) {
+
+	instances, mappings, err := s.readPlacement(ctx, "CheckMappings")
+	if err != nil {
+		return MappingCheck{}, err
+	}
+
+	check := MappingCheck{
+		CheckedAt:  time.Now(),
+		Violations: checkMappingInvariants(mappings, instances),
+	}
+	s.mappingCheck.Store(&check)
+
+	for _, violation := range check.Violations {
+		s.logger.Warn("mapping invariant violated", zap.String("kind", string(violation.Kind)), zap.Strings("mappingIds", violation.MappingIDs), zap.String("detail", violation.Detail))
+	}
+
+	return check, nil
+}
+
+// LatestMappingCheck returns the result of the last mapping check and false if there is none yet
+func (s *Scheduler) LatestMappingCheck() (MappingCheck, bool) {
+
+	check := s.mappingCheck.Load()
+	if check == nil {
+		return MappingCheck{}, false
+	}
+
+	return *check, true
+}
+
+// RepairMappings proposes fixes for all violated mapping invariants. If apply is set, all safe fixes are applied,
+// fixes that would move or drop data are only proposed, since they need a migration instead.
+func (s *Scheduler) RepairMappings(ctx context.Context, apply bool) (MappingRepair, error) {
+
+	if apply {
+		if err := s.Writable(); err != nil {
+			return MappingRepair{}, err
+		}
+	}
+
+	instances, mappings, err := s.readPlacement(ctx, "RepairMappings")
+	if err != nil {
+		return MappingRepair{}, err
+	}
+
+	repair := MappingRepair{
+		Violations: checkMappingInvariants(mappings, instances),
+		Actions:    planMappingRepair(mappings, instances, s.placementTargets(instances)),
+		Applied:    apply,
+	}
+
+	if !apply {
+		return repair, nil
+	}
+
+	for i, action := range repair.Actions {
+
+		if !action.Safe {
+			continue
+		}
+
+		var actionErr error
+
+		switch action.Action {
+		case repairActionDelete:
+			actionErr = s.writer.DeleteMapping(ctx, action.MappingID)
+		case repairActionUpdate:
+			actionErr = s.writer.UpdateMapping(ctx, action.MappingID, action.NewUrl, action.NewFrom)
+		}
+
+		if actionErr != nil {
+			s.logger.Warn("could not apply mapping repair", zap.String("mappingId", action.MappingID), zap.String("action", action.Action), zap.Error(actionErr))
+			repair.Actions[i].Error = actionErr.Error()
+			continue
+		}
+
+		repair.Actions[i].Applied = true
+
+		before := map[string]string{"url": action.Url, "from": action.From}
+		if action.Action == repairActionDelete {
+			s.audit.Record(ctx, actorScheduler, auditMappingDelete, action.MappingID, action.Reason, before, nil)
+		} else {
+			s.audit.Record(ctx, actorScheduler, auditMappingUpdate, action.MappingID, action.Reason, before, map[string]string{"url": action.NewUrl, "from": action.NewFrom})
+		}
+	}
+
+	//refresh the latest check, so the health endpoint reflects the repair right away
+	if _, checkErr := s.CheckMappings(ctx); checkErr != nil {
+		s.logger.Warn("could not check mappings after repair", zap.Error(checkErr))
+	}
+
+	return repair, nil
+}
+
+// GetMigrationJobs returns all migration jobs, including queued and terminally failed ones.
+// If status is not empty, only jobs in that status are returned.
+func (s *Scheduler) GetMigrationJobs(ctx context.Context, status string) ([]MigrationJobInfo, error) {
+
+	jobs, err := s.reader.GetAllMigrationJobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]MigrationJobInfo, 0, len(jobs))
+
+	for _, job := range jobs {
+
+		if status != "" && job.Status != status {
+			continue
+		}
+
+		info := MigrationJobInfo{
+			ID:           job.ID.String(),
+			Url:          job.Url,
+			From:         job.From,
+			To:           job.To,
+			Status:       job.Status,
+			StatusReason: job.StatusReason.String,
+			Attempts:     job.Attempts,
+			Progress:     job.Progress,
+		}
+
+		if job.MWorkerID.Valid {
+			info.WorkerID = job.MWorkerID.String()
+		}
+
+		if job.NextAttemptAt.Valid {
+			nextAttemptAt := job.NextAttemptAt.Time
+			info.NextAttemptAt = &nextAttemptAt
+		}
+
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].From < infos[j].From })
+
+	return infos, nil
+}
+
+// LookupRange resolves the given key to the range it belongs to and the database that stores it.
+// If postgres is unreachable, the mappings of the last snapshot are used and the result is marked as stale.
+func (s *Scheduler) LookupRange(ctx context.Context, key string) (RangeLookup, error) {
+
+	lookup := RangeLookup{Key: key}
+
+	mappings, err := s.reader.GetAllDbMappingInfo(ctx)
+	if err != nil {
+		s.cache.MarkUnavailable(err)
+
+		cached, ok := s.cache.Snapshot()
+		if !ok {
+			return RangeLookup{}, fmt.Errorf("reading mappings failed and there is no snapshot to fall back to: %w", err)
+		}
+
+		mappings = cached.Mappings
+		lookup.Stale = true
+		lookup.SnapshotAge = time.Since(cached.TakenAt).Round(time.Second).String()
+	} else {
+		s.cache.MarkAvailable()
+	}
+
+	mapping, found := rangeForKey(mappings, key)
+	if !found {
+		return RangeLookup{}, fmt.Errorf("%w: %s", ownErrors.ErrNoRangeForKey, key)
+	}
+
+	lookup.From = mapping.From
+	lookup.Url = mapping.Url
+
+	return lookup, nil
+}
+
+// rangeForKey returns the mapping with the largest start that is still smaller or equal to the key
+func rangeForKey(mappings []sqlc.DbMapping, key string) (sqlc.DbMapping, bool) {
+
+	sorted := make([]sqlc.DbMapping, len(mappings))
+	copy(sorted, mappings)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].From < sorted[j].From })
+
+	key = strings.ToLower(key)
+
+	idx := sort.Search(len(sorted), func(i int) bool { return sorted[i].From > key }) - 1
+	if idx < 0 {
+		return sqlc.DbMapping{}, false
+	}
+
+	return sorted[idx], true
+}
+
+func buildSystemState(snapshot StateSnapshot, stale bool) SystemState {
+
+	state := SystemState{
+		Databases:        make([]MigrationInfo, 0, len(snapshot.DbInstances)),
+		Workers:          make([]WorkerInfo, 0, len(snapshot.Workers)),
+		MigrationWorkers: make([]MigrationWorkerInfo, 0, len(snapshot.MigrationWorkers)),
+		Stale:            stale,
+		SnapshotTakenAt:  snapshot.TakenAt,
+		SnapshotAge:      time.Since(snapshot.TakenAt).Round(time.Second).String(),
+	}
 
 	mappingMap := make(map[string][]sqlc.DbMapping)
 
-	for _, mapping := range mappings {
+	for _, mapping := range snapshot.Mappings {
 		mappingMap[mapping.Url] = append(mappingMap[mapping.Url], mapping)
 	}
 
-	for _, instance := range dbInstances {
+	probeMap := make(map[string]sqlc.DbProbe, len(snapshot.Probes))
+
+	for _, probe := range snapshot.Probes {
+		probeMap[probe.Url] = probe
+	}
+
+	for _, instance := range snapshot.DbInstances {
 		info := MigrationInfo{
 			Url:             instance.Url,
 			SpaceQuota:      float64(instance.OccupiedSpace.Int64) / float64(instance.MaxSpace) * 100,
 			CollectionCount: instance.CollectionCount.Int64,
 			LastQueried:     instance.LastQueried.Time,
 			Ranges:          mappingMap[instance.Url],
+			Unhealthy:       instance.UnhealthySince.Valid,
+			UnhealthySince:  instance.UnhealthySince.Time,
+			UnhealthyReason: instance.UnhealthyReason.String,
 		}
-		infos = append(infos, info)
+
+		if probe, ok := probeMap[instance.Url]; ok {
+			info.Probe = &ProbeInfo{
+				Reachable:           probe.Reachable,
+				LatencyMs:           probe.LatencyMs.Float64,
+				Error:               probe.Error.String,
+				ProbedAt:            probe.ProbedAt.Time,
+				ConsecutiveFailures: probe.ConsecutiveFailures,
+			}
+		}
+		state.Databases = append(state.Databases, info)
 	}
 
-	return infos, nil
+	for _, worker := range snapshot.Workers {
+		state.Workers = append(state.Workers, WorkerInfo{
+			ID:            worker.ID.String(),
+			LastHeartbeat: worker.LastHeartbeat.Time,
+		})
+	}
+
+	for _, worker := range snapshot.MigrationWorkers {
+		state.MigrationWorkers = append(state.MigrationWorkers, MigrationWorkerInfo{
+			ID:            worker.ID.String(),
+			LastHeartbeat: worker.LastHeartbeat.Time,
+			WorkingOnFrom: worker.WorkingOnFrom.String,
+			WorkingOnTo:   worker.WorkingOnTo.String,
+		})
+	}
+
+	return state
 }
@@ -0,0 +1,85 @@
+package components
+
+import (
+	sqlc "controller/src/database/sqlc"
+	"sync"
+	"time"
+)
+
+// StateSnapshot is a copy of the tables the scheduler needs to answer read requests, as they were at TakenAt.
+// Replica is the read replica that served it, or empty if it was read from the primary.
+type StateSnapshot struct {
+	DbInstances      []sqlc.DbInstance
+	Mappings         []sqlc.DbMapping
+	Workers          []sqlc.WorkerMetric
+	MigrationWorkers []sqlc.MigrationWorker
+	Probes           []sqlc.DbProbe
+	TakenAt          time.Time
+	Replica          string
+}
+
+// StateCache keeps the last successfully read StateSnapshot and whether postgres is currently reachable.
+// While postgres is unreachable, the controller serves reads from the snapshot and refuses to mutate anything.
+type StateCache struct {
+	mu          sync.RWMutex
+	snapshot    *StateSnapshot
+	available   bool
+	unavailable time.Time
+	lastErr     error
+}
+
+func NewStateCache() *StateCache {
+	//we assume postgres is reachable until the first read fails, since the controller pings it on startup
+	return &StateCache{available: true}
+}
+
+// Store replaces the snapshot. It does not mark postgres as available, since a replica can serve it while the primary is down.
+func (c *StateCache) Store(snapshot StateSnapshot) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.snapshot = &snapshot
+}
+
+// MarkAvailable marks postgres as reachable again without touching the snapshot. Only the primary answering proves that.
+func (c *StateCache) MarkAvailable() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.available = true
+	c.lastErr = nil
+}
+
+// MarkUnavailable marks postgres as unreachable, remembering since when and why
+func (c *StateCache) MarkUnavailable(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.available {
+		c.unavailable = time.Now()
+	}
+
+	c.available = false
+	c.lastErr = err
+}
+
+// Snapshot returns the last snapshot and false if there is none yet
+func (c *StateCache) Snapshot() (StateSnapshot, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.snapshot == nil {
+		return StateSnapshot{}, false
+	}
+
+	return *c.snapshot, true
+}
+
+// Available reports whether postgres was reachable on the last access.
+// If it is not, the time since it became unreachable and the last error are returned as well.
+func (c *StateCache) Available() (bool, time.Time, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.available, c.unavailable, c.lastErr
+}
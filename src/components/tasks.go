@@ -0,0 +1,192 @@
+package components
+
+import (
+	"context"
+	"controller/src/lifecycle"
+	"fmt"
+	"go.uber.org/zap"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ReconcileTask is a single piece of reconciliation logic that is run periodically.
+// Every run is delayed by a random duration of up to Jitter, so the tasks of a controller do not all hit postgres at once,
+// and canceled after Timeout. A zero Jitter or Timeout disables it. LeaderOnly tasks only run while the controller is the leader.
+type ReconcileTask struct {
+	Name       string
+	Interval   time.Duration
+	Jitter     time.Duration
+	Timeout    time.Duration
+	LeaderOnly bool
+	Run        func(ctx context.Context) error
+}
+
+// TaskStatus describes a registered task and the outcome of its last run, as returned by the /tasks endpoint
+type TaskStatus struct {
+	Name         string
+	Interval     string
+	Jitter       string
+	Timeout      string
+	LeaderOnly   bool
+	Scheduled    bool
+	Running      bool
+	Runs         int64
+	Failures     int64
+	LastRun      time.Time
+	LastDuration string
+	LastSuccess  time.Time
+	LastError    string
+}
+
+// TaskRegistry holds all reconcile tasks and schedules them as loops of the lifecycle manager,
+// which restarts them on panics and lets the supervisor decide about failing runs.
+type TaskRegistry struct {
+	logger *zap.Logger
+
+	mu     sync.Mutex
+	tasks  []ReconcileTask
+	status map[string]*TaskStatus
+}
+
+// loopGroup is either the lifecycle manager itself or one of its groups
+type loopGroup interface {
+	AddLoop(loop lifecycle.Loop)
+}
+
+func NewTaskRegistry(logger *zap.Logger) *TaskRegistry {
+	return &TaskRegistry{
+		logger: logger,
+		status: make(map[string]*TaskStatus),
+	}
+}
+
+// Register adds a task to the registry. It panics if a task with the same name is already registered.
+func (t *TaskRegistry) Register(task ReconcileTask) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.status[task.Name]; ok {
+		panic(fmt.Sprintf("components: reconcile task %q registered twice", task.Name))
+	}
+
+	t.tasks = append(t.tasks, task)
+	t.status[task.Name] = &TaskStatus{
+		Name:       task.Name,
+		Interval:   task.Interval.String(),
+		Jitter:     task.Jitter.String(),
+		Timeout:    task.Timeout.String(),
+		LeaderOnly: task.LeaderOnly,
+	}
+}
+
+// Schedule adds all tasks whose LeaderOnly flag matches leaderOnly as loops to the given group
+func (t *TaskRegistry) Schedule(group loopGroup, leaderOnly bool) {
+	t.mu.Lock()
+	tasks := make([]ReconcileTask, 0, len(t.tasks))
+	for _, task := range t.tasks {
+		if task.LeaderOnly == leaderOnly {
+			tasks = append(tasks, task)
+			t.status[task.Name].Scheduled = true
+		}
+	}
+	t.mu.Unlock()
+
+	for _, task := range tasks {
+		group.AddLoop(lifecycle.Loop{
+			Name:     task.Name,
+			Interval: task.Interval,
+			Run:      t.runner(task),
+		})
+	}
+}
+
+// Unscheduled marks all tasks whose LeaderOnly flag matches leaderOnly as no longer scheduled, e.g. after a demotion stopped them
+func (t *TaskRegistry) Unscheduled(leaderOnly bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, task := range t.tasks {
+		if task.LeaderOnly == leaderOnly {
+			t.status[task.Name].Scheduled = false
+		}
+	}
+}
+
+// Status returns the status of all registered tasks, sorted by name
+func (t *TaskRegistry) Status() []TaskStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	statuses := make([]TaskStatus, 0, len(t.status))
+	for _, status := range t.status {
+		statuses = append(statuses, *status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+	return statuses
+}
+
+// runner wraps the task with its jitter and timeout and records the outcome of every run
+func (t *TaskRegistry) runner(task ReconcileTask) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+
+		if task.Jitter > 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(rand.N(task.Jitter)):
+			}
+		}
+
+		runCtx := ctx
+		if task.Timeout > 0 {
+			var cancel context.CancelFunc
+			runCtx, cancel = context.WithTimeout(ctx, task.Timeout)
+			defer cancel()
+		}
+
+		start := time.Now()
+		t.started(task.Name, start)
+
+		err := task.Run(runCtx)
+		if err != nil && runCtx.Err() != nil && ctx.Err() == nil {
+			err = fmt.Errorf("task %s timed out after %s: %w", task.Name, task.Timeout, err)
+		}
+
+		t.finished(task.Name, start, time.Since(start), err)
+
+		return err
+	}
+}
+
+func (t *TaskRegistry) started(name string, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	status := t.status[name]
+	status.Running = true
+	status.LastRun = at
+}
+
+func (t *TaskRegistry) finished(name string, start time.Time, duration time.Duration, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	status := t.status[name]
+	status.Running = false
+	status.Runs++
+	status.LastDuration = duration.String()
+
+	if err != nil {
+		status.Failures++
+		status.LastError = err.Error()
+		t.logger.Debug("reconcile task failed", zap.String("task", name), zap.Duration("duration", duration), zap.Error(err))
+		return
+	}
+
+	status.LastSuccess = start
+	status.LastError = ""
+}
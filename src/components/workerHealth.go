@@ -0,0 +1,187 @@
+package components
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// WorkerHealthState is the state of a worker in the health state machine of the reconciler.
+// A worker with a problem becomes suspect, if the problem persists for longer than the suspect grace period it is quarantined,
+// and if it persists for longer than the quarantine grace period as well, it is evicted from the system.
+// Suspect and quarantined workers go back to healthy after a number of consecutive evaluations without a problem.
+type WorkerHealthState string
+
+const (
+	WorkerHealthy     WorkerHealthState = "healthy"
+	WorkerSuspect     WorkerHealthState = "suspect"
+	WorkerQuarantined WorkerHealthState = "quarantined"
+	WorkerEvicted     WorkerHealthState = "evicted"
+)
+
+// WorkerHealthConfig configures the grace periods and thresholds of the worker health state machine
+type WorkerHealthConfig struct {
+	SuspectGrace      time.Duration
+	QuarantineGrace   time.Duration
+	RecoveryThreshold int
+	FlapWindow        time.Duration
+	FlapThreshold     int
+}
+
+// WorkerHealthTransition is the result of evaluating a single worker
+type WorkerHealthTransition struct {
+	From     WorkerHealthState
+	To       WorkerHealthState
+	Reason   string
+	Flapping bool
+}
+
+// Changed reports whether the evaluation moved the worker into another state
+func (t WorkerHealthTransition) Changed() bool {
+	return t.From != t.To
+}
+
+// WorkerHealthReport is the health of a single worker as shown in the system state
+type WorkerHealthReport struct {
+	WorkerID string
+	State    WorkerHealthState
+	Since    time.Time
+	Reason   string
+	Flapping bool
+	// Degradations is the number of times the worker went from healthy to suspect within the flap window
+	Degradations int
+}
+
+// WorkerHealthTracker keeps the health state of every worker in one place, so each worker is evaluated exactly once per cycle
+type WorkerHealthTracker struct {
+	config WorkerHealthConfig
+
+	mu      sync.Mutex
+	workers map[string]*workerHealth
+}
+
+type workerHealth struct {
+	state        WorkerHealthState
+	since        time.Time
+	reason       string
+	goodStreak   int
+	degradations []time.Time
+}
+
+func NewWorkerHealthTracker(config WorkerHealthConfig) *WorkerHealthTracker {
+	return &WorkerHealthTracker{
+		config:  config,
+		workers: make(map[string]*workerHealth),
+	}
+}
+
+// Evaluate moves the worker through the state machine. problem is nil if the worker passed all checks in this cycle.
+func (t *WorkerHealthTracker) Evaluate(workerId string, problem error, now time.Time) WorkerHealthTransition {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	w, ok := t.workers[workerId]
+	if !ok {
+		w = &workerHealth{state: WorkerHealthy, since: now}
+		t.workers[workerId] = w
+	}
+
+	transition := WorkerHealthTransition{From: w.state}
+
+	if problem != nil {
+		w.goodStreak = 0
+		w.reason = problem.Error()
+	} else {
+		w.goodStreak++
+	}
+
+	switch w.state {
+	case WorkerHealthy:
+		if problem != nil {
+			w.setState(WorkerSuspect, now)
+			w.degradations = append(w.degradations, now)
+		}
+	case WorkerSuspect, WorkerQuarantined:
+		grace := t.config.SuspectGrace
+		next := WorkerQuarantined
+		if w.state == WorkerQuarantined {
+			grace = t.config.QuarantineGrace
+			next = WorkerEvicted
+		}
+
+		switch {
+		case problem == nil && w.goodStreak >= t.config.RecoveryThreshold:
+			w.setState(WorkerHealthy, now)
+			w.reason = ""
+		case problem != nil && now.Sub(w.since) > grace:
+			w.setState(next, now)
+		}
+	}
+
+	w.pruneDegradations(now, t.config.FlapWindow)
+
+	transition.To = w.state
+	transition.Reason = w.reason
+	transition.Flapping = len(w.degradations) >= t.config.FlapThreshold
+
+	return transition
+}
+
+// Forget drops the health state of a worker, e.g. after it was removed
+func (t *WorkerHealthTracker) Forget(workerId string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.workers, workerId)
+}
+
+// Retain drops the health state of all workers that are not in the given set anymore
+func (t *WorkerHealthTracker) Retain(present map[string]struct{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for id := range t.workers {
+		if _, ok := present[id]; !ok {
+			delete(t.workers, id)
+		}
+	}
+}
+
+// Report returns the health of all tracked workers
+func (t *WorkerHealthTracker) Report() []WorkerHealthReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	reports := make([]WorkerHealthReport, 0, len(t.workers))
+
+	for id, w := range t.workers {
+		reports = append(reports, WorkerHealthReport{
+			WorkerID:     id,
+			State:        w.state,
+			Since:        w.since,
+			Reason:       w.reason,
+			Flapping:     len(w.degradations) >= t.config.FlapThreshold,
+			Degradations: len(w.degradations),
+		})
+	}
+
+	sort.Slice(reports, func(i, j int) bool { return reports[i].WorkerID < reports[j].WorkerID })
+
+	return reports
+}
+
+func (w *workerHealth) setState(state WorkerHealthState, now time.Time) {
+	w.state = state
+	w.since = now
+	w.goodStreak = 0
+}
+
+func (w *workerHealth) pruneDegradations(now time.Time, window time.Duration) {
+	recent := w.degradations[:0]
+	for _, t := range w.degradations {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	w.degradations = recent
+}
@@ -3,79 +3,152 @@ package main
 import (
 	"context"
 	"controller/src/components"
+	"controller/src/database"
 	customErr "controller/src/errors"
+	"controller/src/lifecycle"
 	"errors"
+	"fmt"
 	goutils "github.com/linusgith/goutils/pkg/env_utils"
 	"go.uber.org/zap"
 	"os"
+	"sync/atomic"
 	"time"
 )
 
 // Controller is a struct that manages the controller's operations.
 // It contains a scheduler, a reconciler, a logger, and a flag indicating if it is in shadow mode.
+// The flag changes at runtime when the shadow takes over or the leader is demoted, so it is atomic.
 
 type Controller struct {
 	scheduler  components.Scheduler
 	reconciler components.Reconciler
+	audit      *components.Auditor
+	tasks      *components.TaskRegistry
+	breaker    *database.CircuitBreaker
+	replicas   *database.ReplicaRouter
 	logger     *zap.Logger
-	isShadow   bool
+	isShadow   atomic.Bool
 }
 
-// heartbeat periodically sends a heartbeat signal to indicate the controller is alive.
-// It calls the reconciler's Heartbeat method and logs a fatal error if the heartbeat fails.
-// The function sleeps for the configured heartbeat interval between each heartbeat.
-func (c *Controller) heartbeat(ctx context.Context) {
-	heartbeatInterval := goutils.Log().ParseEnvDurationDefault("HEARTBEAT_BACKOFF", 5*time.Second, c.logger)
+// heartbeat sends a single heartbeat signal to indicate the controller is alive.
+// It is run periodically by the lifecycle manager, an error ends the controllers leadership.
+func (c *Controller) heartbeat(ctx context.Context) error {
 
-	for {
-		start := time.Now()
-
-		heartbeatErr := c.reconciler.Heartbeat(ctx)
-		if heartbeatErr != nil {
-			c.logger.Fatal("heartbeat failed", zap.Error(heartbeatErr))
-		}
-
-		end := time.Now()
-
-		timeToSleep := heartbeatInterval - (end.Sub(start))
-
-		time.Sleep(timeToSleep)
+	heartbeatErr := c.reconciler.Heartbeat(ctx)
+	if heartbeatErr != nil {
+		return fmt.Errorf("heartbeat failed: %w", heartbeatErr)
 	}
+
+	return nil
 }
 
 // checkControllerUp runs a loop while the controller is in shadow mode.
 // It periodically checks if the main controller is up by calling the reconciler's CheckControllerUp method.
-// If the main controller is detected as crashed, this function takes over as the main controller,
-// updates the environment variable and state, and starts the heartbeat loop.
-// If another error occurs, it logs a fatal error and exits.
-// Sleeps for the configured check interval between checks.
-func (c *Controller) checkControllerUp(ctx context.Context) {
-	for c.isShadow {
+// If the main controller is detected as crashed, this function claims the controller row. If no other shadow claimed it first,
+// it takes over as the main controller, updates the environment variable and state, resumes the migrations the old leader
+// left behind and returns. Otherwise it stays shadow and keeps watching the new leader.
+// Other errors are handed to the supervisor, which backs off or, if they are fatal, makes this function return them.
+// The function also returns once the context is canceled.
+func (c *Controller) checkControllerUp(ctx context.Context, supervisor *lifecycle.Supervisor) error {
+
+	checkInterval := goutils.Log().ParseEnvDurationDefault("CHECK_CONTROLLER_BACKOFF", 3*time.Second, c.logger)
+
+	wait := checkInterval
 
-		checkInterval := goutils.Log().ParseEnvDurationDefault("CHECK_CONTROLLER_BACKOFF", 3*time.Second, c.logger)
+	for c.isShadow.Load() {
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
 
-		start := time.Now()
+		wait = checkInterval
 
 		shadowErr := c.reconciler.CheckControllerUp(ctx)
+		if shadowErr == nil {
+			supervisor.Succeeded("shadow")
+			continue
+		}
+
+		if !errors.Is(shadowErr, customErr.ErrControllerCrashed) {
 
-		if shadowErr != nil {
-
-			if !errors.Is(shadowErr, customErr.ErrControllerCrashed) {
-				c.logger.Fatal("shadow reconciliation loop failed", zap.Error(shadowErr))
-			} else {
-				// If the controller crashed, take over as the shadow
-				if setEnvErr := os.Setenv("SHADOW", "false"); setEnvErr != nil {
-					c.logger.Warn("could not change `SHADOW` environment variable after taking over as controller")
-				}
-				c.isShadow = false //Put the shadow in control
-				c.heartbeat(ctx)
+			//the shadow has nothing to hand over, so the supervisor either backs off or gives up
+			decision := supervisor.Failed("shadow", shadowErr, false)
+			if decision.Action == lifecycle.ActionExit {
+				return fmt.Errorf("shadow reconciliation loop failed: %w", shadowErr)
 			}
+
+			wait = decision.Backoff
+			continue
 		}
 
-		end := time.Now()
+		//Several shadows can see the same stale heartbeat, only the one whose claim on the controller row succeeds takes over
+		if registerErr := c.reconciler.RegisterController(ctx); registerErr != nil {
 
-		timeToSleep := checkInterval - (end.Sub(start))
+			if errors.Is(registerErr, customErr.ErrLeadershipLost) {
+				c.logger.Info("another controller took over first, staying shadow", zap.Error(registerErr))
+				supervisor.Succeeded("shadow")
+				continue
+			}
 
-		time.Sleep(timeToSleep)
+			decision := supervisor.Failed("shadow", registerErr, false)
+			if decision.Action == lifecycle.ActionExit {
+				return fmt.Errorf("taking over as controller failed: %w", registerErr)
+			}
+
+			wait = decision.Backoff
+			continue
+		}
+
+		// If the controller crashed and the claim succeeded, take over as the shadow
+		if setEnvErr := os.Setenv("SHADOW", "false"); setEnvErr != nil {
+			c.logger.Warn("could not change `SHADOW` environment variable after taking over as controller")
+		}
+		c.isShadow.Store(false) //Put the shadow in control
+
+		//Pick up whatever the old leader left running before heartbeating
+		if resumeErr := c.reconciler.ResumeMigrations(ctx); resumeErr != nil {
+			c.logger.Error("could not resume in-flight migrations after takeover", zap.Error(resumeErr))
+		}
+	}
+
+	return nil
+}
+
+// follow runs the controller as shadow until it takes over, then starts leading.
+// It blocks until that happens, so it should be called in its own goroutine after a demotion.
+func (c *Controller) follow(manager *lifecycle.Manager) {
+
+	ctx := manager.Context()
+
+	if shadowErr := c.checkControllerUp(ctx, manager.Supervisor()); shadowErr != nil {
+		manager.Fail("shadow", shadowErr)
+		return
+	}
+
+	if ctx.Err() != nil {
+		return
 	}
+
+	c.lead(manager)
+}
+
+// lead starts all loops that only run while this controller is the leader.
+// If the supervisor demotes them, the controller goes back to being the shadow.
+func (c *Controller) lead(manager *lifecycle.Manager) {
+
+	leaderLoops := manager.NewGroup("leader", func(reason error) {
+		c.logger.Warn("giving up leadership, continuing as shadow", zap.Error(reason))
+
+		c.isShadow.Store(true)
+		c.tasks.Unscheduled(true)
+		if setEnvErr := os.Setenv("SHADOW", "true"); setEnvErr != nil {
+			c.logger.Warn("could not change `SHADOW` environment variable after demotion")
+		}
+
+		go c.follow(manager)
+	})
+
+	c.tasks.Schedule(leaderLoops, true)
 }
@@ -0,0 +1,206 @@
+package database
+
+import (
+	"context"
+	oe "controller/src/errors"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of the CircuitBreaker
+type BreakerState string
+
+const (
+	// BreakerClosed lets every call through
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen fails every call fast until the open timeout has passed
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen lets a limited number of probe calls through to find out whether postgres recovered
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+// CircuitBreaker is shared by the reader and writer perfectionists. It opens after failureThreshold consecutive
+// failures that are worth retrying, so a struggling postgres is not hit with the full retry budget of every call.
+// While open, calls fail with ErrCircuitOpen. After openTimeout up to halfOpenProbes calls are let through,
+// the first successful one closes the breaker again, a failing one opens it for another openTimeout.
+type CircuitBreaker struct {
+	logger           *zap.Logger
+	failureThreshold int
+	openTimeout      time.Duration
+	halfOpenProbes   int
+
+	mu                  sync.Mutex
+	state               BreakerState
+	consecutiveFailures int
+	openedAt            time.Time
+	probesInFlight      int
+	lastErr             error
+	opened              int64
+	rejected            int64
+}
+
+// BreakerStatus is a snapshot of the CircuitBreaker for /health and /metrics
+type BreakerStatus struct {
+	State               BreakerState
+	ConsecutiveFailures int
+	OpenedAt            time.Time
+	LastError           string
+	OpenedTotal         int64
+	RejectedTotal       int64
+}
+
+func NewCircuitBreaker(logger *zap.Logger, failureThreshold int, openTimeout time.Duration, halfOpenProbes int) *CircuitBreaker {
+	return &CircuitBreaker{
+		logger:           logger,
+		failureThreshold: max(failureThreshold, 1),
+		openTimeout:      openTimeout,
+		halfOpenProbes:   max(halfOpenProbes, 1),
+		state:            BreakerClosed,
+	}
+}
+
+// callOutcome is what a call tells the breaker about the health of postgres
+type callOutcome int
+
+const (
+	// callSucceeded means postgres answered, even if the answer was an error like a missing row
+	callSucceeded callOutcome = iota
+	// callFailed means postgres could not be reached or failed in a way worth retrying
+	callFailed
+	// callAbandoned means the caller canceled the call or ran out of time, which says nothing about postgres
+	callAbandoned
+)
+
+// acquire asks the breaker for permission to run a call. If it is granted, release has to be called with the outcome of the call.
+func (b *CircuitBreaker) acquire() (release func(outcome callOutcome, err error), err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen {
+		if time.Since(b.openedAt) < b.openTimeout {
+			b.rejected++
+			return nil, fmt.Errorf("%w since %s: %v", oe.ErrCircuitOpen, b.openedAt.Format(time.RFC3339), b.lastErr)
+		}
+
+		b.logger.Info("circuit breaker is half-open, probing postgres")
+		b.state = BreakerHalfOpen
+		b.probesInFlight = 0
+	}
+
+	probe := b.state == BreakerHalfOpen
+	if probe {
+		if b.probesInFlight >= b.halfOpenProbes {
+			b.rejected++
+			return nil, fmt.Errorf("%w: waiting for the half-open probe to finish", oe.ErrCircuitOpen)
+		}
+		b.probesInFlight++
+	}
+
+	return func(outcome callOutcome, err error) { b.release(probe, outcome, err) }, nil
+}
+
+func (b *CircuitBreaker) release(probe bool, outcome callOutcome, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		b.probesInFlight--
+	}
+
+	//an abandoned probe frees its slot, so the next call probes again while the breaker stays half-open
+	if outcome == callAbandoned {
+		return
+	}
+
+	if outcome == callSucceeded {
+		if b.state != BreakerClosed {
+			b.logger.Info("postgres answered again, closing circuit breaker", zap.Duration("openFor", time.Since(b.openedAt)))
+		}
+
+		b.state = BreakerClosed
+		b.consecutiveFailures = 0
+		return
+	}
+
+	b.consecutiveFailures++
+	b.lastErr = err
+
+	//a failed probe opens the breaker right away, a probe that finishes after the breaker reopened changes nothing
+	if (probe && b.state == BreakerHalfOpen) || (b.state == BreakerClosed && b.consecutiveFailures >= b.failureThreshold) {
+		b.logger.Warn("opening circuit breaker, failing postgres calls fast", zap.Int("consecutiveFailures", b.consecutiveFailures), zap.Duration("openTimeout", b.openTimeout), zap.Error(err))
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+		b.opened++
+	}
+}
+
+// Status returns a snapshot of the breaker
+func (b *CircuitBreaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := BreakerStatus{
+		State:               b.state,
+		ConsecutiveFailures: b.consecutiveFailures,
+		OpenedTotal:         b.opened,
+		RejectedTotal:       b.rejected,
+	}
+
+	if b.state != BreakerClosed {
+		status.OpenedAt = b.openedAt
+	}
+
+	if b.lastErr != nil {
+		status.LastError = b.lastErr.Error()
+	}
+
+	return status
+}
+
+// guard runs fn if the breaker allows it and reports its outcome. Errors the policy does not retry, like a missing row,
+// count as successes, since postgres answered. Calls canceled by the caller or past their deadline count as neither,
+// since they say nothing about the health of postgres.
+func guard[T any](b *CircuitBreaker, retryable func(err error) bool, fn func(ctx context.Context) (T, error)) func(ctx context.Context) (T, error) {
+	return func(ctx context.Context) (T, error) {
+
+		release, err := b.acquire()
+		if err != nil {
+			var zero T
+			return zero, err
+		}
+
+		result, err := fn(ctx)
+
+		release(outcomeOf(ctx, err, retryable), err)
+
+		return result, err
+	}
+}
+
+// outcomeOf sorts the result of a call into a callOutcome, see guard
+func outcomeOf(ctx context.Context, err error, retryable func(err error) bool) callOutcome {
+	switch {
+	case err == nil:
+		return callSucceeded
+	case ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		return callAbandoned
+	case retryable == nil || retryable(err):
+		return callFailed
+	default:
+		return callSucceeded
+	}
+}
+
+// breakerRetryable wraps the retryable check of a policy, so calls rejected by the breaker are not retried
+func breakerRetryable(retryable func(err error) bool) func(err error) bool {
+	return func(err error) bool {
+		if errors.Is(err, oe.ErrCircuitOpen) {
+			return false
+		}
+
+		return retryable == nil || retryable(err)
+	}
+}
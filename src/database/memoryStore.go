@@ -0,0 +1,990 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	sqlc "controller/src/database/sqlc"
+	oe "controller/src/errors"
+	"controller/src/utils"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"math"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore implements ReadStore and WriteStore with the same semantics as the postgres implementation, but keeps all tables in memory.
+// It is meant for unit tests and simulations of the components. Every call, including a whole transaction or snapshot, holds one lock,
+// so transactions are trivially serializable and never have to be retried. now is used wherever postgres uses now().
+// Tables the controller only reads, like worker_metric or db_instance, are filled through the Put* methods.
+type MemoryStore struct {
+	now func() time.Time
+
+	mu     sync.Mutex
+	tables memoryTables
+}
+
+// memoryTables holds the rows of every table in insertion order
+type memoryTables struct {
+	controller       []sqlc.ControllerStatus
+	workers          []sqlc.WorkerMetric
+	migrationWorkers []sqlc.MigrationWorker
+	workerJobs       []sqlc.MigrationWorkerJob
+	dbInstances      []sqlc.DbInstance
+	dbConnErrs       []sqlc.DbConnErr
+	mappings         []sqlc.DbMapping
+	migrations       []sqlc.DbMigration
+	failureReports   []sqlc.FailureReport
+	probes           []sqlc.DbProbe
+	auditLog         []sqlc.AuditLog
+	nextAuditId      int64
+}
+
+// NewMemoryStore returns an empty MemoryStore. If now is nil, time.Now is used.
+func NewMemoryStore(now func() time.Time) *MemoryStore {
+
+	if now == nil {
+		now = time.Now
+	}
+
+	return &MemoryStore{
+		now:    now,
+		tables: memoryTables{nextAuditId: 1},
+	}
+}
+
+func (t memoryTables) clone() memoryTables {
+	return memoryTables{
+		controller:       slices.Clone(t.controller),
+		workers:          slices.Clone(t.workers),
+		migrationWorkers: slices.Clone(t.migrationWorkers),
+		workerJobs:       slices.Clone(t.workerJobs),
+		dbInstances:      slices.Clone(t.dbInstances),
+		dbConnErrs:       slices.Clone(t.dbConnErrs),
+		mappings:         slices.Clone(t.mappings),
+		migrations:       slices.Clone(t.migrations),
+		failureReports:   slices.Clone(t.failureReports),
+		probes:           slices.Clone(t.probes),
+		auditLog:         slices.Clone(t.auditLog),
+		nextAuditId:      t.nextAuditId,
+	}
+}
+
+// PutWorker inserts or replaces a worker, as the worker does with its heartbeat
+func (m *MemoryStore) PutWorker(worker sqlc.WorkerMetric) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.tables.workers = upsert(m.tables.workers, worker, func(w sqlc.WorkerMetric) bool { return w.ID == worker.ID })
+}
+
+// PutMigrationWorker inserts or replaces a migration worker, as the migration worker does with its heartbeat
+func (m *MemoryStore) PutMigrationWorker(worker sqlc.MigrationWorker) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.tables.migrationWorkers = upsert(m.tables.migrationWorkers, worker, func(w sqlc.MigrationWorker) bool { return w.ID == worker.ID })
+}
+
+// PutDbInstance inserts or replaces a database instance, as the database registers itself and reports its usage
+func (m *MemoryStore) PutDbInstance(instance sqlc.DbInstance) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.tables.dbInstances = upsert(m.tables.dbInstances, instance, func(i sqlc.DbInstance) bool { return i.Url == instance.Url })
+}
+
+// PutMigrationJob inserts or replaces a migration job, as the migration worker does when it reports status and progress
+func (m *MemoryStore) PutMigrationJob(job sqlc.DbMigration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.tables.migrations = upsert(m.tables.migrations, job, func(j sqlc.DbMigration) bool { return j.ID == job.ID })
+}
+
+// AddDbConnErr appends a connection error, as a worker does when it cannot reach a database
+func (m *MemoryStore) AddDbConnErr(connErr sqlc.DbConnErr) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.tables.dbConnErrs = append(m.tables.dbConnErrs, connErr)
+}
+
+func upsert[T any](rows []T, row T, match func(T) bool) []T {
+	if i := slices.IndexFunc(rows, match); i >= 0 {
+		rows[i] = row
+		return rows
+	}
+
+	return append(rows, row)
+}
+
+// memoryRead runs fn on the tables while holding the lock
+func memoryRead[T any](m *MemoryStore, fn func(t *memoryTables) (T, error)) (T, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return fn(&m.tables)
+}
+
+// write runs fn on a copy of the tables and keeps the copy only if fn succeeds, like a transaction that commits or rolls back
+func (m *MemoryStore) write(fn func(t *memoryTables) oe.DbError) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tables := m.tables.clone()
+
+	if dbErr := fn(&tables); dbErr.Err != nil {
+		return dbErr
+	}
+
+	m.tables = tables
+	return nil
+}
+
+// noRowsAffected is the error utils.Must returns for a statement that did not affect any row
+func noRowsAffected(statement string) oe.DbError {
+	return oe.DbError{Err: fmt.Errorf("no execution error but no rows affected: %s", statement), Kind: oe.DbErrNoRows, Reconcilable: false}
+}
+
+// uniqueViolation is the error postgres returns for a duplicate key
+func uniqueViolation(constraint string) oe.DbError {
+	return oe.DbError{Err: fmt.Errorf("duplicate key value violates unique constraint %q", constraint), Kind: oe.DbErrConstraint, Reconcilable: false}
+}
+
+func parseUUID(id string) (pgtype.UUID, oe.DbError) {
+
+	parsed, err := uuid.Parse(id)
+	if err != nil {
+		return pgtype.UUID{}, oe.DbError{Err: fmt.Errorf("could not parse uuid"), Kind: oe.DbErrInvalid, Reconcilable: false}
+	}
+
+	return pgtype.UUID{Bytes: parsed, Valid: true}, oe.DbError{Err: nil}
+}
+
+func (m *MemoryStore) timestamp() pgtype.Timestamptz {
+	return pgtype.Timestamptz{Time: m.now(), Valid: true}
+}
+
+func activeMigration(job sqlc.DbMigration) bool {
+	return job.Status == MigrationStatusWaiting || job.Status == MigrationStatusRunning
+}
+
+// Ping always succeeds
+func (m *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Snapshot runs fn with all tables locked, so all of its reads see the same state
+func (m *MemoryStore) Snapshot(ctx context.Context, operation string, fn func(s SnapshotReader) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return fn(memorySnapshot{tables: &m.tables})
+}
+
+// StaleSnapshot is Snapshot, the memory store has no replicas
+func (m *MemoryStore) StaleSnapshot(ctx context.Context, operation string, fn func(s SnapshotReader) error) (ReadOrigin, error) {
+	return ReadOrigin{}, m.Snapshot(ctx, operation, fn)
+}
+
+// GetControllerState returns the controller heartbeat, an error wrapping pgx.ErrNoRows if no controller registered yet
+func (m *MemoryStore) GetControllerState(ctx context.Context) (sqlc.ControllerStatus, error) {
+	return memoryRead(m, func(t *memoryTables) (sqlc.ControllerStatus, error) {
+		if len(t.controller) == 0 {
+			return sqlc.ControllerStatus{}, fmt.Errorf("getting controller state failed: %w", pgx.ErrNoRows)
+		}
+		return t.controller[0], nil
+	})
+}
+
+func (m *MemoryStore) GetAllWorkerState(ctx context.Context) ([]sqlc.WorkerMetric, error) {
+	return memoryRead(m, func(t *memoryTables) ([]sqlc.WorkerMetric, error) {
+		return slices.Clone(t.workers), nil
+	})
+}
+
+func (m *MemoryStore) GetAllMWorkerState(ctx context.Context) ([]sqlc.MigrationWorker, error) {
+	return memoryRead(m, func(t *memoryTables) ([]sqlc.MigrationWorker, error) {
+		return slices.Clone(t.migrationWorkers), nil
+	})
+}
+
+func (m *MemoryStore) GetSingleWorkerState(ctx context.Context, workerID string) (sqlc.WorkerMetric, error) {
+	return memoryRead(m, func(t *memoryTables) (sqlc.WorkerMetric, error) {
+
+		id, parseErr := parseUUID(workerID)
+		if parseErr.Err != nil {
+			return sqlc.WorkerMetric{}, parseErr.Err
+		}
+
+		i := slices.IndexFunc(t.workers, func(w sqlc.WorkerMetric) bool { return w.ID == id })
+		if i < 0 {
+			return sqlc.WorkerMetric{}, fmt.Errorf("getting single worker state failed: %w", pgx.ErrNoRows)
+		}
+
+		return t.workers[i], nil
+	})
+}
+
+func (m *MemoryStore) GetDBCount(ctx context.Context) (int, error) {
+	return memoryRead(m, func(t *memoryTables) (int, error) {
+		return len(t.dbInstances), nil
+	})
+}
+
+func (m *MemoryStore) GetDBConnErrors(ctx context.Context) ([]sqlc.DbConnErr, error) {
+	return memoryRead(m, func(t *memoryTables) ([]sqlc.DbConnErr, error) {
+		return slices.Clone(t.dbConnErrs), nil
+	})
+}
+
+// GetDBConnErrorBuckets counts the connection errors since the given time per worker, database and time bucket like GetDBConnErrorBuckets
+func (m *MemoryStore) GetDBConnErrorBuckets(ctx context.Context, since time.Time, bucket time.Duration) ([]sqlc.GetDBConnErrorBucketsRow, error) {
+	return memoryRead(m, func(t *memoryTables) ([]sqlc.GetDBConnErrorBucketsRow, error) {
+
+		type bucketKey struct {
+			workerID pgtype.UUID
+			dbUrl    pgtype.Text
+			start    int64
+		}
+
+		counts := make(map[bucketKey]int32)
+		keys := make([]bucketKey, 0)
+
+		for _, connErr := range t.dbConnErrs {
+
+			if !connErr.FailTime.Valid || connErr.FailTime.Time.Before(since) {
+				continue
+			}
+
+			key := bucketKey{
+				workerID: connErr.WorkerID,
+				dbUrl:    connErr.DbUrl,
+				start:    int64(math.Floor(float64(connErr.FailTime.Time.UnixNano())/float64(bucket))) * int64(bucket),
+			}
+
+			if _, ok := counts[key]; !ok {
+				keys = append(keys, key)
+			}
+			counts[key]++
+		}
+
+		buckets := make([]sqlc.GetDBConnErrorBucketsRow, 0, len(keys))
+		for _, key := range keys {
+			buckets = append(buckets, sqlc.GetDBConnErrorBucketsRow{
+				WorkerID:    key.workerID,
+				DbUrl:       key.dbUrl,
+				BucketStart: pgtype.Timestamptz{Time: time.Unix(0, key.start), Valid: true},
+				ErrorCount:  counts[key],
+			})
+		}
+
+		return buckets, nil
+	})
+}
+
+func (m *MemoryStore) GetAllDbInstanceInfo(ctx context.Context) ([]sqlc.DbInstance, error) {
+	return memoryRead(m, func(t *memoryTables) ([]sqlc.DbInstance, error) {
+		return memorySnapshot{tables: t}.GetAllDbInstanceInfo()
+	})
+}
+
+func (m *MemoryStore) GetAllDbMappingInfo(ctx context.Context) ([]sqlc.DbMapping, error) {
+	return memoryRead(m, func(t *memoryTables) ([]sqlc.DbMapping, error) {
+		return memorySnapshot{tables: t}.GetAllDbMappingInfo()
+	})
+}
+
+func (m *MemoryStore) GetDBMappingInfoByUrlFrom(ctx context.Context, url, from string) (sqlc.DbMapping, error) {
+	return memoryRead(m, func(t *memoryTables) (sqlc.DbMapping, error) {
+
+		i := slices.IndexFunc(t.mappings, func(mapping sqlc.DbMapping) bool { return mapping.Url == url && mapping.From == from })
+		if i < 0 {
+			return sqlc.DbMapping{}, fmt.Errorf("getting data on specific db mapping failed: %w", pgx.ErrNoRows)
+		}
+
+		return t.mappings[i], nil
+	})
+}
+
+func (m *MemoryStore) GetActiveMigrationJobs(ctx context.Context) ([]sqlc.DbMigration, error) {
+	return memoryRead(m, func(t *memoryTables) ([]sqlc.DbMigration, error) {
+		return memorySnapshot{tables: t}.GetActiveMigrationJobs()
+	})
+}
+
+func (m *MemoryStore) GetSingleMWorkerState(ctx context.Context, workerID string) (sqlc.MigrationWorker, error) {
+	return memoryRead(m, func(t *memoryTables) (sqlc.MigrationWorker, error) {
+
+		id, parseErr := parseUUID(workerID)
+		if parseErr.Err != nil {
+			return sqlc.MigrationWorker{}, parseErr.Err
+		}
+
+		i := slices.IndexFunc(t.migrationWorkers, func(w sqlc.MigrationWorker) bool { return w.ID == id })
+		if i < 0 {
+			return sqlc.MigrationWorker{}, fmt.Errorf("getting single migration worker state failed: %w", pgx.ErrNoRows)
+		}
+
+		return t.migrationWorkers[i], nil
+	})
+}
+
+func (m *MemoryStore) GetDatabaseTime(ctx context.Context) (time.Time, error) {
+	return m.now(), nil
+}
+
+func (m *MemoryStore) GetFailureReportsSince(ctx context.Context, since time.Time) ([]sqlc.FailureReport, error) {
+	return memoryRead(m, func(t *memoryTables) ([]sqlc.FailureReport, error) {
+
+		reports := make([]sqlc.FailureReport, 0)
+		for _, report := range t.failureReports {
+			if !report.GeneratedAt.Time.Before(since) {
+				reports = append(reports, report)
+			}
+		}
+
+		sort.SliceStable(reports, func(i, j int) bool { return reports[i].GeneratedAt.Time.Before(reports[j].GeneratedAt.Time) })
+
+		return reports, nil
+	})
+}
+
+func (m *MemoryStore) GetDueMigrationJobs(ctx context.Context) ([]sqlc.DbMigration, error) {
+	return memoryRead(m, func(t *memoryTables) ([]sqlc.DbMigration, error) {
+
+		now := m.now()
+
+		jobs := make([]sqlc.DbMigration, 0)
+		for _, job := range t.migrations {
+			if job.Status == MigrationStatusQueued && job.NextAttemptAt.Valid && !job.NextAttemptAt.Time.After(now) {
+				jobs = append(jobs, job)
+			}
+		}
+
+		sort.SliceStable(jobs, func(i, j int) bool { return jobs[i].NextAttemptAt.Time.Before(jobs[j].NextAttemptAt.Time) })
+
+		return jobs, nil
+	})
+}
+
+func (m *MemoryStore) GetAllMigrationJobs(ctx context.Context) ([]sqlc.DbMigration, error) {
+	return memoryRead(m, func(t *memoryTables) ([]sqlc.DbMigration, error) {
+		return slices.Clone(t.migrations), nil
+	})
+}
+
+func (m *MemoryStore) GetAllDbProbes(ctx context.Context) ([]sqlc.DbProbe, error) {
+	return memoryRead(m, func(t *memoryTables) ([]sqlc.DbProbe, error) {
+		return memorySnapshot{tables: t}.GetAllDbProbes()
+	})
+}
+
+func (m *MemoryStore) GetAuditEntries(ctx context.Context, beforeId int64, subject string, pageSize int32) ([]sqlc.AuditLog, error) {
+	return memoryRead(m, func(t *memoryTables) ([]sqlc.AuditLog, error) {
+
+		entries := make([]sqlc.AuditLog, 0, pageSize)
+
+		//entries are appended with increasing ids, so walking backwards returns the newest first
+		for i := len(t.auditLog) - 1; i >= 0 && len(entries) < int(pageSize); i-- {
+			entry := t.auditLog[i]
+			if entry.ID < beforeId && (subject == "" || entry.Subject == subject) {
+				entries = append(entries, entry)
+			}
+		}
+
+		return entries, nil
+	})
+}
+
+// Transaction runs fn on a copy of the tables, which replaces them only if fn succeeds
+func (m *MemoryStore) Transaction(ctx context.Context, operation string, fn func(uow TxWriter) oe.DbError) error {
+	return m.write(func(t *memoryTables) oe.DbError {
+		return fn(&memoryTx{tables: t, now: m.now})
+	})
+}
+
+func (m *MemoryStore) RemoveWorker(uuid pgtype.UUID, ctx context.Context) error {
+	return m.write(func(t *memoryTables) oe.DbError {
+
+		before := len(t.workers)
+		t.workers = slices.DeleteFunc(t.workers, func(w sqlc.WorkerMetric) bool { return w.ID == uuid })
+		if len(t.workers) == before {
+			return noRowsAffected("DELETE 0")
+		}
+
+		return oe.DbError{Err: nil}
+	})
+}
+
+func (m *MemoryStore) AddMigrationWorker(uuid, from, to string, ctx context.Context) error {
+	return m.Transaction(ctx, "AddMigrationWorker", func(uow TxWriter) oe.DbError {
+		return uow.AddMigrationWorker(uuid, from, to)
+	})
+}
+
+func (m *MemoryStore) RemoveMigrationWorker(uuid string, ctx context.Context) error {
+	return m.Transaction(ctx, "RemoveMigrationWorker", func(uow TxWriter) oe.DbError {
+		return uow.RetireMigrationWorker(uuid)
+	})
+}
+
+func (m *MemoryStore) AddWorkerJobJoin(ctx context.Context, workerId, migrationId string) error {
+	return m.Transaction(ctx, "AddWorkerJobJoin", func(uow TxWriter) oe.DbError {
+		return uow.AddWorkerJobJoin(workerId, migrationId)
+	})
+}
+
+func (m *MemoryStore) AddDatabaseMapping(from, url string, ctx context.Context) error {
+	return m.write(func(t *memoryTables) oe.DbError {
+
+		t.mappings = append(t.mappings, sqlc.DbMapping{
+			ID:   pgtype.UUID{Bytes: uuid.New(), Valid: true},
+			Url:  url,
+			From: from,
+		})
+
+		return oe.DbError{Err: nil}
+	})
+}
+
+func (m *MemoryStore) AddMigrationJob(ctx context.Context, addReq MigrationJobAddReq, migrationId uuid.UUID) error {
+	return m.Transaction(ctx, "AddMigrationJob", func(uow TxWriter) oe.DbError {
+		return uow.AddMigrationJob(addReq, migrationId)
+	})
+}
+
+// Heartbeat renews the controller heartbeat. It fails with ErrLeadershipLost if the row belongs to another controller or there is none.
+func (m *MemoryStore) Heartbeat(ctx context.Context, controllerId string) error {
+	return m.write(func(t *memoryTables) oe.DbError {
+
+		if len(t.controller) == 0 || t.controller[0].ControllerID.String != controllerId {
+			return oe.DbError{Err: oe.ErrLeadershipLost, Kind: oe.DbErrNoRows, Reconcilable: false}
+		}
+
+		t.controller[0].LastHeartbeat = m.timestamp()
+
+		return oe.DbError{Err: nil}
+	})
+}
+
+// RegisterController takes over the row of a previous controller whose heartbeat is older than heartbeatTimeout,
+// or creates it if there was none. It fails with ErrLeadershipLost if the previous controller is still alive.
+func (m *MemoryStore) RegisterController(ctx context.Context, controllerId string, heartbeatTimeout time.Duration) error {
+	return m.write(func(t *memoryTables) oe.DbError {
+
+		owner := pgtype.Text{String: controllerId, Valid: true}
+
+		if len(t.controller) == 0 {
+			t.controller = []sqlc.ControllerStatus{{Scaling: false, LastHeartbeat: m.timestamp(), ControllerID: owner}}
+			return oe.DbError{Err: nil}
+		}
+
+		if !t.controller[0].LastHeartbeat.Time.Before(m.now().Add(-heartbeatTimeout)) {
+			return oe.DbError{Err: oe.ErrLeadershipLost, Kind: oe.DbErrNoRows, Reconcilable: false}
+		}
+
+		t.controller[0].ControllerID = owner
+		t.controller[0].LastHeartbeat = m.timestamp()
+
+		return oe.DbError{Err: nil}
+	})
+}
+
+func (m *MemoryStore) ReassignMigrationJob(ctx context.Context, jobId, workerId, reason string) error {
+	return m.Transaction(ctx, "ReassignMigrationJob", func(uow TxWriter) oe.DbError {
+		return uow.ReassignMigrationJob(jobId, workerId, reason)
+	})
+}
+
+func (m *MemoryStore) SetMigrationJobReason(ctx context.Context, jobId, reason string) error {
+	return m.write(func(t *memoryTables) oe.DbError {
+
+		id, parseErr := parseUUID(jobId)
+		if parseErr.Err != nil {
+			return parseErr
+		}
+
+		return t.updateMigration(id, func(job *sqlc.DbMigration) oe.DbError {
+			job.StatusReason = pgtype.Text{String: reason, Valid: true}
+			return oe.DbError{Err: nil}
+		})
+	})
+}
+
+func (m *MemoryStore) FailMigrationJob(ctx context.Context, jobId, reason string) error {
+	return m.write(func(t *memoryTables) oe.DbError {
+
+		id, parseErr := parseUUID(jobId)
+		if parseErr.Err != nil {
+			return parseErr
+		}
+
+		if dbErr := t.updateMigration(id, func(job *sqlc.DbMigration) oe.DbError {
+			job.Status = MigrationStatusFailed
+			job.StatusReason = pgtype.Text{String: reason, Valid: true}
+			job.MWorkerID = pgtype.UUID{}
+			job.NextAttemptAt = pgtype.Timestamptz{}
+			return oe.DbError{Err: nil}
+		}); dbErr.Err != nil {
+			return dbErr
+		}
+
+		t.deleteWorkerJobs(id, pgtype.UUID{})
+
+		return oe.DbError{Err: nil}
+	})
+}
+
+// MarkDbInstanceUnhealthy marks the instance, keeping the original time and reason if it is already marked
+func (m *MemoryStore) MarkDbInstanceUnhealthy(ctx context.Context, url, reason string) error {
+	return m.write(func(t *memoryTables) oe.DbError {
+
+		for i := range t.dbInstances {
+			if t.dbInstances[i].Url == url && !t.dbInstances[i].UnhealthySince.Valid {
+				t.dbInstances[i].UnhealthySince = m.timestamp()
+				t.dbInstances[i].UnhealthyReason = pgtype.Text{String: reason, Valid: true}
+			}
+		}
+
+		return oe.DbError{Err: nil}
+	})
+}
+
+func (m *MemoryStore) ClearDbInstanceUnhealthy(ctx context.Context, url string) error {
+	return m.write(func(t *memoryTables) oe.DbError {
+
+		i := slices.IndexFunc(t.dbInstances, func(instance sqlc.DbInstance) bool { return instance.Url == url })
+		if i < 0 {
+			return noRowsAffected("UPDATE 0")
+		}
+
+		t.dbInstances[i].UnhealthySince = pgtype.Timestamptz{}
+		t.dbInstances[i].UnhealthyReason = pgtype.Text{}
+
+		return oe.DbError{Err: nil}
+	})
+}
+
+func (m *MemoryStore) StoreFailureReport(ctx context.Context, generatedAt time.Time, flaggedCount int, report []byte, retainSince time.Time) error {
+	return m.write(func(t *memoryTables) oe.DbError {
+
+		t.failureReports = append(t.failureReports, sqlc.FailureReport{
+			ID:           pgtype.UUID{Bytes: uuid.New(), Valid: true},
+			GeneratedAt:  pgtype.Timestamptz{Time: generatedAt, Valid: true},
+			FlaggedCount: int32(flaggedCount),
+			Report:       bytes.Clone(report),
+		})
+
+		t.failureReports = slices.DeleteFunc(t.failureReports, func(r sqlc.FailureReport) bool { return r.GeneratedAt.Time.Before(retainSince) })
+
+		return oe.DbError{Err: nil}
+	})
+}
+
+// PurgeDBConnErrors deletes up to batchSize connection errors that happened before the given time
+func (m *MemoryStore) PurgeDBConnErrors(ctx context.Context, before time.Time, batchSize int) (int64, error) {
+	var deleted int64
+
+	err := m.write(func(t *memoryTables) oe.DbError {
+
+		t.dbConnErrs = slices.DeleteFunc(t.dbConnErrs, func(e sqlc.DbConnErr) bool {
+			if deleted >= int64(batchSize) || !e.FailTime.Valid || !e.FailTime.Time.Before(before) {
+				return false
+			}
+
+			deleted++
+			return true
+		})
+
+		return oe.DbError{Err: nil}
+	})
+
+	return deleted, err
+}
+
+func (m *MemoryStore) RetireMigrationWorker(ctx context.Context, workerId string) error {
+	return m.Transaction(ctx, "RetireMigrationWorker", func(uow TxWriter) oe.DbError {
+		return uow.RetireMigrationWorker(workerId)
+	})
+}
+
+func (m *MemoryStore) RequeueMigrationJob(ctx context.Context, jobId string, nextAttemptAt time.Time, reason string) error {
+	return m.Transaction(ctx, "RequeueMigrationJob", func(uow TxWriter) oe.DbError {
+		return uow.RequeueMigrationJob(jobId, nextAttemptAt, reason)
+	})
+}
+
+// StoreDbProbes upserts the probe results like UpsertDbProbe and removes the results of instances that were not probed
+func (m *MemoryStore) StoreDbProbes(ctx context.Context, results []DbProbeResult) error {
+	return m.write(func(t *memoryTables) oe.DbError {
+
+		urls := make([]string, 0, len(results))
+
+		for _, result := range results {
+
+			probe := sqlc.DbProbe{
+				Url:       result.Url,
+				Reachable: result.Reachable,
+				LatencyMs: pgtype.Float8{Float64: float64(result.Latency.Microseconds()) / 1000, Valid: result.Reachable},
+				Error:     pgtype.Text{String: result.Err, Valid: result.Err != ""},
+				ProbedAt:  m.timestamp(),
+			}
+
+			if i := slices.IndexFunc(t.probes, func(p sqlc.DbProbe) bool { return p.Url == result.Url }); i >= 0 && !result.Reachable {
+				probe.ConsecutiveFailures = t.probes[i].ConsecutiveFailures + 1
+			} else if !result.Reachable {
+				probe.ConsecutiveFailures = 1
+			}
+
+			t.probes = upsert(t.probes, probe, func(p sqlc.DbProbe) bool { return p.Url == result.Url })
+			urls = append(urls, result.Url)
+		}
+
+		t.probes = slices.DeleteFunc(t.probes, func(p sqlc.DbProbe) bool { return !slices.Contains(urls, p.Url) })
+
+		return oe.DbError{Err: nil}
+	})
+}
+
+func (m *MemoryStore) UpdateMapping(ctx context.Context, mappingId, url, from string) error {
+	return m.write(func(t *memoryTables) oe.DbError {
+
+		id, parseErr := parseUUID(mappingId)
+		if parseErr.Err != nil {
+			return parseErr
+		}
+
+		i := slices.IndexFunc(t.mappings, func(mapping sqlc.DbMapping) bool { return mapping.ID == id })
+		if i < 0 {
+			return noRowsAffected("UPDATE 0")
+		}
+
+		t.mappings[i].Url = url
+		t.mappings[i].From = from
+
+		return oe.DbError{Err: nil}
+	})
+}
+
+func (m *MemoryStore) DeleteMapping(ctx context.Context, mappingId string) error {
+	return m.write(func(t *memoryTables) oe.DbError {
+
+		id, parseErr := parseUUID(mappingId)
+		if parseErr.Err != nil {
+			return parseErr
+		}
+
+		before := len(t.mappings)
+		t.mappings = slices.DeleteFunc(t.mappings, func(mapping sqlc.DbMapping) bool { return mapping.ID == id })
+		if len(t.mappings) == before {
+			return noRowsAffected("DELETE 0")
+		}
+
+		return oe.DbError{Err: nil}
+	})
+}
+
+func (m *MemoryStore) AppendAuditEntry(ctx context.Context, entry AuditEntry) error {
+	return m.write(func(t *memoryTables) oe.DbError {
+
+		t.auditLog = append(t.auditLog, sqlc.AuditLog{
+			ID:           t.nextAuditId,
+			OccurredAt:   m.timestamp(),
+			Actor:        entry.Actor,
+			Action:       entry.Action,
+			Subject:      entry.Subject,
+			ControllerID: entry.ControllerID,
+			TraceID:      pgtype.Text{String: entry.TraceID, Valid: entry.TraceID != ""},
+			Reason:       pgtype.Text{String: entry.Reason, Valid: entry.Reason != ""},
+			Before:       bytes.Clone(entry.Before),
+			After:        bytes.Clone(entry.After),
+		})
+		t.nextAuditId++
+
+		return oe.DbError{Err: nil}
+	})
+}
+
+// updateMigration applies fn to the migration job with the given id. Like the unique index on db_migration,
+// it refuses to leave a migration worker with more than one waiting or running job.
+func (t *memoryTables) updateMigration(id pgtype.UUID, fn func(job *sqlc.DbMigration) oe.DbError) oe.DbError {
+
+	i := slices.IndexFunc(t.migrations, func(job sqlc.DbMigration) bool { return job.ID == id })
+	if i < 0 {
+		return noRowsAffected("UPDATE 0")
+	}
+
+	job := t.migrations[i]
+	if dbErr := fn(&job); dbErr.Err != nil {
+		return dbErr
+	}
+
+	if dbErr := t.checkOneActiveJob(job); dbErr.Err != nil {
+		return dbErr
+	}
+
+	t.migrations[i] = job
+	return oe.DbError{Err: nil}
+}
+
+func (t *memoryTables) checkOneActiveJob(job sqlc.DbMigration) oe.DbError {
+
+	if !activeMigration(job) || !job.MWorkerID.Valid {
+		return oe.DbError{Err: nil}
+	}
+
+	for _, other := range t.migrations {
+		if other.ID != job.ID && other.MWorkerID == job.MWorkerID && activeMigration(other) {
+			return uniqueViolation("db_migration_one_active_job_per_worker")
+		}
+	}
+
+	return oe.DbError{Err: nil}
+}
+
+// deleteWorkerJobs removes all join rows of the migration job or the migration worker, an invalid id matches nothing
+func (t *memoryTables) deleteWorkerJobs(migrationId, workerId pgtype.UUID) {
+	t.workerJobs = slices.DeleteFunc(t.workerJobs, func(join sqlc.MigrationWorkerJob) bool {
+		return (migrationId.Valid && join.MigrationID == migrationId) || (workerId.Valid && join.WorkerID == workerId)
+	})
+}
+
+// memorySnapshot implements SnapshotReader on the tables of a MemoryStore, whose lock is held by the caller
+type memorySnapshot struct {
+	tables *memoryTables
+}
+
+func (s memorySnapshot) GetAllDbInstanceInfo() ([]sqlc.DbInstance, error) {
+	return slices.Clone(s.tables.dbInstances), nil
+}
+
+func (s memorySnapshot) GetAllDbMappingInfo() ([]sqlc.DbMapping, error) {
+	return slices.Clone(s.tables.mappings), nil
+}
+
+func (s memorySnapshot) GetAllWorkerState() ([]sqlc.WorkerMetric, error) {
+	return slices.Clone(s.tables.workers), nil
+}
+
+func (s memorySnapshot) GetAllMWorkerState() ([]sqlc.MigrationWorker, error) {
+	return slices.Clone(s.tables.migrationWorkers), nil
+}
+
+func (s memorySnapshot) GetAllDbProbes() ([]sqlc.DbProbe, error) {
+	return slices.Clone(s.tables.probes), nil
+}
+
+func (s memorySnapshot) GetActiveMigrationJobs() ([]sqlc.DbMigration, error) {
+
+	jobs := make([]sqlc.DbMigration, 0)
+	for _, job := range s.tables.migrations {
+		if job.Status != MigrationStatusDone && job.Status != MigrationStatusFailed && job.Status != MigrationStatusQueued {
+			jobs = append(jobs, job)
+		}
+	}
+
+	return jobs, nil
+}
+
+// memoryTx implements TxWriter on a copy of the tables of a MemoryStore
+type memoryTx struct {
+	tables *memoryTables
+	now    func() time.Time
+}
+
+func (u *memoryTx) AddMigrationWorker(uuid, from, to string) oe.DbError {
+
+	id, parseErr := parseUUID(uuid)
+	if parseErr.Err != nil {
+		return parseErr
+	}
+
+	if slices.ContainsFunc(u.tables.migrationWorkers, func(w sqlc.MigrationWorker) bool { return w.ID == id }) {
+		return uniqueViolation("migration_worker_pkey")
+	}
+
+	u.tables.migrationWorkers = append(u.tables.migrationWorkers, sqlc.MigrationWorker{
+		ID:            id,
+		LastHeartbeat: pgtype.Timestamptz{Time: u.now(), Valid: true},
+		Uptime:        pgtype.Interval{Valid: true},
+		WorkingOnFrom: pgtype.Text{String: from, Valid: true},
+		WorkingOnTo:   pgtype.Text{String: to, Valid: true},
+	})
+
+	return oe.DbError{Err: nil}
+}
+
+func (u *memoryTx) AddMigrationJob(addReq MigrationJobAddReq, migrationJobId uuid.UUID) oe.DbError {
+
+	workerId, parseErr := parseUUID(addReq.MWorkerId)
+	if parseErr.Err != nil {
+		return parseErr
+	}
+
+	job := sqlc.DbMigration{
+		ID:        pgtype.UUID{Bytes: migrationJobId, Valid: true},
+		Url:       addReq.Url,
+		MWorkerID: workerId,
+		From:      addReq.From,
+		To:        addReq.To,
+		Status:    MigrationStatusWaiting,
+	}
+
+	if slices.ContainsFunc(u.tables.migrations, func(other sqlc.DbMigration) bool { return other.ID == job.ID }) {
+		return uniqueViolation("db_migration_pkey")
+	}
+
+	if dbErr := u.tables.checkOneActiveJob(job); dbErr.Err != nil {
+		return dbErr
+	}
+
+	u.tables.migrations = append(u.tables.migrations, job)
+
+	return oe.DbError{Err: nil}
+}
+
+func (u *memoryTx) AddWorkerJobJoin(workerId, migrationId string) oe.DbError {
+
+	worker, parseErr := parseUUID(workerId)
+	if parseErr.Err != nil {
+		return parseErr
+	}
+
+	migration, parseErr := parseUUID(migrationId)
+	if parseErr.Err != nil {
+		return parseErr
+	}
+
+	u.tables.workerJobs = append(u.tables.workerJobs, sqlc.MigrationWorkerJob{WorkerID: worker, MigrationID: migration})
+
+	return oe.DbError{Err: nil}
+}
+
+// ClaimFreeMigrationWorker returns the migration worker without an active job that heartbeated last, if it did so since aliveSince
+func (u *memoryTx) ClaimFreeMigrationWorker(aliveSince time.Time) (string, oe.DbError) {
+
+	var claimed *sqlc.MigrationWorker
+
+	for i, worker := range u.tables.migrationWorkers {
+
+		if !worker.LastHeartbeat.Valid || worker.LastHeartbeat.Time.Before(aliveSince) {
+			continue
+		}
+
+		busy := slices.ContainsFunc(u.tables.migrations, func(job sqlc.DbMigration) bool { return job.MWorkerID == worker.ID && activeMigration(job) })
+		if busy {
+			continue
+		}
+
+		if claimed == nil || worker.LastHeartbeat.Time.After(claimed.LastHeartbeat.Time) {
+			claimed = &u.tables.migrationWorkers[i]
+		}
+	}
+
+	if claimed == nil {
+		return "", utils.ClassifyDbError(fmt.Errorf("claiming free migration worker failed: %w", pgx.ErrNoRows))
+	}
+
+	return claimed.ID.String(), oe.DbError{Err: nil}
+}
+
+// LockDbInstance returns the database instance, the tables are locked for the whole transaction anyway
+func (u *memoryTx) LockDbInstance(url string) (sqlc.DbInstance, oe.DbError) {
+
+	index := slices.IndexFunc(u.tables.dbInstances, func(instance sqlc.DbInstance) bool { return instance.Url == url })
+	if index < 0 {
+		return sqlc.DbInstance{}, utils.ClassifyDbError(fmt.Errorf("locking db instance failed: %w", pgx.ErrNoRows))
+	}
+
+	return u.tables.dbInstances[index], oe.DbError{Err: nil}
+}
+
+func (u *memoryTx) ClaimQueuedMigrationJob(jobId string) (sqlc.DbMigration, oe.DbError) {
+
+	id, parseErr := parseUUID(jobId)
+	if parseErr.Err != nil {
+		return sqlc.DbMigration{}, parseErr
+	}
+
+	i := slices.IndexFunc(u.tables.migrations, func(job sqlc.DbMigration) bool { return job.ID == id && job.Status == MigrationStatusQueued })
+	if i < 0 {
+		return sqlc.DbMigration{}, utils.ClassifyDbError(fmt.Errorf("claiming queued migration job failed: %w", pgx.ErrNoRows))
+	}
+
+	return u.tables.migrations[i], oe.DbError{Err: nil}
+}
+
+func (u *memoryTx) ReassignMigrationJob(jobId, workerId, reason string) oe.DbError {
+
+	job, parseErr := parseUUID(jobId)
+	if parseErr.Err != nil {
+		return parseErr
+	}
+
+	worker, parseErr := parseUUID(workerId)
+	if parseErr.Err != nil {
+		return parseErr
+	}
+
+	if dbErr := u.tables.updateMigration(job, func(migration *sqlc.DbMigration) oe.DbError {
+		migration.MWorkerID = worker
+		migration.Status = MigrationStatusWaiting
+		migration.StatusReason = pgtype.Text{String: reason, Valid: true}
+		migration.Attempts++
+		migration.NextAttemptAt = pgtype.Timestamptz{}
+		return oe.DbError{Err: nil}
+	}); dbErr.Err != nil {
+		return dbErr
+	}
+
+	u.tables.deleteWorkerJobs(job, pgtype.UUID{})
+	u.tables.workerJobs = append(u.tables.workerJobs, sqlc.MigrationWorkerJob{WorkerID: worker, MigrationID: job})
+
+	return oe.DbError{Err: nil}
+}
+
+func (u *memoryTx) RequeueMigrationJob(jobId string, nextAttemptAt time.Time, reason string) oe.DbError {
+
+	job, parseErr := parseUUID(jobId)
+	if parseErr.Err != nil {
+		return parseErr
+	}
+
+	if dbErr := u.tables.updateMigration(job, func(migration *sqlc.DbMigration) oe.DbError {
+		migration.Status = MigrationStatusQueued
+		migration.StatusReason = pgtype.Text{String: reason, Valid: true}
+		migration.MWorkerID = pgtype.UUID{}
+		migration.NextAttemptAt = pgtype.Timestamptz{Time: nextAttemptAt, Valid: true}
+		return oe.DbError{Err: nil}
+	}); dbErr.Err != nil {
+		return dbErr
+	}
+
+	u.tables.deleteWorkerJobs(job, pgtype.UUID{})
+
+	return oe.DbError{Err: nil}
+}
+
+func (u *memoryTx) RetireMigrationWorker(workerId string) oe.DbError {
+
+	worker, parseErr := parseUUID(workerId)
+	if parseErr.Err != nil {
+		return parseErr
+	}
+
+	u.tables.deleteWorkerJobs(pgtype.UUID{}, worker)
+
+	before := len(u.tables.migrationWorkers)
+	u.tables.migrationWorkers = slices.DeleteFunc(u.tables.migrationWorkers, func(w sqlc.MigrationWorker) bool { return w.ID == worker })
+	if len(u.tables.migrationWorkers) == before {
+		return noRowsAffected("DELETE 0")
+	}
+
+	return oe.DbError{Err: nil}
+}
@@ -0,0 +1,239 @@
+package database
+
+import (
+	"context"
+	sqlc "controller/src/database/sqlc"
+	oe "controller/src/errors"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+	"testing"
+	"time"
+)
+
+// TestMemoryStoreParity runs the claiming and requeueing paths of the MemoryStore and checks them against what the
+// queries and constraints of the postgres schema do: which worker ClaimFreeMigrationWorker picks, what RequeueMigrationJob
+// and RetireMigrationWorker leave behind, the errors utils.Must returns for missing rows and the partial unique index
+// db_migration_one_active_job_per_worker.
+func TestMemoryStoreParity(t *testing.T) {
+
+	now := time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC)
+	aliveSince := now.Add(-5 * time.Second)
+
+	fresh, older, busy, dead := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	job, otherJob := uuid.New(), uuid.New()
+
+	worker := func(id uuid.UUID, heartbeat time.Time) sqlc.MigrationWorker {
+		return sqlc.MigrationWorker{ID: pgID(id), LastHeartbeat: pgtype.Timestamptz{Time: heartbeat, Valid: true}}
+	}
+
+	migration := func(id, workerId uuid.UUID, status string) sqlc.DbMigration {
+		return sqlc.DbMigration{ID: pgID(id), Url: "db-1", MWorkerID: pgID(workerId), From: "a", To: "m", Status: status}
+	}
+
+	//fresh heartbeated last, busy even later but is running a job and dead is past the heartbeat timeout
+	workers := func(m *MemoryStore) {
+		m.PutMigrationWorker(worker(fresh, now.Add(-time.Second)))
+		m.PutMigrationWorker(worker(older, now.Add(-2*time.Second)))
+		m.PutMigrationWorker(worker(busy, now))
+		m.PutMigrationWorker(worker(dead, now.Add(-time.Minute)))
+		m.PutMigrationJob(migration(otherJob, busy, MigrationStatusRunning))
+	}
+
+	//the job is waiting on fresh, both the job and the worker have a join row like after RunMigration
+	assigned := func(m *MemoryStore) {
+		workers(m)
+		m.PutMigrationJob(migration(job, fresh, MigrationStatusWaiting))
+		m.tables.workerJobs = append(m.tables.workerJobs,
+			sqlc.MigrationWorkerJob{WorkerID: pgID(fresh), MigrationID: pgID(job)},
+			sqlc.MigrationWorkerJob{WorkerID: pgID(busy), MigrationID: pgID(otherJob)})
+	}
+
+	tests := []struct {
+		name  string
+		setup func(m *MemoryStore)
+		run   func(ctx context.Context, m *MemoryStore) (string, error)
+		kind  oe.DbErrorKind
+		check func(t *testing.T, m *MemoryStore, result string)
+	}{
+		{
+			name:  "claim picks the idle worker that heartbeated last",
+			setup: workers,
+			run: func(ctx context.Context, m *MemoryStore) (string, error) {
+				return claim(ctx, m, aliveSince)
+			},
+			check: func(t *testing.T, m *MemoryStore, result string) {
+				if result != fresh.String() {
+					t.Errorf("expected worker %s to be claimed, got %s", fresh, result)
+				}
+			},
+		},
+		{
+			name:  "claim skips workers that stopped heartbeating",
+			setup: workers,
+			run: func(ctx context.Context, m *MemoryStore) (string, error) {
+				return claim(ctx, m, now.Add(time.Second))
+			},
+			kind: oe.DbErrNoRows,
+		},
+		{
+			name:  "requeue detaches the job from its worker",
+			setup: assigned,
+			run: func(ctx context.Context, m *MemoryStore) (string, error) {
+				return "", m.RequeueMigrationJob(ctx, job.String(), now.Add(time.Minute), "worker died")
+			},
+			check: func(t *testing.T, m *MemoryStore, result string) {
+				requeued := findMigration(m, job)
+				if requeued.Status != MigrationStatusQueued || requeued.MWorkerID.Valid || !requeued.NextAttemptAt.Time.Equal(now.Add(time.Minute)) {
+					t.Errorf("expected a queued job without worker, got %+v", requeued)
+				}
+				if joins(m, pgtype.UUID{}, pgID(job)) != 0 {
+					t.Errorf("expected the join row of the requeued job to be removed")
+				}
+				if claimed, err := claim(context.Background(), m, aliveSince); err != nil || claimed != fresh.String() {
+					t.Errorf("expected the worker to be free again, got %s (%v)", claimed, err)
+				}
+			},
+		},
+		{
+			name:  "requeue of an unknown job affects no rows",
+			setup: assigned,
+			run: func(ctx context.Context, m *MemoryStore) (string, error) {
+				return "", m.RequeueMigrationJob(ctx, uuid.NewString(), now, "worker died")
+			},
+			kind: oe.DbErrNoRows,
+		},
+		{
+			name:  "retire removes the worker and its join rows",
+			setup: assigned,
+			run: func(ctx context.Context, m *MemoryStore) (string, error) {
+				return "", m.RetireMigrationWorker(ctx, fresh.String())
+			},
+			check: func(t *testing.T, m *MemoryStore, result string) {
+				if _, err := m.GetSingleMWorkerState(context.Background(), fresh.String()); err == nil {
+					t.Errorf("expected worker %s to be removed", fresh)
+				}
+				if joins(m, pgID(fresh), pgtype.UUID{}) != 0 {
+					t.Errorf("expected the join rows of the retired worker to be removed")
+				}
+				if joins(m, pgID(busy), pgtype.UUID{}) != 1 {
+					t.Errorf("expected the join rows of other workers to be kept")
+				}
+			},
+		},
+		{
+			name:  "retire of an unknown worker affects no rows",
+			setup: workers,
+			run: func(ctx context.Context, m *MemoryStore) (string, error) {
+				return "", m.RetireMigrationWorker(ctx, uuid.NewString())
+			},
+			kind: oe.DbErrNoRows,
+		},
+		{
+			name:  "second active job of a worker violates the unique index and rolls back",
+			setup: workers,
+			run: func(ctx context.Context, m *MemoryStore) (string, error) {
+				return "", m.Transaction(ctx, "test", func(uow TxWriter) oe.DbError {
+					if dbErr := uow.AddMigrationJob(MigrationJobAddReq{From: "a", To: "m", Url: "db-1", MWorkerId: older.String()}, job); dbErr.Err != nil {
+						return dbErr
+					}
+					return uow.AddMigrationJob(MigrationJobAddReq{From: "n", To: "z", Url: "db-1", MWorkerId: older.String()}, uuid.New())
+				})
+			},
+			kind: oe.DbErrConstraint,
+			check: func(t *testing.T, m *MemoryStore, result string) {
+				if findMigration(m, job).ID.Valid {
+					t.Errorf("expected the first job of the failed transaction to be rolled back")
+				}
+			},
+		},
+		{
+			name:  "reassigning onto a busy worker violates the unique index",
+			setup: assigned,
+			run: func(ctx context.Context, m *MemoryStore) (string, error) {
+				return "", m.ReassignMigrationJob(ctx, job.String(), busy.String(), "worker died")
+			},
+			kind: oe.DbErrConstraint,
+			check: func(t *testing.T, m *MemoryStore, result string) {
+				if kept := findMigration(m, job); kept.MWorkerID != pgID(fresh) {
+					t.Errorf("expected the job to stay on worker %s, got %+v", fresh, kept)
+				}
+			},
+		},
+		{
+			name:  "a done job does not count as active",
+			setup: workers,
+			run: func(ctx context.Context, m *MemoryStore) (string, error) {
+				m.PutMigrationJob(migration(uuid.New(), older, MigrationStatusDone))
+				return "", m.AddMigrationJob(ctx, MigrationJobAddReq{From: "a", To: "m", Url: "db-1", MWorkerId: older.String()}, job)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			m := NewMemoryStore(func() time.Time { return now })
+			test.setup(m)
+
+			result, err := test.run(context.Background(), m)
+
+			var dbErr oe.DbError
+			switch {
+			case test.kind == "" && err != nil:
+				t.Fatalf("expected no error, got %v", err)
+			case test.kind != "" && !errors.As(err, &dbErr):
+				t.Fatalf("expected an error of kind %s, got %v", test.kind, err)
+			case test.kind != "" && dbErr.Kind != test.kind:
+				t.Fatalf("expected an error of kind %s, got %s (%v)", test.kind, dbErr.Kind, err)
+			}
+
+			if test.check != nil {
+				test.check(t, m, result)
+			}
+		})
+	}
+}
+
+func pgID(id uuid.UUID) pgtype.UUID {
+	return pgtype.UUID{Bytes: id, Valid: true}
+}
+
+// claim claims a migration worker in its own transaction, like RunMigration does
+func claim(ctx context.Context, m *MemoryStore, aliveSince time.Time) (string, error) {
+
+	var claimed string
+
+	err := m.Transaction(ctx, "claim", func(uow TxWriter) oe.DbError {
+		workerId, dbErr := uow.ClaimFreeMigrationWorker(aliveSince)
+		claimed = workerId
+		return dbErr
+	})
+
+	return claimed, err
+}
+
+func findMigration(m *MemoryStore, id uuid.UUID) sqlc.DbMigration {
+
+	jobs, _ := m.GetAllMigrationJobs(context.Background())
+	for _, job := range jobs {
+		if job.ID == pgID(id) {
+			return job
+		}
+	}
+
+	return sqlc.DbMigration{}
+}
+
+// joins counts the join rows of the worker or the migration
+func joins(m *MemoryStore, workerId, migrationId pgtype.UUID) int {
+
+	count := 0
+	for _, join := range m.tables.workerJobs {
+		if (workerId.Valid && join.WorkerID == workerId) || (migrationId.Valid && join.MigrationID == migrationId) {
+			count++
+		}
+	}
+
+	return count
+}
@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS migration_worker_jobs;
+DROP TABLE IF EXISTS db_migration;
+DROP TABLE IF EXISTS migration_worker;
+DROP TABLE IF EXISTS db_conn_err;
+DROP TABLE IF EXISTS db_mapping;
+DROP TABLE IF EXISTS db_instance;
+DROP TABLE IF EXISTS worker_metric;
+DROP TABLE IF EXISTS controller_status;
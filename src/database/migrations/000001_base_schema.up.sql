@@ -0,0 +1,63 @@
+-- Tables the controller, the workers and the migration workers share, as they were before the controller managed its own schema.
+-- Databases that got them from the migrations submodule already have all of them, so every statement is a no-op there.
+CREATE TABLE IF NOT EXISTS controller_status
+(
+    scaling        BOOLEAN NOT NULL,
+    last_heartbeat TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS worker_metric
+(
+    id             UUID PRIMARY KEY,
+    last_heartbeat TIMESTAMPTZ,
+    uptime         INTERVAL
+);
+
+CREATE TABLE IF NOT EXISTS db_instance
+(
+    url              TEXT PRIMARY KEY,
+    occupied_space   BIGINT,
+    max_space        BIGINT NOT NULL,
+    collection_count BIGINT,
+    last_queried     TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS db_mapping
+(
+    id     UUID PRIMARY KEY,
+    url    TEXT   NOT NULL,
+    "from" TEXT   NOT NULL,
+    size   BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS db_conn_err
+(
+    worker_id UUID,
+    db_url    TEXT,
+    fail_time TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS migration_worker
+(
+    id              UUID PRIMARY KEY,
+    last_heartbeat  TIMESTAMPTZ,
+    uptime          INTERVAL,
+    working_on_from TEXT,
+    working_on_to   TEXT
+);
+
+CREATE TABLE IF NOT EXISTS db_migration
+(
+    id          UUID PRIMARY KEY,
+    url         TEXT NOT NULL,
+    m_worker_id UUID NOT NULL,
+    "from"      TEXT NOT NULL,
+    "to"        TEXT NOT NULL,
+    status      TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS migration_worker_jobs
+(
+    worker_id    UUID,
+    migration_id UUID
+);
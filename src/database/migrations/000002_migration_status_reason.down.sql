@@ -0,0 +1,2 @@
+ALTER TABLE db_migration
+    DROP COLUMN IF EXISTS status_reason;
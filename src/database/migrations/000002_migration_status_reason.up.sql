@@ -0,0 +1,3 @@
+-- Records why the controller resumed, reassigned or failed a migration job
+ALTER TABLE db_migration
+    ADD COLUMN IF NOT EXISTS status_reason TEXT;
@@ -0,0 +1,3 @@
+ALTER TABLE db_instance
+    DROP COLUMN IF EXISTS unhealthy_reason,
+    DROP COLUMN IF EXISTS unhealthy_since;
@@ -0,0 +1,5 @@
+-- Databases with a high failure rate across workers are marked unhealthy by the controller
+-- and excluded from placement until the failure rate recovers
+ALTER TABLE db_instance
+    ADD COLUMN IF NOT EXISTS unhealthy_since  TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS unhealthy_reason TEXT;
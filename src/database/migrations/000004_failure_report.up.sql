@@ -0,0 +1,10 @@
+-- History of the aggregated reports computed by CheckFailureRate, pruned after the configured retention
+CREATE TABLE IF NOT EXISTS failure_report
+(
+    id            UUID PRIMARY KEY,
+    generated_at  TIMESTAMPTZ NOT NULL,
+    flagged_count INTEGER     NOT NULL,
+    report        JSONB       NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS failure_report_generated_at_idx ON failure_report (generated_at);
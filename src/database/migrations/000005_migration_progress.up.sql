@@ -0,0 +1,3 @@
+-- Counter that migration workers increase while copying a range, so the controller can detect stuck jobs
+ALTER TABLE db_migration
+    ADD COLUMN IF NOT EXISTS progress BIGINT NOT NULL DEFAULT 0;
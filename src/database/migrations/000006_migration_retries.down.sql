@@ -0,0 +1,8 @@
+DELETE
+FROM db_migration
+WHERE m_worker_id IS NULL;
+
+ALTER TABLE db_migration
+    DROP COLUMN IF EXISTS next_attempt_at,
+    DROP COLUMN IF EXISTS attempts,
+    ALTER COLUMN m_worker_id SET NOT NULL;
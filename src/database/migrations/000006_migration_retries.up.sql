@@ -0,0 +1,6 @@
+-- Migration jobs of dead or stuck workers are requeued instead of deleted. A queued job has no migration worker
+-- and is dispatched again once next_attempt_at has passed, until it runs out of attempts and is failed.
+ALTER TABLE db_migration
+    ALTER COLUMN m_worker_id DROP NOT NULL,
+    ADD COLUMN IF NOT EXISTS attempts        INTEGER NOT NULL DEFAULT 1,
+    ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMPTZ;
@@ -0,0 +1,11 @@
+-- Latest result of the controller connecting to every database instance directly,
+-- independent of the connection errors reported by workers
+CREATE TABLE IF NOT EXISTS db_probe
+(
+    url                  TEXT PRIMARY KEY,
+    reachable            BOOLEAN     NOT NULL,
+    latency_ms           DOUBLE PRECISION,
+    error                TEXT,
+    probed_at            TIMESTAMPTZ NOT NULL,
+    consecutive_failures INTEGER     NOT NULL DEFAULT 0
+);
@@ -0,0 +1,16 @@
+-- Journal of every action the controller takes on workers, migration workers, migrations, mappings and databases
+CREATE TABLE IF NOT EXISTS audit_log
+(
+    id            BIGSERIAL PRIMARY KEY,
+    occurred_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    actor         TEXT        NOT NULL,
+    action        TEXT        NOT NULL,
+    subject       TEXT        NOT NULL,
+    controller_id TEXT        NOT NULL,
+    trace_id      TEXT,
+    reason        TEXT,
+    before        JSONB,
+    after         JSONB
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_subject_idx ON audit_log (subject);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS db_migration_queued;
+DROP INDEX IF EXISTS db_migration_one_active_job_per_worker;
@@ -0,0 +1,11 @@
+-- A migration worker works on at most one job at a time. Jobs are claimed with SELECT ... FOR UPDATE SKIP LOCKED,
+-- this index is the last line of defense if two claims ever get past each other.
+-- Workers that already have more than one active job have to be cleaned up before this migration can run.
+CREATE UNIQUE INDEX IF NOT EXISTS db_migration_one_active_job_per_worker
+    ON db_migration (m_worker_id)
+    WHERE status IN ('waiting', 'running');
+
+-- Queued jobs are polled by next_attempt_at.
+CREATE INDEX IF NOT EXISTS db_migration_queued
+    ON db_migration (next_attempt_at)
+    WHERE status = 'queued';
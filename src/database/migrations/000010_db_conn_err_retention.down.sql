@@ -0,0 +1 @@
+DROP INDEX IF EXISTS db_conn_err_fail_time;
@@ -0,0 +1,3 @@
+-- Connection errors are aggregated and purged by fail_time, without an index both scan the whole table.
+CREATE INDEX IF NOT EXISTS db_conn_err_fail_time
+    ON db_conn_err (fail_time);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS controller_status_singleton;
+
+ALTER TABLE controller_status
+    DROP COLUMN IF EXISTS controller_id;
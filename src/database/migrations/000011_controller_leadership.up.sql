@@ -0,0 +1,17 @@
+-- The controller that owns the heartbeat row. Leadership is taken over with a conditional UPDATE on it,
+-- so of several shadows that see the same stale heartbeat only one can win, and an old leader notices it was replaced.
+ALTER TABLE controller_status
+    ADD COLUMN IF NOT EXISTS controller_id text;
+
+-- There is at most one controller row, which makes the first registration an INSERT ... ON CONFLICT DO NOTHING.
+-- Leftover rows from before the heartbeat was updated in place are dropped, except for the newest one. A row without
+-- a heartbeat sorts last, so it never survives in place of the row of a live leader.
+DELETE
+FROM controller_status
+WHERE ctid NOT IN (SELECT ctid
+                   FROM controller_status
+                   ORDER BY last_heartbeat DESC NULLS LAST
+                   LIMIT 1);
+
+CREATE UNIQUE INDEX IF NOT EXISTS controller_status_singleton
+    ON controller_status ((true));
@@ -15,9 +15,12 @@ import (
 // The Reader struct provides methods to read data from the database.
 // It uses a pgxpool.Pool for database connections and a zap.Logger for logging.
 // All methods are similar to another and the names are self-explanatory.
+// Reads that tolerate stale data, like state dumps and failure analysis, go to the Replicas if there are any,
+// everything that decisions depend on, like leader checks and the clock, stays on the primary Pool.
 type Reader struct {
-	Pool   *pgxpool.Pool
-	Logger *zap.Logger
+	Pool     *pgxpool.Pool
+	Replicas *ReplicaRouter
+	Logger   *zap.Logger
 }
 
 func (r *Reader) Ping(ctx context.Context) error {
@@ -200,51 +203,41 @@ func (r *Reader) GetDBCount(ctx context.Context) (int, error) {
 // Returns a slice of errors and logs the operation. Returns an error if the operation fails.
 func (r *Reader) GetDBConnErrors(ctx context.Context) ([]sqlc.DbConnErr, error) {
 
-	tx, err := r.Pool.BeginTx(ctx, pgx.TxOptions{})
-	if err != nil {
-		return nil, fmt.Errorf("beginning transaction failed: %w", err)
-	}
-
-	defer tx.Rollback(ctx)
-
-	q := sqlc.New(tx)
-	connectionErrors, err := q.GetAllDbConnErrors(ctx)
+	connectionErrors, err := readReplica(ctx, r, func(q *sqlc.Queries) ([]sqlc.DbConnErr, error) {
+		connectionErrors, queryErr := q.GetAllDbConnErrors(ctx)
+		if queryErr != nil {
+			return nil, fmt.Errorf("getting db_conn_errors failed: %w", queryErr)
+		}
+		return connectionErrors, nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("getting db_conn_errors failed: %w", err)
-	}
-
-	commitErr := tx.Commit(ctx)
-	if commitErr != nil {
-		return nil, fmt.Errorf("committing transaction failed: %w", commitErr)
+		return nil, err
 	}
 
 	r.Logger.Debug("successfully got db conn errors")
 	return connectionErrors, nil
 }
 
-// GetFreeMigrationWorker fetches a UUID for a free migration worker
-// Returns the worker UUID and an error if the operation fails.
-func (r *Reader) GetFreeMigrationWorker(ctx context.Context) (pgtype.UUID, error) {
-	tx, err := r.Pool.BeginTx(ctx, pgx.TxOptions{})
+// GetDBConnErrorBuckets counts the database connection errors since the given time per worker, database and time bucket.
+// Buckets start at multiples of bucket since the unix epoch.
+func (r *Reader) GetDBConnErrorBuckets(ctx context.Context, since time.Time, bucket time.Duration) ([]sqlc.GetDBConnErrorBucketsRow, error) {
+
+	buckets, err := readReplica(ctx, r, func(q *sqlc.Queries) ([]sqlc.GetDBConnErrorBucketsRow, error) {
+		buckets, queryErr := q.GetDBConnErrorBuckets(ctx, sqlc.GetDBConnErrorBucketsParams{
+			BucketSeconds: bucket.Seconds(),
+			Since:         pgtype.Timestamptz{Time: since, Valid: true},
+		})
+		if queryErr != nil {
+			return nil, fmt.Errorf("getting db conn error buckets failed: %w", queryErr)
+		}
+		return buckets, nil
+	})
 	if err != nil {
-		return pgtype.UUID{}, fmt.Errorf("beginning transaction failed: %w", err)
+		return nil, err
 	}
 
-	defer tx.Rollback(ctx)
-
-	q := sqlc.New(tx)
-	workerUUID, queryErr := q.GetFreeMigrationWorker(ctx)
-	if queryErr != nil {
-		return pgtype.UUID{}, fmt.Errorf("getting available migration worker failed: %w", queryErr)
-	}
-
-	commitErr := tx.Commit(ctx)
-	if commitErr != nil {
-		return pgtype.UUID{}, fmt.Errorf("committing transaction failed: %w", commitErr)
-	}
-
-	r.Logger.Debug("successfully got available worker", zap.String("workerID", workerUUID.String()))
-	return workerUUID, nil
+	r.Logger.Debug("successfully got db conn error buckets", zap.Int("count", len(buckets)))
+	return buckets, nil
 }
 
 // GetAllDbInstanceInfo retrieves information about all database instances
@@ -328,3 +321,195 @@ func (r *Reader) GetDBMappingInfoByUrlFrom(ctx context.Context, url, from string
 	return mapping, nil
 
 }
+
+// GetActiveMigrationJobs retrieves all migration jobs that are assigned to a migration worker and have not reached a terminal state yet
+func (r *Reader) GetActiveMigrationJobs(ctx context.Context) ([]sqlc.DbMigration, error) {
+
+	tx, err := r.Pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction failed: %w", err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	q := sqlc.New(tx)
+	jobs, queryErr := q.GetActiveMigrationJobs(ctx)
+	if queryErr != nil {
+		return nil, fmt.Errorf("getting active migration jobs failed: %w", queryErr)
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return nil, fmt.Errorf("committing transaction failed: %w", commitErr)
+	}
+
+	r.Logger.Debug("successfully got active migration jobs", zap.Int("count", len(jobs)))
+	return jobs, nil
+}
+
+// GetSingleMWorkerState retrieves the state of a single migration worker identified by workerID
+func (r *Reader) GetSingleMWorkerState(ctx context.Context, workerID string) (sqlc.MigrationWorker, error) {
+
+	tx, err := r.Pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return sqlc.MigrationWorker{}, fmt.Errorf("beginning transaction failed: %w", err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	parsed, err := guuid.Parse(workerID)
+	if err != nil {
+		return sqlc.MigrationWorker{}, fmt.Errorf("could not parse uuid")
+	}
+
+	q := sqlc.New(tx)
+	worker, err := q.GetSingleMWorkerState(ctx, pgtype.UUID{
+		Bytes: parsed,
+		Valid: true,
+	})
+	if err != nil {
+		return sqlc.MigrationWorker{}, fmt.Errorf("getting single migration worker state failed: %w", err)
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return sqlc.MigrationWorker{}, fmt.Errorf("committing transaction failed: %w", commitErr)
+	}
+
+	r.Logger.Debug("successfully got migration worker state", zap.String("workerID", workerID))
+	return worker, nil
+}
+
+// GetDatabaseTime retrieves the current time of the database clock
+func (r *Reader) GetDatabaseTime(ctx context.Context) (time.Time, error) {
+
+	tx, err := r.Pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("beginning transaction failed: %w", err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	q := sqlc.New(tx)
+	now, queryErr := q.GetDatabaseTime(ctx)
+	if queryErr != nil {
+		return time.Time{}, fmt.Errorf("getting database time failed: %w", queryErr)
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return time.Time{}, fmt.Errorf("committing transaction failed: %w", commitErr)
+	}
+
+	r.Logger.Debug("successfully got database time", zap.Time("now", now.Time))
+	return now.Time, nil
+}
+
+// GetFailureReportsSince retrieves all persisted failure reports generated at or after the given time, oldest first
+func (r *Reader) GetFailureReportsSince(ctx context.Context, since time.Time) ([]sqlc.FailureReport, error) {
+
+	reports, err := readReplica(ctx, r, func(q *sqlc.Queries) ([]sqlc.FailureReport, error) {
+		reports, queryErr := q.GetFailureReportsSince(ctx, pgtype.Timestamptz{Time: since, Valid: true})
+		if queryErr != nil {
+			return nil, fmt.Errorf("getting failure reports failed: %w", queryErr)
+		}
+		return reports, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	r.Logger.Debug("successfully got failure reports", zap.Int("count", len(reports)))
+	return reports, nil
+}
+
+// GetDueMigrationJobs retrieves all queued migration jobs whose next attempt is due, the longest overdue first
+func (r *Reader) GetDueMigrationJobs(ctx context.Context) ([]sqlc.DbMigration, error) {
+
+	tx, err := r.Pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction failed: %w", err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	q := sqlc.New(tx)
+	jobs, queryErr := q.GetDueMigrationJobs(ctx)
+	if queryErr != nil {
+		return nil, fmt.Errorf("getting due migration jobs failed: %w", queryErr)
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return nil, fmt.Errorf("committing transaction failed: %w", commitErr)
+	}
+
+	r.Logger.Debug("successfully got due migration jobs", zap.Int("count", len(jobs)))
+	return jobs, nil
+}
+
+// GetAllMigrationJobs retrieves all migration jobs, including terminal ones
+func (r *Reader) GetAllMigrationJobs(ctx context.Context) ([]sqlc.DbMigration, error) {
+
+	jobs, err := readReplica(ctx, r, func(q *sqlc.Queries) ([]sqlc.DbMigration, error) {
+		jobs, queryErr := q.GetAllMigrationJobs(ctx)
+		if queryErr != nil {
+			return nil, fmt.Errorf("getting all migration jobs failed: %w", queryErr)
+		}
+		return jobs, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	r.Logger.Debug("successfully got all migration jobs", zap.Int("count", len(jobs)))
+	return jobs, nil
+}
+
+// GetAllDbProbes retrieves the latest probe result of every database instance
+func (r *Reader) GetAllDbProbes(ctx context.Context) ([]sqlc.DbProbe, error) {
+
+	tx, err := r.Pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction failed: %w", err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	q := sqlc.New(tx)
+	probes, queryErr := q.GetAllDbProbes(ctx)
+	if queryErr != nil {
+		return nil, fmt.Errorf("getting database probes failed: %w", queryErr)
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return nil, fmt.Errorf("committing transaction failed: %w", commitErr)
+	}
+
+	r.Logger.Debug("successfully got database probes", zap.Int("count", len(probes)))
+	return probes, nil
+}
+
+// GetAuditEntries retrieves one page of the audit log, newest first, starting below the entry with the id beforeId.
+// If subject is not empty, only entries about that subject are returned.
+func (r *Reader) GetAuditEntries(ctx context.Context, beforeId int64, subject string, pageSize int32) ([]sqlc.AuditLog, error) {
+
+	entries, err := readReplica(ctx, r, func(q *sqlc.Queries) ([]sqlc.AuditLog, error) {
+		entries, queryErr := q.GetAuditEntries(ctx, sqlc.GetAuditEntriesParams{
+			BeforeID: beforeId,
+			Subject:  pgtype.Text{String: subject, Valid: subject != ""},
+			PageSize: pageSize,
+		})
+		if queryErr != nil {
+			return nil, fmt.Errorf("getting audit entries failed: %w", queryErr)
+		}
+		return entries, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	r.Logger.Debug("successfully got audit entries", zap.Int("count", len(entries)))
+	return entries, nil
+}
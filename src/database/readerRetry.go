@@ -4,296 +4,220 @@ import (
 	"context"
 	sqlc "controller/src/database/sqlc"
 	"controller/src/utils"
-	"github.com/jackc/pgx/v5/pgtype"
-	goutils "github.com/linusgith/goutils/pkg/env_utils"
 	"go.uber.org/zap"
 	"time"
 )
 
-// ReaderPerfectionist is a wrapper around Reader that implements retry logic with backoff strategies
-// for various database operations. It retries operations up to a maximum number of times
-// with an initial backoff duration that can be configured. The backoff strategy can be either
-// exponential or linear, also configurable via environment variables.
+// ReaderPerfectionist is a wrapper around Reader that retries every read through the retry engine in utils,
+// guarded by the circuit breaker it shares with the WriterPerfectionist.
+// All operations share one retry policy, configured via environment variables, which can be overridden per operation.
 // It is designed to handle transient errors gracefully, allowing the application to recover
 // from temporary issues without crashing or losing data.
 type ReaderPerfectionist struct {
-	reader         *Reader
-	maxRetries     int
-	initialBackoff time.Duration
-	backoffType    string
+	reader    *Reader
+	breaker   *CircuitBreaker
+	policy    utils.RetryPolicy
+	overrides map[string]utils.RetryPolicy
 }
 
-func NewReaderPerfectionist(reader *Reader) *ReaderPerfectionist {
-
-	//15 ms in exp backoff gives us [15,225, 3375] ms as backoff intervals
-
-	initBackoff := goutils.Log().ParseEnvDurationDefault("INIT_RETRY_BACKOFF", 15*time.Millisecond, reader.Logger)
-
-	maxRetries := goutils.Log().ParseEnvIntDefault("MAX_RETRIES", 3, reader.Logger)
-
-	defaultBackoffStrategy := "exp"
+// DefaultRetryPolicy is used by both perfectionists unless the environment says otherwise.
+// 15 ms with exponential backoff gives us [15, 30] ms as waits between three attempts.
+var DefaultRetryPolicy = utils.RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 15 * time.Millisecond,
+	MaxBackoff:     time.Second,
+	Strategy:       utils.BackoffExponential,
+}
 
-	backoffTypeInput := goutils.Log().ParseEnvStringDefault("BACKOFF_TYPE", defaultBackoffStrategy, reader.Logger)
+func NewReaderPerfectionist(reader *Reader, breaker *CircuitBreaker) *ReaderPerfectionist {
 
-	var backoffType string
+	policy := utils.RetryPolicyFromEnv("", DefaultRetryPolicy, reader.Logger)
 
-	switch backoffTypeInput {
-	case "exp":
-		backoffType = "exponential"
-	case "lin":
-		backoffType = "linear"
-	default:
-		reader.Logger.Warn("invalid backoff strategy provided, setting default", zap.String("provided", backoffTypeInput))
-		backoffType = defaultBackoffStrategy
+	//a missing row does not appear by asking again, neither does a canceled caller
+	policy.Retryable = func(err error) bool {
+		return utils.ClassifyDbError(err).Reconcilable
 	}
 
 	return &ReaderPerfectionist{
-		reader:         reader,
-		maxRetries:     maxRetries,
-		initialBackoff: initBackoff,
-		backoffType:    backoffType,
+		reader:    reader,
+		breaker:   breaker,
+		policy:    policy,
+		overrides: make(map[string]utils.RetryPolicy),
 	}
 }
 
-func (r *ReaderPerfectionist) Ping(ctx context.Context) error {
-
-	var err error
+// OverridePolicy sets the retry policy of a single operation, named like the method of the ReaderPerfectionist.
+// It is not safe for concurrent use and has to be called during setup.
+func (r *ReaderPerfectionist) OverridePolicy(operation string, policy utils.RetryPolicy) {
+	if policy.Retryable == nil {
+		policy.Retryable = r.policy.Retryable
+	}
 
-	for i := 1; i <= r.maxRetries; i++ {
-		err := r.reader.Ping(ctx)
-		if err == nil {
-			return nil
-		}
+	r.reader.Logger.Debug("overriding retry policy", zap.String("operation", operation), zap.Int("maxAttempts", policy.MaxAttempts), zap.String("strategy", string(policy.Strategy)))
+	r.overrides[operation] = policy
+}
 
-		if i < r.maxRetries {
-			r.reader.Logger.Warn("pinging database failed; retrying...", zap.Int("try", i), zap.Error(err))
+// read runs a single read of the reader with the policy of the operation, every attempt has to pass the circuit breaker
+func read[T any](ctx context.Context, r *ReaderPerfectionist, operation string, fn func(ctx context.Context) (T, error)) (T, error) {
 
-			utils.CalculateAndExecuteBackoff(i, r.initialBackoff)
-		}
+	policy, ok := r.overrides[operation]
+	if !ok {
+		policy = r.policy
 	}
 
-	r.reader.Logger.Error("pinging database failed, retry limit reached", zap.Error(err))
-	return err
+	retryable := policy.Retryable
+	policy.Retryable = breakerRetryable(retryable)
 
+	return utils.Retry(ctx, r.reader.Logger, operation, policy, guard(r.breaker, retryable, fn))
 }
 
-// GetControllerState retrieves the current state of the controller.
-func (r *ReaderPerfectionist) GetControllerState(ctx context.Context) (sqlc.ControllerStatus, error) {
-
-	var err error
+// Snapshot runs fn in a single snapshot transaction. A failed attempt runs fn again from the start,
+// so fn must not have side effects beyond the values it reads.
+func (r *ReaderPerfectionist) Snapshot(ctx context.Context, operation string, fn func(s SnapshotReader) error) error {
+	_, err := read(ctx, r, operation, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, r.reader.Snapshot(ctx, func(s *Snapshot) error { return fn(s) })
+	})
 
-	for i := 1; i <= r.maxRetries; i++ {
-		state, err := r.reader.GetControllerState(ctx)
-		if err == nil {
-			return state, nil
-		}
+	return err
+}
 
-		if i < r.maxRetries {
-			r.reader.Logger.Warn("getting controller state failed; retrying...", zap.Int("try", i), zap.Error(err))
+// StaleSnapshot is Snapshot on a read replica, see Reader.StaleSnapshot
+func (r *ReaderPerfectionist) StaleSnapshot(ctx context.Context, operation string, fn func(s SnapshotReader) error) (ReadOrigin, error) {
+	return read(ctx, r, operation, func(ctx context.Context) (ReadOrigin, error) {
+		return r.reader.StaleSnapshot(ctx, func(s *Snapshot) error { return fn(s) })
+	})
+}
 
-			utils.CalculateAndExecuteBackoff(i, r.initialBackoff)
-		}
-	}
+func (r *ReaderPerfectionist) Ping(ctx context.Context) error {
+	_, err := read(ctx, r, "Ping", func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, r.reader.Ping(ctx)
+	})
 
-	r.reader.Logger.Error("getting controller state failed, retry limit reached", zap.Error(err))
-	return sqlc.ControllerStatus{}, err
+	return err
+}
 
+// GetControllerState retrieves the current state of the controller.
+func (r *ReaderPerfectionist) GetControllerState(ctx context.Context) (sqlc.ControllerStatus, error) {
+	return read(ctx, r, "GetControllerState", func(ctx context.Context) (sqlc.ControllerStatus, error) {
+		return r.reader.GetControllerState(ctx)
+	})
 }
 
 // GetAllWorkerState retrieves the state of all workers.
 func (r *ReaderPerfectionist) GetAllWorkerState(ctx context.Context) ([]sqlc.WorkerMetric, error) {
-
-	var err error
-
-	for i := 1; i <= r.maxRetries; i++ {
-		state, err := r.reader.GetAllWorkerState(ctx)
-		if err == nil {
-			return state, nil
-		}
-
-		if i < r.maxRetries {
-			r.reader.Logger.Warn("getting all worker states failed; retrying...", zap.Int("try", i), zap.Error(err))
-
-			utils.CalculateAndExecuteBackoff(i, r.initialBackoff)
-		}
-	}
-
-	r.reader.Logger.Error("getting all worker states failed, retry limit reached", zap.Error(err))
-	return nil, err
+	return read(ctx, r, "GetAllWorkerState", func(ctx context.Context) ([]sqlc.WorkerMetric, error) {
+		return r.reader.GetAllWorkerState(ctx)
+	})
 }
 
 // GetAllMWorkerState retrieves the state of all migration workers.
 func (r *ReaderPerfectionist) GetAllMWorkerState(ctx context.Context) ([]sqlc.MigrationWorker, error) {
-
-	var err error
-
-	for i := 1; i <= r.maxRetries; i++ {
-		state, err := r.reader.GetAllMWorkerState(ctx)
-		if err == nil {
-			return state, nil
-		}
-
-		if i < r.maxRetries {
-			r.reader.Logger.Warn("getting all worker states failed; retrying...", zap.Int("try", i), zap.Error(err))
-
-			utils.CalculateAndExecuteBackoff(i, r.initialBackoff)
-		}
-	}
-
-	r.reader.Logger.Error("getting all worker states failed, retry limit reached", zap.Error(err))
-	return nil, err
+	return read(ctx, r, "GetAllMWorkerState", func(ctx context.Context) ([]sqlc.MigrationWorker, error) {
+		return r.reader.GetAllMWorkerState(ctx)
+	})
 }
 
 // GetSingleWorkerState retrieves the state of a single worker identified by workerID
 func (r *ReaderPerfectionist) GetSingleWorkerState(ctx context.Context, workerID string) (sqlc.WorkerMetric, error) {
-
-	var err error
-
-	for i := 1; i <= r.maxRetries; i++ {
-		state, err := r.reader.GetSingleWorkerState(ctx, workerID)
-		if err == nil {
-			return state, nil
-		}
-
-		if i < r.maxRetries {
-			r.reader.Logger.Warn("getting single worker state failed; retrying...", zap.Int("try", i), zap.Error(err))
-
-			utils.CalculateAndExecuteBackoff(i, r.initialBackoff)
-		}
-	}
-
-	r.reader.Logger.Error("getting single worker state failed, retry limit reached", zap.String("workerID", workerID), zap.Error(err))
-	return sqlc.WorkerMetric{}, err
+	return read(ctx, r, "GetSingleWorkerState", func(ctx context.Context) (sqlc.WorkerMetric, error) {
+		return r.reader.GetSingleWorkerState(ctx, workerID)
+	})
 }
 
 // GetDBCount retrieves the count of databases in the system.
 func (r *ReaderPerfectionist) GetDBCount(ctx context.Context) (int, error) {
-	var err error
-
-	for i := 1; i <= r.maxRetries; i++ {
-		count, err := r.reader.GetDBCount(ctx)
-		if err == nil {
-			return count, nil
-		}
-
-		if i < r.maxRetries {
-			r.reader.Logger.Warn("getting db count failed; retrying...", zap.Int("try", i), zap.Error(err))
-
-			utils.CalculateAndExecuteBackoff(i, r.initialBackoff)
-		}
-	}
-
-	r.reader.Logger.Error("getting db count failed, retry limit reached", zap.Error(err))
-	return 0, err
+	return read(ctx, r, "GetDBCount", func(ctx context.Context) (int, error) {
+		return r.reader.GetDBCount(ctx)
+	})
 }
 
 // GetDBConnErrors retrieves the database connection errors.
 func (r *ReaderPerfectionist) GetDBConnErrors(ctx context.Context) ([]sqlc.DbConnErr, error) {
-	var err error
-
-	for i := 1; i <= r.maxRetries; i++ {
-		connErrors, err := r.reader.GetDBConnErrors(ctx)
-		if err == nil {
-			return connErrors, nil
-		}
-
-		if i < r.maxRetries {
-			r.reader.Logger.Warn("getting db connection errors failed; retrying...", zap.Int("try", i), zap.Error(err))
-
-			utils.CalculateAndExecuteBackoff(i, r.initialBackoff)
-		}
-	}
-
-	r.reader.Logger.Error("getting db connection errors failed, retry limit reached", zap.Error(err))
-	return nil, err
+	return read(ctx, r, "GetDBConnErrors", func(ctx context.Context) ([]sqlc.DbConnErr, error) {
+		return r.reader.GetDBConnErrors(ctx)
+	})
 }
 
-// GetFreeMigrationWorker retrieves a free migration worker from the database.
-func (r *ReaderPerfectionist) GetFreeMigrationWorker(ctx context.Context) (pgtype.UUID, error) {
-	var err error
-
-	for i := 1; i <= r.maxRetries; i++ {
-		workerUUID, err := r.reader.GetFreeMigrationWorker(ctx)
-		if err == nil {
-			return workerUUID, nil
-		}
-
-		if i < r.maxRetries {
-			r.reader.Logger.Warn("getting available migration worker failed; retrying...", zap.Int("try", i), zap.Error(err))
-
-			utils.CalculateAndExecuteBackoff(i, r.initialBackoff)
-		}
-	}
-
-	r.reader.Logger.Error("getting available migration worker failed, retry limit reached", zap.Error(err))
-	return pgtype.UUID{}, err
+// GetDBConnErrorBuckets retrieves the database connection errors since the given time, counted per worker, database and time bucket.
+func (r *ReaderPerfectionist) GetDBConnErrorBuckets(ctx context.Context, since time.Time, bucket time.Duration) ([]sqlc.GetDBConnErrorBucketsRow, error) {
+	return read(ctx, r, "GetDBConnErrorBuckets", func(ctx context.Context) ([]sqlc.GetDBConnErrorBucketsRow, error) {
+		return r.reader.GetDBConnErrorBuckets(ctx, since, bucket)
+	})
 }
 
 // GetAllDbInstanceInfo retrieves information about all database instances.
 func (r *ReaderPerfectionist) GetAllDbInstanceInfo(ctx context.Context) ([]sqlc.DbInstance, error) {
-
-	var err error
-
-	for i := 1; i <= r.maxRetries; i++ {
-		dbInstances, err := r.reader.GetAllDbInstanceInfo(ctx)
-		if err == nil {
-			return dbInstances, nil
-		}
-
-		if i < r.maxRetries {
-			r.reader.Logger.Warn("getting info on all db instances failed; retrying...", zap.Int("try", i), zap.Error(err))
-
-			utils.CalculateAndExecuteBackoff(i, r.initialBackoff)
-		}
-	}
-
-	r.reader.Logger.Error("getting info on all db instances failed, retry limit reached", zap.Error(err))
-	return nil, err
-
+	return read(ctx, r, "GetAllDbInstanceInfo", func(ctx context.Context) ([]sqlc.DbInstance, error) {
+		return r.reader.GetAllDbInstanceInfo(ctx)
+	})
 }
 
 // GetAllDbMappingInfo retrieves information about all database mappings.
 func (r *ReaderPerfectionist) GetAllDbMappingInfo(ctx context.Context) ([]sqlc.DbMapping, error) {
-
-	var err error
-
-	for i := 1; i <= r.maxRetries; i++ {
-		dbInstances, err := r.reader.GetAllDbMappingInfo(ctx)
-		if err == nil {
-			return dbInstances, nil
-		}
-
-		if i < r.maxRetries {
-			r.reader.Logger.Warn("getting all db mappings failed; retrying...", zap.Int("try", i), zap.Error(err))
-
-			utils.CalculateAndExecuteBackoff(i, r.initialBackoff)
-		}
-	}
-
-	r.reader.Logger.Error("getting db mappings failed, retry limit reached", zap.Error(err))
-	return nil, err
-
+	return read(ctx, r, "GetAllDbMappingInfo", func(ctx context.Context) ([]sqlc.DbMapping, error) {
+		return r.reader.GetAllDbMappingInfo(ctx)
+	})
 }
 
 // GetDBMappingInfoByUrlFrom retrieves the database mapping information for a specific URL and from a given source.
 func (r *ReaderPerfectionist) GetDBMappingInfoByUrlFrom(ctx context.Context, url, from string) (sqlc.DbMapping, error) {
+	return read(ctx, r, "GetDBMappingInfoByUrlFrom", func(ctx context.Context) (sqlc.DbMapping, error) {
+		return r.reader.GetDBMappingInfoByUrlFrom(ctx, url, from)
+	})
+}
 
-	var err error
+// GetActiveMigrationJobs retrieves all migration jobs that are assigned to a worker and not done or failed.
+func (r *ReaderPerfectionist) GetActiveMigrationJobs(ctx context.Context) ([]sqlc.DbMigration, error) {
+	return read(ctx, r, "GetActiveMigrationJobs", func(ctx context.Context) ([]sqlc.DbMigration, error) {
+		return r.reader.GetActiveMigrationJobs(ctx)
+	})
+}
 
-	for i := 1; i <= r.maxRetries; i++ {
-		mapping, err := r.reader.GetDBMappingInfoByUrlFrom(ctx, url, from)
-		if err == nil {
-			return mapping, nil
-		}
+// GetSingleMWorkerState retrieves the state of a single migration worker identified by workerID
+func (r *ReaderPerfectionist) GetSingleMWorkerState(ctx context.Context, workerID string) (sqlc.MigrationWorker, error) {
+	return read(ctx, r, "GetSingleMWorkerState", func(ctx context.Context) (sqlc.MigrationWorker, error) {
+		return r.reader.GetSingleMWorkerState(ctx, workerID)
+	})
+}
 
-		if i < r.maxRetries {
-			r.reader.Logger.Warn("getting all db mappings failed; retrying...", zap.Int("try", i), zap.Error(err))
+// GetDatabaseTime retrieves the current time of the database clock.
+func (r *ReaderPerfectionist) GetDatabaseTime(ctx context.Context) (time.Time, error) {
+	return read(ctx, r, "GetDatabaseTime", func(ctx context.Context) (time.Time, error) {
+		return r.reader.GetDatabaseTime(ctx)
+	})
+}
 
-			utils.CalculateAndExecuteBackoff(i, r.initialBackoff)
-		}
-	}
+// GetFailureReportsSince retrieves the failure report history with retries and backoff.
+func (r *ReaderPerfectionist) GetFailureReportsSince(ctx context.Context, since time.Time) ([]sqlc.FailureReport, error) {
+	return read(ctx, r, "GetFailureReportsSince", func(ctx context.Context) ([]sqlc.FailureReport, error) {
+		return r.reader.GetFailureReportsSince(ctx, since)
+	})
+}
 
-	r.reader.Logger.Error("getting db mappings failed, retry limit reached", zap.Error(err))
-	return sqlc.DbMapping{}, err
+// GetDueMigrationJobs retrieves all queued migration jobs whose next attempt is due with retries and backoff.
+func (r *ReaderPerfectionist) GetDueMigrationJobs(ctx context.Context) ([]sqlc.DbMigration, error) {
+	return read(ctx, r, "GetDueMigrationJobs", func(ctx context.Context) ([]sqlc.DbMigration, error) {
+		return r.reader.GetDueMigrationJobs(ctx)
+	})
+}
+
+// GetAllMigrationJobs retrieves all migration jobs with retries and backoff.
+func (r *ReaderPerfectionist) GetAllMigrationJobs(ctx context.Context) ([]sqlc.DbMigration, error) {
+	return read(ctx, r, "GetAllMigrationJobs", func(ctx context.Context) ([]sqlc.DbMigration, error) {
+		return r.reader.GetAllMigrationJobs(ctx)
+	})
+}
+
+// GetAllDbProbes retrieves the latest database probe results with retries and backoff.
+func (r *ReaderPerfectionist) GetAllDbProbes(ctx context.Context) ([]sqlc.DbProbe, error) {
+	return read(ctx, r, "GetAllDbProbes", func(ctx context.Context) ([]sqlc.DbProbe, error) {
+		return r.reader.GetAllDbProbes(ctx)
+	})
+}
 
+// GetAuditEntries retrieves one page of the audit log with retries and backoff.
+func (r *ReaderPerfectionist) GetAuditEntries(ctx context.Context, beforeId int64, subject string, pageSize int32) ([]sqlc.AuditLog, error) {
+	return read(ctx, r, "GetAuditEntries", func(ctx context.Context) ([]sqlc.AuditLog, error) {
+		return r.reader.GetAuditEntries(ctx, beforeId, subject, pageSize)
+	})
 }
@@ -0,0 +1,237 @@
+package database
+
+import (
+	"context"
+	sqlc "controller/src/database/sqlc"
+	oe "controller/src/errors"
+	"controller/src/utils"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ReplicaRouter spreads the reads that tolerate stale data over the read replicas.
+// A replica only takes reads while its last lag check succeeded and its replay lag was within maxLag,
+// until then and while no replica qualifies, the reads go to the primary. Replicas start out of rotation until their first check.
+type ReplicaRouter struct {
+	logger *zap.Logger
+	maxLag time.Duration
+
+	mu       sync.Mutex
+	replicas []*replica
+	next     int
+}
+
+type replica struct {
+	pool   *pgxpool.Pool
+	status ReplicaStatus
+}
+
+// ReadOrigin tells which server answered a read. Replica is empty if it was the primary,
+// otherwise Lag is the replay lag the replica had on its last check.
+type ReadOrigin struct {
+	Replica string
+	Lag     time.Duration
+}
+
+// ReplicaStatus is a snapshot of a single replica for /health and /metrics
+type ReplicaStatus struct {
+	Name      string
+	InUse     bool
+	Lag       time.Duration
+	CheckedAt time.Time
+	LastError string
+}
+
+func NewReplicaRouter(logger *zap.Logger, pools []*pgxpool.Pool, maxLag time.Duration) *ReplicaRouter {
+
+	replicas := make([]*replica, 0, len(pools))
+	for _, pool := range pools {
+		config := pool.Config().ConnConfig
+		replicas = append(replicas, &replica{
+			pool:   pool,
+			status: ReplicaStatus{Name: net.JoinHostPort(config.Host, strconv.Itoa(int(config.Port)))},
+		})
+	}
+
+	return &ReplicaRouter{
+		logger:   logger,
+		maxLag:   maxLag,
+		replicas: replicas,
+	}
+}
+
+// Len returns the number of configured replicas, whether they are in use or not
+func (r *ReplicaRouter) Len() int {
+	if r == nil {
+		return 0
+	}
+
+	return len(r.replicas)
+}
+
+// CheckLag measures the replay lag of every replica and takes the ones that lag behind more than maxLag
+// or cannot be reached out of rotation. The returned error joins the checks that failed, a replica that lags is not an error.
+func (r *ReplicaRouter) CheckLag(ctx context.Context) error {
+
+	var errs []error
+
+	for _, rep := range r.replicas {
+
+		lagSeconds, err := sqlc.New(rep.pool).GetReplicationLag(ctx)
+		lag := time.Duration(lagSeconds * float64(time.Second))
+
+		r.mu.Lock()
+		wasInUse := rep.status.InUse
+		rep.status.CheckedAt = time.Now()
+
+		if err != nil {
+			rep.status.InUse = false
+			rep.status.LastError = err.Error()
+			errs = append(errs, fmt.Errorf("checking lag of replica %s failed: %w", rep.status.Name, err))
+		} else {
+			rep.status.Lag = lag
+			rep.status.InUse = lag <= r.maxLag
+			rep.status.LastError = ""
+		}
+
+		status := rep.status
+		r.mu.Unlock()
+
+		switch {
+		case wasInUse && !status.InUse:
+			r.logger.Warn("taking replica out of rotation, reads fall back to the primary", zap.String("replica", status.Name),
+				zap.Duration("lag", status.Lag), zap.Duration("maxLag", r.maxLag), zap.Error(err))
+		case !wasInUse && status.InUse:
+			r.logger.Info("replica is in rotation", zap.String("replica", status.Name), zap.Duration("lag", status.Lag))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Status returns the state of every replica
+func (r *ReplicaRouter) Status() []ReplicaStatus {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	statuses := make([]ReplicaStatus, 0, len(r.replicas))
+	for _, rep := range r.replicas {
+		statuses = append(statuses, rep.status)
+	}
+
+	return statuses
+}
+
+// Close closes the pools of all replicas
+func (r *ReplicaRouter) Close() {
+	for _, rep := range r.replicas {
+		rep.pool.Close()
+	}
+}
+
+// pick returns the next replica in rotation, round-robin, or nil if there is none
+func (r *ReplicaRouter) pick() *replica {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for range r.replicas {
+		rep := r.replicas[r.next%len(r.replicas)]
+		r.next++
+
+		if rep.status.InUse {
+			return rep
+		}
+	}
+
+	return nil
+}
+
+// origin returns the ReadOrigin of a read the replica answered
+func (r *ReplicaRouter) origin(rep *replica) ReadOrigin {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return ReadOrigin{Replica: rep.status.Name, Lag: rep.status.Lag}
+}
+
+// fail takes a replica out of rotation until its next successful lag check
+func (r *ReplicaRouter) fail(rep *replica, err error) {
+
+	r.mu.Lock()
+	wasInUse := rep.status.InUse
+	rep.status.InUse = false
+	rep.status.LastError = err.Error()
+	r.mu.Unlock()
+
+	if wasInUse {
+		r.logger.Warn("replica failed, taking it out of rotation until the next lag check", zap.String("replica", rep.status.Name), zap.Error(err))
+	}
+}
+
+// onReplica runs fn on a replica in rotation, or on the primary if there is none.
+// If the replica cannot be reached, it is taken out of rotation and fn runs again on the primary,
+// so a lost replica never fails a read or counts against the circuit breaker. The returned ReadOrigin tells which one answered.
+func (r *Reader) onReplica(fn func(pool *pgxpool.Pool) error) (ReadOrigin, error) {
+
+	rep := r.Replicas.pick()
+	if rep == nil {
+		return ReadOrigin{}, fn(r.Pool)
+	}
+
+	err := fn(rep.pool)
+	if err == nil {
+		return r.Replicas.origin(rep), nil
+	}
+	if utils.ClassifyDbError(err).Kind != oe.DbErrConnection {
+		return ReadOrigin{}, err
+	}
+
+	r.Replicas.fail(rep, err)
+
+	return ReadOrigin{}, fn(r.Pool)
+}
+
+// readReplica runs a single query in a read-only transaction through onReplica
+func readReplica[T any](ctx context.Context, r *Reader, fn func(q *sqlc.Queries) (T, error)) (T, error) {
+
+	var result T
+
+	_, err := r.onReplica(func(pool *pgxpool.Pool) error {
+
+		tx, err := pool.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+		if err != nil {
+			return fmt.Errorf("beginning transaction failed: %w", err)
+		}
+
+		defer tx.Rollback(ctx)
+
+		result, err = fn(sqlc.New(tx))
+		if err != nil {
+			return err
+		}
+
+		commitErr := tx.Commit(ctx)
+		if commitErr != nil {
+			return fmt.Errorf("committing transaction failed: %w", commitErr)
+		}
+
+		return nil
+	})
+
+	return result, err
+}
@@ -0,0 +1,170 @@
+package database
+
+import (
+	"context"
+	oe "controller/src/errors"
+	"embed"
+	"errors"
+	"fmt"
+	"github.com/golang-migrate/migrate/v4"
+	migratepgx "github.com/golang-migrate/migrate/v4/database/pgx/v5"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
+	"go.uber.org/zap"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// SchemaMigrationsTable keeps the version of the embedded migrations. It is separate from the schema_migrations table
+// of the migrations submodule, whose tables the first embedded migration creates if they do not exist yet,
+// so an empty database gets the whole schema and one that was set up from the submodule keeps its tables.
+const SchemaMigrationsTable = "controller_schema_migrations"
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// SchemaVersion describes the version of the embedded migrations found in the database and the one this build expects
+type SchemaVersion struct {
+	Current  uint
+	Expected uint
+	Dirty    bool
+}
+
+// EnsureSchema checks the version of the embedded migrations in the database on startup.
+// If apply is set, pending migrations are applied. golang-migrate holds a postgres advisory lock while doing so,
+// so if several controllers start at once, only one of them migrates and the others wait up to lockTimeout and find nothing left to do.
+// The returned error wraps ErrSchemaIncompatible if the schema is dirty, newer than this build, or behind it and apply is not set.
+func EnsureSchema(ctx context.Context, pool *pgxpool.Pool, logger *zap.Logger, apply bool, lockTimeout time.Duration) (SchemaVersion, error) {
+
+	source, err := iofs.New(migrationFiles, "migrations")
+	if err != nil {
+		return SchemaVersion{}, fmt.Errorf("reading embedded migrations failed: %w", err)
+	}
+
+	expected, err := latestMigration(source)
+	if err != nil {
+		return SchemaVersion{}, err
+	}
+
+	//closing the sql.DB does not close the pool
+	db := stdlib.OpenDBFromPool(pool)
+	defer db.Close()
+
+	driver, err := migratepgx.WithInstance(db, &migratepgx.Config{MigrationsTable: SchemaMigrationsTable})
+	if err != nil {
+		return SchemaVersion{}, fmt.Errorf("creating migration driver failed: %w", err)
+	}
+
+	m, err := migrate.NewWithInstance("iofs", source, "pgx5", driver)
+	if err != nil {
+		return SchemaVersion{}, fmt.Errorf("creating migrator failed: %w", err)
+	}
+
+	defer func() {
+		if _, closeErr := m.Close(); closeErr != nil {
+			logger.Warn("could not close migrator", zap.Error(closeErr))
+		}
+	}()
+
+	m.LockTimeout = lockTimeout
+	m.Log = migrateLogger{logger: logger}
+
+	version, err := schemaVersion(m, expected)
+	if err != nil {
+		return version, err
+	}
+
+	logger.Info("checked schema version", zap.Uint("current", version.Current), zap.Uint("expected", version.Expected), zap.Bool("dirty", version.Dirty))
+
+	switch {
+	case version.Dirty:
+		return version, fmt.Errorf("%w: migration %d failed halfway and has to be fixed by hand", oe.ErrSchemaIncompatible, version.Current)
+	case version.Current > version.Expected:
+		return version, fmt.Errorf("%w: schema version %d is newer than %d, which this controller was built for", oe.ErrSchemaIncompatible, version.Current, version.Expected)
+	case version.Current == version.Expected:
+		return version, nil
+	case !apply:
+		return version, fmt.Errorf("%w: schema version %d is behind %d and applying migrations is disabled", oe.ErrSchemaIncompatible, version.Current, version.Expected)
+	}
+
+	logger.Info("applying pending schema migrations", zap.Uint("from", version.Current), zap.Uint("to", version.Expected))
+
+	//migrate does not take a context, so a shutdown stops it after the migration that is currently running
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			m.GracefulStop <- true
+		case <-done:
+		}
+	}()
+
+	if upErr := m.Up(); upErr != nil && !errors.Is(upErr, migrate.ErrNoChange) {
+		return version, fmt.Errorf("applying schema migrations failed: %w", upErr)
+	}
+
+	version, err = schemaVersion(m, expected)
+	if err != nil {
+		return version, err
+	}
+
+	if version.Dirty || version.Current != version.Expected {
+		return version, fmt.Errorf("%w: schema is at version %d (dirty: %t) after migrating to %d", oe.ErrSchemaIncompatible, version.Current, version.Dirty, version.Expected)
+	}
+
+	logger.Info("schema is up to date", zap.Uint("version", version.Current))
+
+	return version, nil
+}
+
+// schemaVersion reads the current version from the database, a database without any migration is at version 0
+func schemaVersion(m *migrate.Migrate, expected uint) (SchemaVersion, error) {
+
+	current, dirty, err := m.Version()
+	if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+		return SchemaVersion{Expected: expected}, fmt.Errorf("reading schema version failed: %w", err)
+	}
+
+	return SchemaVersion{Current: current, Expected: expected, Dirty: dirty}, nil
+}
+
+// latestMigration returns the version of the newest embedded migration
+func latestMigration(source interface {
+	First() (uint, error)
+	Next(version uint) (uint, error)
+}) (uint, error) {
+
+	version, err := source.First()
+	if err != nil {
+		return 0, fmt.Errorf("finding first embedded migration failed: %w", err)
+	}
+
+	for {
+		next, nextErr := source.Next(version)
+		if errors.Is(nextErr, fs.ErrNotExist) {
+			return version, nil
+		}
+		if nextErr != nil {
+			return 0, fmt.Errorf("finding embedded migration after %d failed: %w", version, nextErr)
+		}
+
+		version = next
+	}
+}
+
+// migrateLogger passes the log output of golang-migrate to zap
+type migrateLogger struct {
+	logger *zap.Logger
+}
+
+func (l migrateLogger) Printf(format string, v ...any) {
+	l.logger.Info(strings.TrimSpace(fmt.Sprintf(format, v...)), zap.String("component", "migrate"))
+}
+
+func (l migrateLogger) Verbose() bool {
+	return false
+}
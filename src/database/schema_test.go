@@ -0,0 +1,146 @@
+package database
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMigrationsMatchQueries applies all embedded migrations to an empty database and prepares every query of query.sql
+// against the result, so a migration that does not produce the schema the sqlc queries were generated for fails here.
+// It needs an empty database it may migrate, passed as connection string in TEST_PG_CONN, and is skipped without one.
+func TestMigrationsMatchQueries(t *testing.T) {
+
+	pgConn := os.Getenv("TEST_PG_CONN")
+	if pgConn == "" {
+		t.Skip("TEST_PG_CONN is not set")
+	}
+
+	ctx := context.Background()
+
+	pool, err := pgxpool.New(ctx, pgConn)
+	if err != nil {
+		t.Fatalf("could not connect to database: %v", err)
+	}
+	defer pool.Close()
+
+	var tables int
+	if err = pool.QueryRow(ctx, "SELECT count(*) FROM information_schema.tables WHERE table_schema = current_schema()").Scan(&tables); err != nil {
+		t.Fatalf("could not count tables: %v", err)
+	}
+	if tables != 0 {
+		t.Fatalf("expected an empty database, found %d tables", tables)
+	}
+
+	version, err := EnsureSchema(ctx, pool, zap.NewNop(), true, time.Minute)
+	if err != nil {
+		t.Fatalf("applying migrations failed: %v", err)
+	}
+	if version.Current != version.Expected {
+		t.Fatalf("expected schema version %d, got %d", version.Expected, version.Current)
+	}
+
+	queries, err := readQueries("../../query.sql")
+	if err != nil {
+		t.Fatalf("could not read queries: %v", err)
+	}
+
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("could not acquire connection: %v", err)
+	}
+	defer conn.Release()
+
+	for name, query := range queries {
+		t.Run(name, func(t *testing.T) {
+			if _, prepareErr := conn.Conn().Prepare(ctx, "", query); prepareErr != nil {
+				t.Errorf("query does not match the migrated schema: %v\n%s", prepareErr, query)
+			}
+		})
+	}
+}
+
+var (
+	queryName     = regexp.MustCompile(`^-- name: (\w+) :\w+`)
+	namedArg      = regexp.MustCompile(`sqlc\.n?arg\((\w+)\)`)
+	positionalArg = regexp.MustCompile(`\$(\d+)`)
+)
+
+// readQueries reads the queries of a sqlc query file by name. The named arguments of sqlc are replaced by
+// positional parameters following the ones the query already uses, which is what sqlc generates as well.
+func readQueries(path string) (map[string]string, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	queries := make(map[string]string)
+	var name string
+	var body strings.Builder
+
+	flush := func() {
+		if name != "" {
+			queries[name] = positional(body.String())
+		}
+		body.Reset()
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+
+		line := scanner.Text()
+
+		if match := queryName.FindStringSubmatch(line); match != nil {
+			flush()
+			name = match[1]
+			continue
+		}
+
+		body.WriteString(line)
+		body.WriteString("\n")
+	}
+	flush()
+
+	if scanErr := scanner.Err(); scanErr != nil {
+		return nil, scanErr
+	}
+
+	if len(queries) == 0 {
+		return nil, fmt.Errorf("no queries found in %s", path)
+	}
+
+	return queries, nil
+}
+
+func positional(query string) string {
+
+	next := 0
+	for _, match := range positionalArg.FindAllStringSubmatch(query, -1) {
+		if n, _ := strconv.Atoi(match[1]); n > next {
+			next = n
+		}
+	}
+
+	numbers := make(map[string]int)
+
+	return namedArg.ReplaceAllStringFunc(query, func(arg string) string {
+
+		name := namedArg.FindStringSubmatch(arg)[1]
+		if _, ok := numbers[name]; !ok {
+			next++
+			numbers[name] = next
+		}
+
+		return "$" + strconv.Itoa(numbers[name])
+	})
+}
@@ -0,0 +1,71 @@
+package database
+
+import (
+	"context"
+	database "controller/src/database/sqlc"
+	oe "controller/src/errors"
+	"controller/src/utils"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+// serializableRetryPolicy decides how often a SERIALIZABLE transaction is run again after postgres aborted it.
+// The waits are short and jittered, the transactions that conflicted are usually done by then.
+var serializableRetryPolicy = utils.RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: 5 * time.Millisecond,
+	MaxBackoff:     200 * time.Millisecond,
+	Strategy:       utils.BackoffDecorrelated,
+	Retryable: func(err error) bool {
+		var dbErr oe.DbError
+		return errors.As(err, &dbErr) && dbErr.TxRetryable()
+	},
+}
+
+// errTxRetriesExhausted marks a serialization failure or deadlock that outlasted every attempt of serializableRetryPolicy.
+// The WriterPerfectionist does not retry it again, so a single write runs its transaction at most MaxAttempts times.
+var errTxRetriesExhausted = errors.New("transaction conflicted on every attempt")
+
+// serializable runs fn in a SERIALIZABLE transaction and commits it. Postgres aborts such a transaction on a serialization
+// failure or a deadlock, in which case the whole transaction is run again from the start, fn must not have side effects
+// outside the transaction. Any other error is returned right away.
+// This is the only retry of conflicts, the error they end in stays reconcilable for the supervisor but wraps errTxRetriesExhausted.
+func (w *Writer) serializable(ctx context.Context, operation string, fn func(q *database.Queries) oe.DbError) oe.DbError {
+
+	_, err := utils.Retry(ctx, w.Logger, operation, serializableRetryPolicy, func(ctx context.Context) (struct{}, error) {
+		if dbErr := w.serializableOnce(ctx, fn); dbErr.Err != nil {
+			return struct{}{}, dbErr
+		}
+		return struct{}{}, nil
+	})
+
+	dbErr := utils.ClassifyDbError(err)
+	if dbErr.TxRetryable() {
+		dbErr.Err = fmt.Errorf("%w: %w", errTxRetriesExhausted, dbErr.Err)
+	}
+
+	return dbErr
+}
+
+func (w *Writer) serializableOnce(ctx context.Context, fn func(q *database.Queries) oe.DbError) oe.DbError {
+
+	tx, err := w.Pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.Serializable})
+	if err != nil {
+		return utils.ClassifyDbError(fmt.Errorf("beginning transaction: %w", err))
+	}
+
+	defer tx.Rollback(ctx)
+
+	if oeErr := fn(database.New(tx)); oeErr.Err != nil {
+		return oeErr
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return utils.ClassifyDbError(fmt.Errorf("committing transaction failed: %w", commitErr))
+	}
+
+	return oe.DbError{Err: nil}
+}
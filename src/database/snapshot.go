@@ -0,0 +1,122 @@
+package database
+
+import (
+	"context"
+	sqlc "controller/src/database/sqlc"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Snapshot runs several reads in one REPEATABLE READ, read-only transaction, so all of them see the same state of the database,
+// e.g. no migration cutover can happen between reading db_instance and db_mapping.
+// It is only valid inside the function passed to one of the Snapshot methods of the Reader or the ReaderPerfectionist.
+type Snapshot struct {
+	ctx context.Context
+	q   *sqlc.Queries
+}
+
+// Snapshot runs fn in a single snapshot transaction on the primary. The transaction is read-only, so fn can only read.
+func (r *Reader) Snapshot(ctx context.Context, fn func(s *Snapshot) error) error {
+	return r.snapshotOn(ctx, r.Pool, fn)
+}
+
+// StaleSnapshot is Snapshot on a replica in rotation, for state dumps that tolerate data as old as the replicas lag limit.
+// fn runs again on the primary if the replica cannot be reached, so it must not have side effects beyond the values it reads.
+// The returned ReadOrigin tells whether a replica answered and how far it lagged behind.
+func (r *Reader) StaleSnapshot(ctx context.Context, fn func(s *Snapshot) error) (ReadOrigin, error) {
+	return r.onReplica(func(pool *pgxpool.Pool) error {
+		return r.snapshotOn(ctx, pool, fn)
+	})
+}
+
+func (r *Reader) snapshotOn(ctx context.Context, pool *pgxpool.Pool, fn func(s *Snapshot) error) error {
+
+	tx, err := pool.BeginTx(ctx, pgx.TxOptions{
+		IsoLevel:   pgx.RepeatableRead,
+		AccessMode: pgx.ReadOnly,
+	})
+	if err != nil {
+		return fmt.Errorf("beginning snapshot transaction failed: %w", err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	if fnErr := fn(&Snapshot{ctx: ctx, q: sqlc.New(tx)}); fnErr != nil {
+		return fnErr
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return fmt.Errorf("committing snapshot transaction failed: %w", commitErr)
+	}
+
+	r.Logger.Debug("successfully read snapshot")
+	return nil
+}
+
+// GetAllDbInstanceInfo retrieves information about all database instances
+func (s *Snapshot) GetAllDbInstanceInfo() ([]sqlc.DbInstance, error) {
+
+	dbInstances, err := s.q.GetAllDbInstances(s.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting data on all db instances failed: %w", err)
+	}
+
+	return dbInstances, nil
+}
+
+// GetAllDbMappingInfo retrieves information about all database mappings
+func (s *Snapshot) GetAllDbMappingInfo() ([]sqlc.DbMapping, error) {
+
+	mappings, err := s.q.GetAllDbMappings(s.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting data on all db mappings failed: %w", err)
+	}
+
+	return mappings, nil
+}
+
+// GetAllWorkerState retrieves the state of all workers
+func (s *Snapshot) GetAllWorkerState() ([]sqlc.WorkerMetric, error) {
+
+	workers, err := s.q.GetAllWorkerState(s.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting all worker states failed: %w", err)
+	}
+
+	return workers, nil
+}
+
+// GetAllMWorkerState retrieves the state of all migration workers
+func (s *Snapshot) GetAllMWorkerState() ([]sqlc.MigrationWorker, error) {
+
+	workers, err := s.q.GetAllMWorkerState(s.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting all migration workers failed: %w", err)
+	}
+
+	return workers, nil
+}
+
+// GetAllDbProbes retrieves the latest probe results of all databases
+func (s *Snapshot) GetAllDbProbes() ([]sqlc.DbProbe, error) {
+
+	probes, err := s.q.GetAllDbProbes(s.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting database probes failed: %w", err)
+	}
+
+	return probes, nil
+}
+
+// GetActiveMigrationJobs retrieves all migration jobs that are assigned to a migration worker and have not reached a terminal state yet
+func (s *Snapshot) GetActiveMigrationJobs() ([]sqlc.DbMigration, error) {
+
+	jobs, err := s.q.GetActiveMigrationJobs(s.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting active migration jobs failed: %w", err)
+	}
+
+	return jobs, nil
+}
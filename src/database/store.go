@@ -0,0 +1,95 @@
+package database
+
+import (
+	"context"
+	sqlc "controller/src/database/sqlc"
+	oe "controller/src/errors"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+	"time"
+)
+
+// ReadStore is every read the components need. The ReaderPerfectionist implements it on top of postgres,
+// the MemoryStore keeps the tables in memory for unit tests and simulations.
+type ReadStore interface {
+	Ping(ctx context.Context) error
+	Snapshot(ctx context.Context, operation string, fn func(s SnapshotReader) error) error
+	StaleSnapshot(ctx context.Context, operation string, fn func(s SnapshotReader) error) (ReadOrigin, error)
+	GetControllerState(ctx context.Context) (sqlc.ControllerStatus, error)
+	GetAllWorkerState(ctx context.Context) ([]sqlc.WorkerMetric, error)
+	GetAllMWorkerState(ctx context.Context) ([]sqlc.MigrationWorker, error)
+	GetSingleWorkerState(ctx context.Context, workerID string) (sqlc.WorkerMetric, error)
+	GetDBCount(ctx context.Context) (int, error)
+	GetDBConnErrors(ctx context.Context) ([]sqlc.DbConnErr, error)
+	GetDBConnErrorBuckets(ctx context.Context, since time.Time, bucket time.Duration) ([]sqlc.GetDBConnErrorBucketsRow, error)
+	GetAllDbInstanceInfo(ctx context.Context) ([]sqlc.DbInstance, error)
+	GetAllDbMappingInfo(ctx context.Context) ([]sqlc.DbMapping, error)
+	GetDBMappingInfoByUrlFrom(ctx context.Context, url, from string) (sqlc.DbMapping, error)
+	GetActiveMigrationJobs(ctx context.Context) ([]sqlc.DbMigration, error)
+	GetSingleMWorkerState(ctx context.Context, workerID string) (sqlc.MigrationWorker, error)
+	GetDatabaseTime(ctx context.Context) (time.Time, error)
+	GetFailureReportsSince(ctx context.Context, since time.Time) ([]sqlc.FailureReport, error)
+	GetDueMigrationJobs(ctx context.Context) ([]sqlc.DbMigration, error)
+	GetAllMigrationJobs(ctx context.Context) ([]sqlc.DbMigration, error)
+	GetAllDbProbes(ctx context.Context) ([]sqlc.DbProbe, error)
+	GetAuditEntries(ctx context.Context, beforeId int64, subject string, pageSize int32) ([]sqlc.AuditLog, error)
+}
+
+// SnapshotReader is a set of reads that all see the same state, see Snapshot
+type SnapshotReader interface {
+	GetAllDbInstanceInfo() ([]sqlc.DbInstance, error)
+	GetAllDbMappingInfo() ([]sqlc.DbMapping, error)
+	GetAllWorkerState() ([]sqlc.WorkerMetric, error)
+	GetAllMWorkerState() ([]sqlc.MigrationWorker, error)
+	GetAllDbProbes() ([]sqlc.DbProbe, error)
+	GetActiveMigrationJobs() ([]sqlc.DbMigration, error)
+}
+
+// WriteStore is every write the components need. The WriterPerfectionist implements it on top of postgres,
+// the MemoryStore keeps the tables in memory for unit tests and simulations. Failed writes return an oe.DbError.
+type WriteStore interface {
+	Transaction(ctx context.Context, operation string, fn func(uow TxWriter) oe.DbError) error
+	RemoveWorker(uuid pgtype.UUID, ctx context.Context) error
+	AddMigrationWorker(uuid, from, to string, ctx context.Context) error
+	RemoveMigrationWorker(uuid string, ctx context.Context) error
+	AddWorkerJobJoin(ctx context.Context, workerId, migrationId string) error
+	AddDatabaseMapping(from, url string, ctx context.Context) error
+	AddMigrationJob(ctx context.Context, addReq MigrationJobAddReq, migrationId uuid.UUID) error
+	Heartbeat(ctx context.Context, controllerId string) error
+	RegisterController(ctx context.Context, controllerId string, heartbeatTimeout time.Duration) error
+	ReassignMigrationJob(ctx context.Context, jobId, workerId, reason string) error
+	SetMigrationJobReason(ctx context.Context, jobId, reason string) error
+	FailMigrationJob(ctx context.Context, jobId, reason string) error
+	MarkDbInstanceUnhealthy(ctx context.Context, url, reason string) error
+	ClearDbInstanceUnhealthy(ctx context.Context, url string) error
+	StoreFailureReport(ctx context.Context, generatedAt time.Time, flaggedCount int, report []byte, retainSince time.Time) error
+	PurgeDBConnErrors(ctx context.Context, before time.Time, batchSize int) (int64, error)
+	RetireMigrationWorker(ctx context.Context, workerId string) error
+	RequeueMigrationJob(ctx context.Context, jobId string, nextAttemptAt time.Time, reason string) error
+	StoreDbProbes(ctx context.Context, results []DbProbeResult) error
+	UpdateMapping(ctx context.Context, mappingId, url, from string) error
+	DeleteMapping(ctx context.Context, mappingId string) error
+	AppendAuditEntry(ctx context.Context, entry AuditEntry) error
+}
+
+// TxWriter is a set of writes that either all happen or none of them does, see UnitOfWork
+type TxWriter interface {
+	AddMigrationWorker(uuid, from, to string) oe.DbError
+	AddMigrationJob(addReq MigrationJobAddReq, migrationJobId uuid.UUID) oe.DbError
+	AddWorkerJobJoin(workerId, migrationId string) oe.DbError
+	ClaimFreeMigrationWorker(aliveSince time.Time) (string, oe.DbError)
+	ClaimQueuedMigrationJob(jobId string) (sqlc.DbMigration, oe.DbError)
+	LockDbInstance(url string) (sqlc.DbInstance, oe.DbError)
+	ReassignMigrationJob(jobId, workerId, reason string) oe.DbError
+	RequeueMigrationJob(jobId string, nextAttemptAt time.Time, reason string) oe.DbError
+	RetireMigrationWorker(workerId string) oe.DbError
+}
+
+var (
+	_ ReadStore      = (*ReaderPerfectionist)(nil)
+	_ WriteStore     = (*WriterPerfectionist)(nil)
+	_ SnapshotReader = (*Snapshot)(nil)
+	_ TxWriter       = (*UnitOfWork)(nil)
+	_ ReadStore      = (*MemoryStore)(nil)
+	_ WriteStore     = (*MemoryStore)(nil)
+)
@@ -0,0 +1,227 @@
+package database
+
+import (
+	"context"
+	database "controller/src/database/sqlc"
+	oe "controller/src/errors"
+	"controller/src/utils"
+	"fmt"
+	guuid "github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+	"time"
+)
+
+// UnitOfWork composes several writes into one serializable transaction, so they either all happen or none of them does.
+// It is only valid inside the function passed to Writer.Transaction or WriterPerfectionist.Transaction.
+type UnitOfWork struct {
+	ctx context.Context
+	q   *database.Queries
+}
+
+// Transaction runs fn as a single unit of work and commits it. Serialization failures and deadlocks run fn again
+// from the start, so fn must not have side effects outside the unit of work.
+func (w *Writer) Transaction(ctx context.Context, operation string, fn func(uow *UnitOfWork) oe.DbError) oe.DbError {
+	return w.serializable(ctx, operation, func(q *database.Queries) oe.DbError {
+		return fn(&UnitOfWork{ctx: ctx, q: q})
+	})
+}
+
+// AddMigrationWorker adds a new migration worker with the specified UUID, from, and to values.
+func (u *UnitOfWork) AddMigrationWorker(uuid, from, to string) oe.DbError {
+
+	parsed, err := guuid.Parse(uuid)
+	if err != nil {
+		return oe.DbError{Err: fmt.Errorf("could not parse uuid"), Kind: oe.DbErrInvalid, Reconcilable: false}
+	}
+
+	return utils.Must(u.q.AddMigrationWorker(u.ctx, database.AddMigrationWorkerParams{
+		ID: pgtype.UUID{
+			Bytes: parsed,
+			Valid: true,
+		},
+		LastHeartbeat: pgtype.Timestamptz{
+			Time:             time.Now(),
+			InfinityModifier: 0,
+			Valid:            true,
+		},
+		Uptime: pgtype.Interval{
+			Microseconds: 0,
+			Days:         0,
+			Months:       0,
+			Valid:        true,
+		},
+		WorkingOnFrom: pgtype.Text{
+			String: from,
+			Valid:  true,
+		},
+		WorkingOnTo: pgtype.Text{
+			String: to,
+			Valid:  true,
+		},
+	}))
+}
+
+// AddMigrationJob creates a migration job for the range, assigned to the migration worker of the request.
+func (u *UnitOfWork) AddMigrationJob(addReq MigrationJobAddReq, migrationJobId guuid.UUID) oe.DbError {
+
+	parsed, err := guuid.Parse(addReq.MWorkerId)
+	if err != nil {
+		return oe.DbError{Err: fmt.Errorf("could not parse uuid"), Kind: oe.DbErrInvalid, Reconcilable: false}
+	}
+
+	return utils.Must(u.q.CreateMigrationJob(u.ctx, database.CreateMigrationJobParams{
+		ID: pgtype.UUID{
+			Bytes: migrationJobId,
+			Valid: true,
+		},
+		Url: addReq.Url,
+		MWorkerID: pgtype.UUID{
+			Bytes: parsed,
+			Valid: true,
+		},
+		From:   addReq.From,
+		To:     addReq.To,
+		Status: MigrationStatusWaiting, //status after creation always waiting
+	}))
+}
+
+// AddWorkerJobJoin adds a relationship between a migration worker and a migration job.
+func (u *UnitOfWork) AddWorkerJobJoin(workerId, migrationId string) oe.DbError {
+
+	workerParsed, err := guuid.Parse(workerId)
+	if err != nil {
+		return oe.DbError{Err: fmt.Errorf("could not parse uuid: %v", err), Kind: oe.DbErrInvalid, Reconcilable: false}
+	}
+
+	migrationParsed, err := guuid.Parse(migrationId)
+	if err != nil {
+		return oe.DbError{Err: fmt.Errorf("could not parse uuid: %v", err), Kind: oe.DbErrInvalid, Reconcilable: false}
+	}
+
+	return utils.Must(u.q.CreateWorkerJobJoin(u.ctx, database.CreateWorkerJobJoinParams{
+		WorkerID:    pgtype.UUID{Bytes: workerParsed, Valid: true},
+		MigrationID: pgtype.UUID{Bytes: migrationParsed, Valid: true},
+	}))
+}
+
+// ClaimFreeMigrationWorker locks a migration worker that heartbeated since aliveSince and has no active job, preferring the
+// one that heartbeated last. Workers locked by other transactions are skipped, so concurrent claims never get the same worker.
+// If there is no such worker, the returned error is of kind DbErrNoRows.
+func (u *UnitOfWork) ClaimFreeMigrationWorker(aliveSince time.Time) (string, oe.DbError) {
+
+	worker, err := u.q.ClaimFreeMigrationWorker(u.ctx, pgtype.Timestamptz{Time: aliveSince, Valid: true})
+	if err != nil {
+		return "", utils.ClassifyDbError(fmt.Errorf("claiming free migration worker failed: %w", err))
+	}
+
+	return worker.String(), oe.DbError{Err: nil}
+}
+
+// LockDbInstance reads a database instance and locks it until the transaction ends, so it cannot be marked unhealthy
+// between checking it and placing a range on it. If there is no such instance, the returned error is of kind DbErrNoRows.
+func (u *UnitOfWork) LockDbInstance(url string) (database.DbInstance, oe.DbError) {
+
+	instance, err := u.q.LockDbInstance(u.ctx, url)
+	if err != nil {
+		return database.DbInstance{}, utils.ClassifyDbError(fmt.Errorf("locking db instance failed: %w", err))
+	}
+
+	return instance, oe.DbError{Err: nil}
+}
+
+// ClaimQueuedMigrationJob locks a queued migration job. If the job is not queued anymore or claimed by another transaction,
+// the returned error is of kind DbErrNoRows.
+func (u *UnitOfWork) ClaimQueuedMigrationJob(jobId string) (database.DbMigration, oe.DbError) {
+
+	parsed, err := guuid.Parse(jobId)
+	if err != nil {
+		return database.DbMigration{}, oe.DbError{Err: fmt.Errorf("could not parse uuid"), Kind: oe.DbErrInvalid, Reconcilable: false}
+	}
+
+	job, err := u.q.ClaimQueuedMigrationJob(u.ctx, pgtype.UUID{Bytes: parsed, Valid: true})
+	if err != nil {
+		return database.DbMigration{}, utils.ClassifyDbError(fmt.Errorf("claiming queued migration job failed: %w", err))
+	}
+
+	return job, oe.DbError{Err: nil}
+}
+
+// ReassignMigrationJob moves a migration job to another migration worker, resetting it to "waiting" and recording the reason.
+// The join row between worker and job is moved as well.
+func (u *UnitOfWork) ReassignMigrationJob(jobId, workerId, reason string) oe.DbError {
+
+	jobParsed, err := guuid.Parse(jobId)
+	if err != nil {
+		return oe.DbError{Err: fmt.Errorf("could not parse uuid: %v", err), Kind: oe.DbErrInvalid, Reconcilable: false}
+	}
+
+	workerParsed, err := guuid.Parse(workerId)
+	if err != nil {
+		return oe.DbError{Err: fmt.Errorf("could not parse uuid: %v", err), Kind: oe.DbErrInvalid, Reconcilable: false}
+	}
+
+	jobUUID := pgtype.UUID{Bytes: jobParsed, Valid: true}
+	workerUUID := pgtype.UUID{Bytes: workerParsed, Valid: true}
+
+	execRes, execErr := u.q.ReassignMigrationJob(u.ctx, database.ReassignMigrationJobParams{
+		ID:           jobUUID,
+		MWorkerID:    workerUUID,
+		StatusReason: pgtype.Text{String: reason, Valid: true},
+	})
+	if oeErr := utils.Must(execRes, execErr); oeErr.Err != nil {
+		return oeErr
+	}
+
+	//the old join row might already be gone together with its worker
+	execRes, execErr = u.q.DeleteWorkerJobJoin(u.ctx, database.DeleteWorkerJobJoinParams{MigrationID: jobUUID})
+	if oeErr := utils.Optional(execRes, execErr); oeErr.Err != nil {
+		return oeErr
+	}
+
+	return utils.Must(u.q.CreateWorkerJobJoin(u.ctx, database.CreateWorkerJobJoinParams{
+		WorkerID:    workerUUID,
+		MigrationID: jobUUID,
+	}))
+}
+
+// RequeueMigrationJob detaches a migration job from its migration worker and queues it for another attempt at nextAttemptAt.
+func (u *UnitOfWork) RequeueMigrationJob(jobId string, nextAttemptAt time.Time, reason string) oe.DbError {
+
+	parsed, err := guuid.Parse(jobId)
+	if err != nil {
+		return oe.DbError{Err: fmt.Errorf("could not parse uuid"), Kind: oe.DbErrInvalid, Reconcilable: false}
+	}
+
+	jobUUID := pgtype.UUID{Bytes: parsed, Valid: true}
+
+	execRes, execErr := u.q.RequeueMigrationJob(u.ctx, database.RequeueMigrationJobParams{
+		ID:            jobUUID,
+		NextAttemptAt: pgtype.Timestamptz{Time: nextAttemptAt, Valid: true},
+		StatusReason:  pgtype.Text{String: reason, Valid: true},
+	})
+	if oeErr := utils.Must(execRes, execErr); oeErr.Err != nil {
+		return oeErr
+	}
+
+	//the job might not have a worker anymore
+	return utils.Optional(u.q.DeleteWorkerJobJoin(u.ctx, database.DeleteWorkerJobJoinParams{MigrationID: jobUUID}))
+}
+
+// RetireMigrationWorker removes a migration worker together with any join rows it still has.
+func (u *UnitOfWork) RetireMigrationWorker(workerId string) oe.DbError {
+
+	parsed, err := guuid.Parse(workerId)
+	if err != nil {
+		return oe.DbError{Err: fmt.Errorf("could not parse uuid"), Kind: oe.DbErrInvalid, Reconcilable: false}
+	}
+
+	workerUUID := pgtype.UUID{Bytes: parsed, Valid: true}
+
+	//the join row usually moved together with the job already
+	execRes, execErr := u.q.DeleteWorkerJobJoin(u.ctx, database.DeleteWorkerJobJoinParams{WorkerID: workerUUID})
+	if oeErr := utils.Optional(execRes, execErr); oeErr.Err != nil {
+		return oeErr
+	}
+
+	return utils.Must(u.q.DeleteMigrationWorker(u.ctx, workerUUID))
+}
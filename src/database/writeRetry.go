@@ -4,318 +4,243 @@ import (
 	"context"
 	oe "controller/src/errors"
 	utils "controller/src/utils"
+	"errors"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5/pgtype"
-	goutils "github.com/linusgith/goutils/pkg/env_utils"
 	"go.uber.org/zap"
 	"time"
 )
 
-// WriterPerfectionist is a wrapper around the Writer that retries operations with a backoff strategy
-// and handles reconcilable errors. It is used to ensure that operations are retried
-// in case of temporary failures, while also allowing for a maximum number of retries.
+// WriterPerfectionist is a wrapper around the Writer that retries every write through the retry engine in utils,
+// guarded by the circuit breaker it shares with the ReaderPerfectionist. Only reconcilable errors are retried. All operations share one retry policy, configured via environment variables,
+// which can be overridden per operation.
 type WriterPerfectionist struct {
-	writer         *Writer
-	maxRetries     int
-	initialBackoff time.Duration
-	backoffType    string
+	writer    *Writer
+	breaker   *CircuitBreaker
+	policy    utils.RetryPolicy
+	overrides map[string]utils.RetryPolicy
 }
 
-func NewWriterPerfectionist(writer *Writer) *WriterPerfectionist {
+func NewWriterPerfectionist(writer *Writer, breaker *CircuitBreaker) *WriterPerfectionist {
 
-	//15 ms in exp backoff gives us [15,225, 3375] ms as backoff intervals
-
-	initBackoff := goutils.Log().ParseEnvDurationDefault("INIT_RETRY_BACKOFF", 15*time.Millisecond, writer.Logger)
-
-	maxRetries := goutils.Log().ParseEnvIntDefault("MAX_RETRIES", 3, writer.Logger)
-
-	defaultBackoffStrategy := "exp"
-
-	backoffTypeInput := goutils.Log().ParseEnvStringDefault("BACKOFF_TYPE", defaultBackoffStrategy, writer.Logger)
-
-	var backoffType string
-
-	switch backoffTypeInput {
-	case "exp":
-		backoffType = "exponential"
-	case "lin":
-		backoffType = "linear"
-	default:
-		writer.Logger.Warn("invalid backoff strategy provided, setting default", zap.String("provided", backoffTypeInput))
-		backoffType = defaultBackoffStrategy
-	}
+	policy := utils.RetryPolicyFromEnv("", DefaultRetryPolicy, writer.Logger)
+	policy.Retryable = reconcilable
 
 	return &WriterPerfectionist{
-		writer:         writer,
-		maxRetries:     maxRetries,
-		initialBackoff: initBackoff,
-		backoffType:    backoffType,
+		writer:    writer,
+		breaker:   breaker,
+		policy:    policy,
+		overrides: make(map[string]utils.RetryPolicy),
 	}
 }
 
-// RemoveWorker removes a worker from the database with retries and backoff.
-func (w *WriterPerfectionist) RemoveWorker(uuid pgtype.UUID, ctx context.Context) error {
+// OverridePolicy sets the retry policy of a single operation, named like the method of the WriterPerfectionist.
+// It is not safe for concurrent use and has to be called during setup.
+func (w *WriterPerfectionist) OverridePolicy(operation string, policy utils.RetryPolicy) {
+	if policy.Retryable == nil {
+		policy.Retryable = reconcilable
+	}
 
-	var err oe.DbError
+	w.writer.Logger.Debug("overriding retry policy", zap.String("operation", operation), zap.Int("maxAttempts", policy.MaxAttempts), zap.String("strategy", string(policy.Strategy)))
+	w.overrides[operation] = policy
+}
 
-	for i := 1; i <= w.maxRetries; i++ {
-		err = w.writer.RemoveWorker(ctx, uuid)
-		if err.Err == nil {
-			return nil
-		}
+// write runs a single write of the writer with the policy of the operation, every attempt has to pass the circuit breaker
+func (w *WriterPerfectionist) write(ctx context.Context, operation string, fn func(ctx context.Context) oe.DbError) error {
 
-		if !err.Reconcilable {
-			return err
-		}
+	policy, ok := w.overrides[operation]
+	if !ok {
+		policy = w.policy
+	}
 
-		if i < w.maxRetries {
-			w.writer.Logger.Warn("removing worker failed; retrying...", zap.Int("try", i), zap.Error(err))
+	retryable := policy.Retryable
+	policy.Retryable = breakerRetryable(retryable)
 
-			utils.CalculateAndExecuteBackoff(i, w.initialBackoff)
+	_, err := utils.Retry(ctx, w.writer.Logger, operation, policy, guard(w.breaker, retryable, func(ctx context.Context) (struct{}, error) {
+		if dbErr := fn(ctx); dbErr.Err != nil {
+			return struct{}{}, dbErr
 		}
-	}
+		return struct{}{}, nil
+	}))
 
-	w.writer.Logger.Error("removing worker failed, retry limit reached", zap.Error(err))
 	return err
-
 }
 
-// AddMigrationWorker adds a migration worker to the database with retries and backoff.
-func (w *WriterPerfectionist) AddMigrationWorker(uuid, from, to string, ctx context.Context) error {
-
-	var err oe.DbError
-
-	for i := 1; i <= w.maxRetries; i++ {
-		err = w.writer.AddMigrationWorker(ctx, uuid, from, to)
-		if err.Err == nil {
-			return nil
-		}
-
-		if !err.Reconcilable {
-			return err
-		}
+// Transaction runs fn as a single unit of work with retries, see Writer.Transaction.
+// Conflicts are only retried inside Writer.Transaction, lost connections and the like by the policy of the operation.
+// fn may run several times, so it must not have side effects outside the unit of work.
+func (w *WriterPerfectionist) Transaction(ctx context.Context, operation string, fn func(uow TxWriter) oe.DbError) error {
+	return w.write(ctx, operation, func(ctx context.Context) oe.DbError {
+		return w.writer.Transaction(ctx, operation, func(uow *UnitOfWork) oe.DbError { return fn(uow) })
+	})
+}
 
-		if i < w.maxRetries {
-			w.writer.Logger.Warn("removing migration worker failed; retrying...", zap.Int("try", i), zap.Error(err))
+// reconcilable reports whether a write failed with an error that is worth retrying.
+// Conflicts of transactions were already retried by Writer.serializable and are not retried again.
+func reconcilable(err error) bool {
+	if errors.Is(err, errTxRetriesExhausted) {
+		return false
+	}
 
-			utils.CalculateAndExecuteBackoff(i, w.initialBackoff)
-		}
+	var dbErr oe.DbError
+	if errors.As(err, &dbErr) {
+		return dbErr.Reconcilable
 	}
 
-	w.writer.Logger.Error("removing migration worker failed, retry limit reached", zap.Error(err))
-	return err
+	return true
+}
+
+// RemoveWorker removes a worker from the database with retries and backoff.
+func (w *WriterPerfectionist) RemoveWorker(uuid pgtype.UUID, ctx context.Context) error {
+	return w.write(ctx, "RemoveWorker", func(ctx context.Context) oe.DbError {
+		return w.writer.RemoveWorker(ctx, uuid)
+	})
+}
 
+// AddMigrationWorker adds a migration worker to the database with retries and backoff.
+func (w *WriterPerfectionist) AddMigrationWorker(uuid, from, to string, ctx context.Context) error {
+	return w.write(ctx, "AddMigrationWorker", func(ctx context.Context) oe.DbError {
+		return w.writer.AddMigrationWorker(ctx, uuid, from, to)
+	})
 }
 
 // RemoveMigrationWorker removes a migration worker from the database with retries and backoff.
 func (w *WriterPerfectionist) RemoveMigrationWorker(uuid string, ctx context.Context) error {
-
-	var err oe.DbError
-
-	for i := 1; i <= w.maxRetries; i++ {
-		err = w.writer.RemoveMigrationWorker(ctx, uuid)
-		if err.Err == nil {
-			return nil
-		}
-
-		if !err.Reconcilable {
-			return err
-		}
-
-		if i < w.maxRetries {
-			w.writer.Logger.Warn("removing migration worker failed; retrying...", zap.Int("try", i), zap.Error(err))
-
-			utils.CalculateAndExecuteBackoff(i, w.initialBackoff)
-		}
-	}
-
-	w.writer.Logger.Error("removing migration worker failed, retry limit reached", zap.Int("retry", w.maxRetries), zap.Error(err))
-	return err
-
+	return w.write(ctx, "RemoveMigrationWorker", func(ctx context.Context) oe.DbError {
+		return w.writer.RemoveMigrationWorker(ctx, uuid)
+	})
 }
 
 // AddWorkerJobJoin adds a join from a migration worker to a job with retries and backoff.
 func (w *WriterPerfectionist) AddWorkerJobJoin(ctx context.Context, workerId, migrationId string) error {
-
-	var err oe.DbError
-
-	for i := 1; i <= w.maxRetries; i++ {
-		err = w.writer.AddWorkerJobJoin(ctx, workerId, migrationId)
-		if err.Err == nil {
-			return nil
-		}
-
-		if !err.Reconcilable {
-			return err
-		}
-
-		if i < w.maxRetries {
-			w.writer.Logger.Warn("adding join from migration worker and job failed; retrying...", zap.Int("try", i), zap.Error(err))
-
-			utils.CalculateAndExecuteBackoff(i, w.initialBackoff)
-		}
-	}
-
-	w.writer.Logger.Error("adding join from migration worker and job failed, retry limit reached", zap.Int("retry", w.maxRetries), zap.Error(err))
-	return err
-
-}
-
-// RemoveMWorkerAndJobs removes a migration worker and its associated jobs with retries and backoff.
-func (w *WriterPerfectionist) RemoveMWorkerAndJobs(ctx context.Context, workerId string) error {
-
-	var err oe.DbError
-
-	for i := 1; i <= w.maxRetries; i++ {
-		err = w.writer.RemoveMWorkerAndJobs(ctx, workerId)
-		if err.Err == nil {
-			return nil
-		}
-
-		if !err.Reconcilable {
-			return err
-		}
-
-		if i < w.maxRetries {
-			w.writer.Logger.Warn("removing migration worker failed; retrying...", zap.Int("try", i), zap.Error(err))
-
-			utils.CalculateAndExecuteBackoff(i, w.initialBackoff)
-		}
-	}
-
-	w.writer.Logger.Error("removing migration worker failed, retry limit reached", zap.Int("retry", w.maxRetries), zap.Error(err))
-	return err
-
+	return w.write(ctx, "AddWorkerJobJoin", func(ctx context.Context) oe.DbError {
+		return w.writer.AddWorkerJobJoin(ctx, workerId, migrationId)
+	})
 }
 
 // AddDatabaseMapping adds a database mapping with retries and backoff.
 func (w *WriterPerfectionist) AddDatabaseMapping(from, url string, ctx context.Context) error {
-	var err oe.DbError
-
-	for i := 1; i <= w.maxRetries; i++ {
-		err = w.writer.AddDatabaseMapping(from, url, ctx)
-		if err.Err == nil {
-			return nil
-		}
-
-		if !err.Reconcilable {
-			return err
-		}
-
-		if i < w.maxRetries {
-			w.writer.Logger.Warn("adding database mapping failed; retrying...", zap.Int("try", i), zap.Error(err))
-
-			utils.CalculateAndExecuteBackoff(i, w.initialBackoff)
-		}
-	}
-
-	w.writer.Logger.Error("adding database mapping failed, retry limit reached", zap.Error(err))
-	return err
+	return w.write(ctx, "AddDatabaseMapping", func(ctx context.Context) oe.DbError {
+		return w.writer.AddDatabaseMapping(from, url, ctx)
+	})
 }
 
 // AddMigrationJob adds a migration job with retries and backoff.
 func (w *WriterPerfectionist) AddMigrationJob(ctx context.Context, addReq MigrationJobAddReq, migrationId uuid.UUID) error {
-
-	var err oe.DbError
-
-	for i := 1; i <= w.maxRetries; i++ {
-		err = w.writer.AddMigrationJob(ctx, addReq, migrationId)
-		if err.Err == nil {
-			return nil
-		}
-
-		if !err.Reconcilable {
-			return err
-		}
-
-		if i < w.maxRetries {
-			w.writer.Logger.Warn("adding migration job failed; retrying...", zap.Int("try", i), zap.Error(err))
-
-			utils.CalculateAndExecuteBackoff(i, w.initialBackoff)
-		}
-	}
-
-	w.writer.Logger.Error("adding migration job failed, retry limit reached", zap.Error(err))
-	return err
+	return w.write(ctx, "AddMigrationJob", func(ctx context.Context) oe.DbError {
+		return w.writer.AddMigrationJob(ctx, addReq, migrationId)
+	})
 }
 
-// DeleteDBConnErrors deletes outdated database connection errors with retries and backoff.
-func (w *WriterPerfectionist) DeleteDBConnErrors(ctx context.Context, dbUrl pgtype.Text, workerId pgtype.UUID, timestamp pgtype.Timestamptz) error {
-
-	var err oe.DbError
-
-	for i := 1; i <= w.maxRetries; i++ {
-		err = w.writer.DeleteDbConnErrors(ctx, dbUrl, workerId, timestamp)
-		if err.Err == nil {
-			return nil
-		}
-
-		if !err.Reconcilable {
-			return err
-		}
-
-		if i < w.maxRetries {
-			w.writer.Logger.Warn("deleting outdated dbConnError failed; retrying...", zap.Int("try", i), zap.Error(err))
-
-			utils.CalculateAndExecuteBackoff(i, w.initialBackoff)
-		}
-	}
+// Heartbeat sends a heartbeat signal to the database with retries and backoff.
+// A lost leadership is not retried, see Writer.Heartbeat.
+func (w *WriterPerfectionist) Heartbeat(ctx context.Context, controllerId string) error {
+	return w.write(ctx, "Heartbeat", func(ctx context.Context) oe.DbError {
+		return w.writer.Heartbeat(ctx, controllerId)
+	})
+}
 
-	w.writer.Logger.Error("deleting outdated dbConnError failed, retry limit reached", zap.Error(err))
-	return err
+// RegisterController registers a controller with the database with retries and backoff.
+// Losing the registration to another controller is not retried, see Writer.RegisterController.
+func (w *WriterPerfectionist) RegisterController(ctx context.Context, controllerId string, heartbeatTimeout time.Duration) error {
+	return w.write(ctx, "RegisterController", func(ctx context.Context) oe.DbError {
+		return w.writer.RegisterController(ctx, controllerId, heartbeatTimeout)
+	})
+}
 
+// ReassignMigrationJob moves a migration job to another migration worker with retries and backoff.
+func (w *WriterPerfectionist) ReassignMigrationJob(ctx context.Context, jobId, workerId, reason string) error {
+	return w.write(ctx, "ReassignMigrationJob", func(ctx context.Context) oe.DbError {
+		return w.writer.ReassignMigrationJob(ctx, jobId, workerId, reason)
+	})
 }
 
-// Heartbeat sends a heartbeat signal to the database with retries and backoff.
-func (w *WriterPerfectionist) Heartbeat(ctx context.Context) error {
+// SetMigrationJobReason records the reason for a controller decision on a migration job with retries and backoff.
+func (w *WriterPerfectionist) SetMigrationJobReason(ctx context.Context, jobId, reason string) error {
+	return w.write(ctx, "SetMigrationJobReason", func(ctx context.Context) oe.DbError {
+		return w.writer.SetMigrationJobReason(ctx, jobId, reason)
+	})
+}
 
-	var err oe.DbError
+// FailMigrationJob marks a migration job as failed with retries and backoff.
+func (w *WriterPerfectionist) FailMigrationJob(ctx context.Context, jobId, reason string) error {
+	return w.write(ctx, "FailMigrationJob", func(ctx context.Context) oe.DbError {
+		return w.writer.FailMigrationJob(ctx, jobId, reason)
+	})
+}
 
-	for i := 1; i <= w.maxRetries; i++ {
-		err = w.writer.Heartbeat(ctx)
-		if err.Err == nil {
-			return nil
-		}
+// MarkDbInstanceUnhealthy marks a database instance as unhealthy with retries and backoff.
+func (w *WriterPerfectionist) MarkDbInstanceUnhealthy(ctx context.Context, url, reason string) error {
+	return w.write(ctx, "MarkDbInstanceUnhealthy", func(ctx context.Context) oe.DbError {
+		return w.writer.MarkDbInstanceUnhealthy(ctx, url, reason)
+	})
+}
 
-		if !err.Reconcilable {
-			return err
-		}
+// ClearDbInstanceUnhealthy clears the unhealthy mark of a database instance with retries and backoff.
+func (w *WriterPerfectionist) ClearDbInstanceUnhealthy(ctx context.Context, url string) error {
+	return w.write(ctx, "ClearDbInstanceUnhealthy", func(ctx context.Context) oe.DbError {
+		return w.writer.ClearDbInstanceUnhealthy(ctx, url)
+	})
+}
 
-		if i < w.maxRetries {
-			w.writer.Logger.Warn("heartbeat failed; retrying...", zap.Int("try", i), zap.Error(err))
+// StoreFailureReport persists a failure report and prunes old ones with retries and backoff.
+func (w *WriterPerfectionist) StoreFailureReport(ctx context.Context, generatedAt time.Time, flaggedCount int, report []byte, retainSince time.Time) error {
+	return w.write(ctx, "StoreFailureReport", func(ctx context.Context) oe.DbError {
+		return w.writer.StoreFailureReport(ctx, generatedAt, flaggedCount, report, retainSince)
+	})
+}
 
-			utils.CalculateAndExecuteBackoff(i, w.initialBackoff)
-		}
-	}
+// PurgeDBConnErrors deletes one batch of database connection errors before the given time with retries and backoff.
+func (w *WriterPerfectionist) PurgeDBConnErrors(ctx context.Context, before time.Time, batchSize int) (int64, error) {
+	var deleted int64
 
-	w.writer.Logger.Error("heartbeat failed, retry limit reached", zap.Error(err))
+	err := w.write(ctx, "PurgeDBConnErrors", func(ctx context.Context) oe.DbError {
+		var dbErr oe.DbError
+		deleted, dbErr = w.writer.PurgeDBConnErrors(ctx, before, batchSize)
+		return dbErr
+	})
 
-	return err
+	return deleted, err
 }
 
-// RegisterController registers a controller with the database with retries and backoff.
-func (w *WriterPerfectionist) RegisterController(ctx context.Context) error {
-
-	var err oe.DbError
-
-	for i := 1; i <= w.maxRetries; i++ {
-		err = w.writer.RegisterController(ctx)
-		if err.Err == nil {
-			return nil
-		}
+// RetireMigrationWorker removes a migration worker without a job with retries and backoff.
+func (w *WriterPerfectionist) RetireMigrationWorker(ctx context.Context, workerId string) error {
+	return w.write(ctx, "RetireMigrationWorker", func(ctx context.Context) oe.DbError {
+		return w.writer.RetireMigrationWorker(ctx, workerId)
+	})
+}
 
-		if !err.Reconcilable {
-			return err
-		}
+// RequeueMigrationJob queues a migration job for another attempt with retries and backoff.
+func (w *WriterPerfectionist) RequeueMigrationJob(ctx context.Context, jobId string, nextAttemptAt time.Time, reason string) error {
+	return w.write(ctx, "RequeueMigrationJob", func(ctx context.Context) oe.DbError {
+		return w.writer.RequeueMigrationJob(ctx, jobId, nextAttemptAt, reason)
+	})
+}
 
-		if i < w.maxRetries {
-			w.writer.Logger.Warn("registering controller failed; retrying...", zap.Int("try", i), zap.Error(err))
+// StoreDbProbes stores the latest database probe results with retries and backoff.
+func (w *WriterPerfectionist) StoreDbProbes(ctx context.Context, results []DbProbeResult) error {
+	return w.write(ctx, "StoreDbProbes", func(ctx context.Context) oe.DbError {
+		return w.writer.StoreDbProbes(ctx, results)
+	})
+}
 
-			utils.CalculateAndExecuteBackoff(i, w.initialBackoff)
-		}
-	}
+// UpdateMapping updates a mapping with retries and backoff.
+func (w *WriterPerfectionist) UpdateMapping(ctx context.Context, mappingId, url, from string) error {
+	return w.write(ctx, "UpdateMapping", func(ctx context.Context) oe.DbError {
+		return w.writer.UpdateMapping(ctx, mappingId, url, from)
+	})
+}
 
-	w.writer.Logger.Error("registering controller failed, retry limit reached", zap.Error(err))
+// DeleteMapping deletes a mapping with retries and backoff.
+func (w *WriterPerfectionist) DeleteMapping(ctx context.Context, mappingId string) error {
+	return w.write(ctx, "DeleteMapping", func(ctx context.Context) oe.DbError {
+		return w.writer.DeleteMapping(ctx, mappingId)
+	})
+}
 
-	return err
+// AppendAuditEntry appends an entry to the audit log with retries and backoff.
+func (w *WriterPerfectionist) AppendAuditEntry(ctx context.Context, entry AuditEntry) error {
+	return w.write(ctx, "AppendAuditEntry", func(ctx context.Context) oe.DbError {
+		return w.writer.AppendAuditEntry(ctx, entry)
+	})
 }
@@ -10,6 +10,7 @@ import (
 	"github.com/google/uuid"
 	guuid "github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"go.uber.org/zap"
@@ -30,7 +31,7 @@ func (w *Writer) RemoveWorker(ctx context.Context, uuid pgtype.UUID) oe.DbError
 
 	tx, err := w.Pool.BeginTx(ctx, pgx.TxOptions{})
 	if err != nil {
-		return oe.DbError{Err: fmt.Errorf("beginning transaction: %w", err), Reconcilable: true}
+		return utils.ClassifyDbError(fmt.Errorf("beginning transaction: %w", err))
 	}
 
 	defer tx.Rollback(ctx)
@@ -43,7 +44,7 @@ func (w *Writer) RemoveWorker(ctx context.Context, uuid pgtype.UUID) oe.DbError
 
 	commitErr := tx.Commit(ctx)
 	if commitErr != nil {
-		return oe.DbError{Err: fmt.Errorf("committing transaction failed: %w", commitErr), Reconcilable: true}
+		return utils.ClassifyDbError(fmt.Errorf("committing transaction failed: %w", commitErr))
 	}
 
 	w.Logger.Debug("successfully removed worker", zap.String("worker_uuid", uuid.String()))
@@ -53,422 +54,586 @@ func (w *Writer) RemoveWorker(ctx context.Context, uuid pgtype.UUID) oe.DbError
 // AddMigrationWorker adds a new migration worker to the database with the specified UUID, from, and to values.
 func (w *Writer) AddMigrationWorker(ctx context.Context, uuid, from, to string) oe.DbError {
 
-	tx, err := w.Pool.BeginTx(ctx, pgx.TxOptions{})
-	if err != nil {
-		return oe.DbError{Err: fmt.Errorf("beginning transaction: %w", err), Reconcilable: true}
+	if txErr := w.Transaction(ctx, "AddMigrationWorker", func(uow *UnitOfWork) oe.DbError {
+		return uow.AddMigrationWorker(uuid, from, to)
+	}); txErr.Err != nil {
+		return txErr
 	}
 
-	defer tx.Rollback(ctx)
+	w.Logger.Debug("successfully added migration worker", zap.String("worker_uuid", uuid))
+	return oe.DbError{Err: nil}
+
+}
+
+// RemoveMigrationWorker removes a migration worker from the database by UUID.
+// Its join rows are removed in the same serializable transaction, the worker might not have any anymore.
+func (w *Writer) RemoveMigrationWorker(ctx context.Context, uuid string) oe.DbError {
+
+	if txErr := w.Transaction(ctx, "RemoveMigrationWorker", func(uow *UnitOfWork) oe.DbError {
+		return uow.RetireMigrationWorker(uuid)
+	}); txErr.Err != nil {
+		return txErr
+	}
+
+	w.Logger.Debug("successfully removed migration worker", zap.String("worker_uuid", uuid))
+	return oe.DbError{Err: nil}
+
+}
 
-	parsed, err := guuid.Parse(uuid)
+// AddWorkerJobJoin adds a relationship between a worker and a migration job in the database.
+func (w *Writer) AddWorkerJobJoin(ctx context.Context, workerId, migrationId string) oe.DbError {
+
+	if txErr := w.Transaction(ctx, "AddWorkerJobJoin", func(uow *UnitOfWork) oe.DbError {
+		return uow.AddWorkerJobJoin(workerId, migrationId)
+	}); txErr.Err != nil {
+		return txErr
+	}
+
+	w.Logger.Debug("successfully added relationship between worker and migration job", zap.String("workerId", workerId), zap.String("jobId", migrationId))
+	return oe.DbError{Err: nil}
+}
+
+// AddDatabaseMapping adds a new mapping for a range to a database URL in the mapping table.
+// Executes within a transaction and logs the result. Returns an error if the operation fails.
+func (w *Writer) AddDatabaseMapping(from, url string, ctx context.Context) oe.DbError {
+
+	tx, err := w.Pool.BeginTx(ctx, pgx.TxOptions{})
 	if err != nil {
-		return oe.DbError{Err: fmt.Errorf("could not parse uuid"), Reconcilable: false}
+		return utils.ClassifyDbError(fmt.Errorf("beginning transaction: %w", err))
 	}
 
+	defer tx.Rollback(ctx)
+
 	q := database.New(tx)
-	args := database.AddMigrationWorkerParams{
+	params := database.CreateMappingParams{
 		ID: pgtype.UUID{
-			Bytes: parsed,
+			Bytes: uuid.New(),
 			Valid: true,
 		},
-		LastHeartbeat: pgtype.Timestamptz{
-			Time:             time.Now(),
-			InfinityModifier: 0,
-			Valid:            true,
-		},
-		Uptime: pgtype.Interval{
-			Microseconds: 0,
-			Days:         0,
-			Months:       0,
-			Valid:        true,
-		},
-		WorkingOnFrom: pgtype.Text{
-			String: from,
-			Valid:  true,
-		},
-		WorkingOnTo: pgtype.Text{
-			String: to,
-			Valid:  true,
-		},
+		Url:  url,
+		From: from,
 	}
-	execRes, execErr := q.AddMigrationWorker(ctx, args)
+	execRes, execErr := q.CreateMapping(ctx, params)
 	if oeErr := utils.Must(execRes, execErr); oeErr.Err != nil {
 		return oeErr
 	}
-	w.Logger.Debug("changed rows", zap.Int64("count", execRes.RowsAffected()))
 
 	commitErr := tx.Commit(ctx)
 	if commitErr != nil {
-		return oe.DbError{Err: fmt.Errorf("committing transaction failed: %w", commitErr), Reconcilable: true}
+		return utils.ClassifyDbError(fmt.Errorf("committing transaction failed: %w", commitErr))
 	}
 
-	w.Logger.Debug("successfully added migration worker", zap.String("worker_uuid", uuid))
+	w.Logger.Debug("successfully added database mapping", zap.String("from", from), zap.String("url", url))
 	return oe.DbError{Err: nil}
+}
 
+// MigrationJobAddReq is a struct that holds the parameters required to add a migration job.
+type MigrationJobAddReq struct {
+	From, To, Url, MWorkerId string
 }
 
-// RemoveMigrationWorker removes a migration worker from the database by UUID.
-func (w *Writer) RemoveMigrationWorker(ctx context.Context, uuid string) oe.DbError {
+// AddMigrationJob takes a range with a given id from the mapping table and transfers it into the migrations table,
+// marking it to be migrated by the migration worker specified through the id. Executes within a transaction.
+// Returns an error if the operation fails.
+func (w *Writer) AddMigrationJob(ctx context.Context, addReq MigrationJobAddReq, migrationJobId uuid.UUID) oe.DbError {
+
+	if txErr := w.Transaction(ctx, "AddMigrationJob", func(uow *UnitOfWork) oe.DbError {
+		return uow.AddMigrationJob(addReq, migrationJobId)
+	}); txErr.Err != nil {
+		return txErr
+	}
+
+	w.Logger.Info("successfully added migration job", zap.String("from", addReq.From), zap.String("to", addReq.To), zap.String("worker_id", addReq.MWorkerId))
+	return oe.DbError{Err: nil}
+}
+
+// Heartbeat renews the heartbeat of the controller with the given id, the scaling state stays in the row.
+// If the row belongs to another controller, because a shadow took over while this one could not heartbeat,
+// it fails with ErrLeadershipLost, which is not reconcilable, so the supervisor demotes the controller right away.
+func (w *Writer) Heartbeat(ctx context.Context, controllerId string) oe.DbError {
+
+	w.Logger.Debug("attempting to update heartbeat", zap.Time("timestamp", time.Now()))
 
 	tx, err := w.Pool.BeginTx(ctx, pgx.TxOptions{})
 	if err != nil {
-		return oe.DbError{Err: fmt.Errorf("beginning transaction: %w", err), Reconcilable: true}
+		return utils.ClassifyDbError(fmt.Errorf("beginning transaction: %w", err))
 	}
 
 	defer tx.Rollback(ctx)
 
-	parsed, err := guuid.Parse(uuid)
+	q := database.New(tx)
+	if oeErr := claimed(q.RenewControllerHeartbeat(ctx, controllerId)); oeErr.Err != nil {
+		return oeErr
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return utils.ClassifyDbError(fmt.Errorf("committing transaction failed: %w", commitErr))
+	}
+
+	w.Logger.Debug("successfully updated controller heartbeat")
+	return oe.DbError{Err: nil}
+}
+
+// RegisterController makes the controller with the given id the leader. The row is only taken over if it still belongs to the
+// controller read at the start and that controllers heartbeat is older than heartbeatTimeout, both checked by the UPDATE itself.
+// Postgres locks the row for the first of several controllers registering at once, the others see its id once it committed
+// and update nothing. If there was no controller before, the singleton index lets only one INSERT through.
+// Losing either race fails with ErrLeadershipLost.
+func (w *Writer) RegisterController(ctx context.Context, controllerId string, heartbeatTimeout time.Duration) oe.DbError {
+
+	tx, err := w.Pool.BeginTx(ctx, pgx.TxOptions{})
 	if err != nil {
-		return oe.DbError{Err: fmt.Errorf("could not parse uuid"), Reconcilable: false}
+		return utils.ClassifyDbError(fmt.Errorf("beginning transaction: %w", err))
 	}
 
+	defer tx.Rollback(ctx)
+
 	q := database.New(tx)
 
-	args := database.DeleteWorkerJobJoinParams{
-		WorkerID: pgtype.UUID{
-			Bytes: parsed,
-			Valid: true,
-		},
-	}
-	execRes, execErr := q.DeleteWorkerJobJoin(ctx, args)
-	if oeErr := utils.Must(execRes, execErr); oeErr.Err != nil {
-		return oeErr
-	}
+	state, queryErr := q.GetControllerState(ctx)
+	switch {
+	case queryErr == nil:
+		// Controller takeover: claim the row of the old controller, if it is still dead
+		if oeErr := claimed(q.ClaimControllerLeadership(ctx, database.ClaimControllerLeadershipParams{
+			ControllerID:    controllerId,
+			OldControllerID: state.ControllerID,
+			TimeoutSeconds:  heartbeatTimeout.Seconds(),
+		})); oeErr.Err != nil {
+			return oeErr
+		}
 
-	execRes, execErr = q.DeleteMigrationWorker(ctx, pgtype.UUID{
-		Bytes: parsed,
-		Valid: true,
-	})
-	if oeErr := utils.Must(execRes, execErr); oeErr.Err != nil {
-		return oeErr
+	case errors.Is(queryErr, pgx.ErrNoRows):
+		// No previous controller found
+		w.Logger.Debug("there has not been a controller before, starting the bloodline")
+		if oeErr := claimed(q.CreateControllerLeadership(ctx, controllerId)); oeErr.Err != nil {
+			return oeErr
+		}
+
+	default:
+		// Unexpected error
+		return utils.ClassifyDbError(fmt.Errorf("getting controller state failed, but err was not 'no rows': %w", queryErr))
 	}
 
 	commitErr := tx.Commit(ctx)
 	if commitErr != nil {
-		return oe.DbError{Err: fmt.Errorf("committing transaction failed: %w", commitErr), Reconcilable: true}
+		return utils.ClassifyDbError(fmt.Errorf("committing transaction failed: %w", commitErr))
 	}
 
-	w.Logger.Debug("successfully removed migration worker", zap.String("worker_uuid", uuid))
+	w.Logger.Debug("successfully registered controller", zap.String("controllerId", controllerId), zap.String("previous", state.ControllerID.String))
 	return oe.DbError{Err: nil}
+}
 
+// claimed classifies a statement on the controller row, for which zero affected rows mean the row belongs to another controller
+func claimed(execRes pgconn.CommandTag, execErr error) oe.DbError {
+	if execErr != nil {
+		return utils.ClassifyDbError(execErr)
+	}
+
+	if execRes.RowsAffected() == 0 {
+		return oe.DbError{Err: oe.ErrLeadershipLost, Kind: oe.DbErrNoRows, Reconcilable: false}
+	}
+
+	return oe.DbError{Err: nil}
 }
 
-// AddWorkerJobJoin adds a relationship between a worker and a migration job in the database.
-func (w *Writer) AddWorkerJobJoin(ctx context.Context, workerId, migrationId string) oe.DbError {
+// MigrationStatus values of the db_migration table. Jobs in "done" or "failed" are terminal and will not be picked up again.
+// Jobs in "queued" have no migration worker and wait for their next attempt.
+const (
+	MigrationStatusQueued  = "queued"
+	MigrationStatusWaiting = "waiting"
+	MigrationStatusRunning = "running"
+	MigrationStatusDone    = "done"
+	MigrationStatusFailed  = "failed"
+)
+
+// ReassignMigrationJob moves a migration job to another migration worker, resetting it to "waiting" and recording the reason.
+// This counts as a new attempt of the job. The join row between worker and job is moved in the same serializable transaction.
+func (w *Writer) ReassignMigrationJob(ctx context.Context, jobId, workerId, reason string) oe.DbError {
+
+	if txErr := w.Transaction(ctx, "ReassignMigrationJob", func(uow *UnitOfWork) oe.DbError {
+		return uow.ReassignMigrationJob(jobId, workerId, reason)
+	}); txErr.Err != nil {
+		return txErr
+	}
+
+	w.Logger.Debug("successfully reassigned migration job", zap.String("jobId", jobId), zap.String("workerId", workerId))
+	return oe.DbError{Err: nil}
+}
+
+// SetMigrationJobReason records why the controller took (or did not take) action on a migration job without changing its status.
+func (w *Writer) SetMigrationJobReason(ctx context.Context, jobId, reason string) oe.DbError {
 
 	tx, err := w.Pool.BeginTx(ctx, pgx.TxOptions{})
 	if err != nil {
-		return oe.DbError{Err: fmt.Errorf("beginning transaction: %w", err), Reconcilable: true}
+		return utils.ClassifyDbError(fmt.Errorf("beginning transaction: %w", err))
 	}
 
 	defer tx.Rollback(ctx)
 
-	workerParsed, err := guuid.Parse(workerId)
-	migrationParsed, err := guuid.Parse(migrationId)
+	parsed, err := guuid.Parse(jobId)
 	if err != nil {
-		return oe.DbError{Err: fmt.Errorf("could not parse uuid: %v", err), Reconcilable: false}
+		return oe.DbError{Err: fmt.Errorf("could not parse uuid"), Kind: oe.DbErrInvalid, Reconcilable: false}
 	}
 
 	q := database.New(tx)
-	params := database.CreateWorkerJobJoinParams{
-		WorkerID: pgtype.UUID{
-			Bytes: workerParsed,
-			Valid: true,
-		},
-		MigrationID: pgtype.UUID{
-			Bytes: migrationParsed,
-			Valid: true,
-		},
-	}
-	execRes, execErr := q.CreateWorkerJobJoin(ctx, params)
+	execRes, execErr := q.SetMigrationJobReason(ctx, database.SetMigrationJobReasonParams{
+		ID:           pgtype.UUID{Bytes: parsed, Valid: true},
+		StatusReason: pgtype.Text{String: reason, Valid: true},
+	})
 	if oeErr := utils.Must(execRes, execErr); oeErr.Err != nil {
 		return oeErr
 	}
 
 	commitErr := tx.Commit(ctx)
 	if commitErr != nil {
-		return oe.DbError{Err: fmt.Errorf("committing transaction failed: %w", commitErr), Reconcilable: true}
+		return utils.ClassifyDbError(fmt.Errorf("committing transaction failed: %w", commitErr))
 	}
 
-	w.Logger.Debug("successfully added relationship between worker and migration job", zap.String("workerId", workerId), zap.String("jobId", migrationId))
+	w.Logger.Debug("successfully set migration job reason", zap.String("jobId", jobId), zap.String("reason", reason))
 	return oe.DbError{Err: nil}
 }
 
-// RemoveMWorkerAndJobs removes a migration worker and all its associated jobs from the database.
-func (w *Writer) RemoveMWorkerAndJobs(ctx context.Context, workerId string) oe.DbError {
+// FailMigrationJob moves a migration job into the terminal "failed" state and records the reason.
+// The job is detached from its migration worker in the same serializable transaction, so the worker can be removed or retired.
+func (w *Writer) FailMigrationJob(ctx context.Context, jobId, reason string) oe.DbError {
 
-	tx, err := w.Pool.BeginTx(ctx, pgx.TxOptions{})
+	parsed, err := guuid.Parse(jobId)
 	if err != nil {
-		return oe.DbError{Err: fmt.Errorf("beginning transaction: %w", err), Reconcilable: true}
+		return oe.DbError{Err: fmt.Errorf("could not parse uuid"), Kind: oe.DbErrInvalid, Reconcilable: false}
 	}
 
-	defer tx.Rollback(ctx)
+	jobUUID := pgtype.UUID{Bytes: parsed, Valid: true}
 
-	parsed, err := guuid.Parse(workerId)
-	if err != nil {
-		return oe.DbError{Err: fmt.Errorf("could not parse uuid"), Reconcilable: false}
-	}
+	txErr := w.serializable(ctx, "FailMigrationJob", func(q *database.Queries) oe.DbError {
 
-	//In one transaction, remove the jobs first and then the migration worker (else there will be a fk constraint err)
-	q := database.New(tx)
+		execRes, execErr := q.FailMigrationJob(ctx, database.FailMigrationJobParams{
+			ID:           jobUUID,
+			StatusReason: pgtype.Text{String: reason, Valid: true},
+		})
+		if oeErr := utils.Must(execRes, execErr); oeErr.Err != nil {
+			return oeErr
+		}
 
-	args := database.DeleteWorkerJobJoinParams{
-		WorkerID: pgtype.UUID{
-			Bytes: parsed,
-			Valid: true,
-		},
-	}
-	execRes, execErr := q.DeleteWorkerJobJoin(ctx, args)
-	if oeErr := utils.Must(execRes, execErr); oeErr.Err != nil {
-		return oeErr
+		//the job might not have a worker anymore
+		return utils.Optional(q.DeleteWorkerJobJoin(ctx, database.DeleteWorkerJobJoinParams{MigrationID: jobUUID}))
+	})
+	if txErr.Err != nil {
+		return txErr
 	}
 
-	execRes, execErr = q.DeleteWorkerJob(ctx, pgtype.UUID{
-		Bytes: parsed,
-		Valid: true,
-	})
-	if oeErr := utils.Must(execRes, execErr); oeErr.Err != nil {
-		return oeErr
+	w.Logger.Info("marked migration job as failed", zap.String("jobId", jobId), zap.String("reason", reason))
+	return oe.DbError{Err: nil}
+}
+
+// MarkDbInstanceUnhealthy marks a database instance as unhealthy, so it is no longer used for placement.
+// If the instance is already marked, the original time and reason are kept.
+func (w *Writer) MarkDbInstanceUnhealthy(ctx context.Context, url, reason string) oe.DbError {
+
+	tx, err := w.Pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return utils.ClassifyDbError(fmt.Errorf("beginning transaction: %w", err))
 	}
 
-	w.Logger.Debug("successfully removed worker jobs", zap.String("workerId", workerId))
+	defer tx.Rollback(ctx)
+
+	q := database.New(tx)
 
-	execRes, execErr = q.DeleteMigrationWorker(ctx, pgtype.UUID{
-		Bytes: parsed,
-		Valid: true,
+	//zero affected rows means the instance was already marked, which is fine here
+	execRes, execErr := q.MarkDbInstanceUnhealthy(ctx, database.MarkDbInstanceUnhealthyParams{
+		Url:             url,
+		UnhealthyReason: pgtype.Text{String: reason, Valid: true},
 	})
-	if oeErr := utils.Must(execRes, execErr); oeErr.Err != nil {
+	if oeErr := utils.Optional(execRes, execErr); oeErr.Err != nil {
 		return oeErr
 	}
 
 	commitErr := tx.Commit(ctx)
 	if commitErr != nil {
-		return oe.DbError{Err: fmt.Errorf("committing transaction failed: %w", commitErr), Reconcilable: true}
+		return utils.ClassifyDbError(fmt.Errorf("committing transaction failed: %w", commitErr))
 	}
 
-	w.Logger.Debug("successfully removed migration worker and its jobs", zap.String("worker_uuid", workerId))
+	w.Logger.Info("marked database instance as unhealthy", zap.String("url", url), zap.String("reason", reason))
 	return oe.DbError{Err: nil}
-
 }
 
-// AddDatabaseMapping adds a new mapping for a range to a database URL in the mapping table.
-// Executes within a transaction and logs the result. Returns an error if the operation fails.
-func (w *Writer) AddDatabaseMapping(from, url string, ctx context.Context) oe.DbError {
+// ClearDbInstanceUnhealthy removes the unhealthy mark of a database instance, making it available for placement again.
+func (w *Writer) ClearDbInstanceUnhealthy(ctx context.Context, url string) oe.DbError {
 
 	tx, err := w.Pool.BeginTx(ctx, pgx.TxOptions{})
 	if err != nil {
-		return oe.DbError{Err: fmt.Errorf("beginning transaction: %w", err), Reconcilable: true}
+		return utils.ClassifyDbError(fmt.Errorf("beginning transaction: %w", err))
 	}
 
 	defer tx.Rollback(ctx)
 
 	q := database.New(tx)
-	params := database.CreateMappingParams{
-		ID: pgtype.UUID{
-			Bytes: uuid.New(),
-			Valid: true,
-		},
-		Url:  url,
-		From: from,
-	}
-	execRes, execErr := q.CreateMapping(ctx, params)
+	execRes, execErr := q.ClearDbInstanceUnhealthy(ctx, url)
 	if oeErr := utils.Must(execRes, execErr); oeErr.Err != nil {
 		return oeErr
 	}
 
 	commitErr := tx.Commit(ctx)
 	if commitErr != nil {
-		return oe.DbError{Err: fmt.Errorf("committing transaction failed: %w", commitErr), Reconcilable: true}
+		return utils.ClassifyDbError(fmt.Errorf("committing transaction failed: %w", commitErr))
 	}
 
-	w.Logger.Debug("successfully added database mapping", zap.String("from", from), zap.String("url", url))
+	w.Logger.Info("cleared unhealthy mark of database instance", zap.String("url", url))
 	return oe.DbError{Err: nil}
 }
 
-// MigrationJobAddReq is a struct that holds the parameters required to add a migration job.
-type MigrationJobAddReq struct {
-	From, To, Url, MWorkerId string
-}
-
-// AddMigrationJob takes a range with a given id from the mapping table and transfers it into the migrations table,
-// marking it to be migrated by the migration worker specified through the id. Executes within a transaction.
-// Returns an error if the operation fails.
-func (w *Writer) AddMigrationJob(ctx context.Context, addReq MigrationJobAddReq, migrationJobId uuid.UUID) oe.DbError {
+// StoreFailureReport persists the serialized report of a failure rate check and, in the same transaction,
+// deletes all reports that were generated before retainSince.
+func (w *Writer) StoreFailureReport(ctx context.Context, generatedAt time.Time, flaggedCount int, report []byte, retainSince time.Time) oe.DbError {
 
 	tx, err := w.Pool.BeginTx(ctx, pgx.TxOptions{})
 	if err != nil {
-		return oe.DbError{Err: fmt.Errorf("beginning transaction: %w", err), Reconcilable: true}
+		return utils.ClassifyDbError(fmt.Errorf("beginning transaction: %w", err))
 	}
 
 	defer tx.Rollback(ctx)
 
-	parsed, err := guuid.Parse(addReq.MWorkerId)
-	if err != nil {
-		return oe.DbError{Err: fmt.Errorf("could not parse uuid"), Reconcilable: false}
-	}
-
 	q := database.New(tx)
-	params := database.CreateMigrationJobParams{
-		ID: pgtype.UUID{
-			Bytes: migrationJobId,
-			Valid: true,
-		},
-		Url: addReq.Url,
-		MWorkerID: pgtype.UUID{
-			Bytes: parsed,
-			Valid: true,
-		},
-		From:   addReq.From,
-		To:     addReq.To,
-		Status: "waiting", //status after creation always waiting
-	}
-	execRes, execErr := q.CreateMigrationJob(ctx, params)
+	execRes, execErr := q.CreateFailureReport(ctx, database.CreateFailureReportParams{
+		ID:           pgtype.UUID{Bytes: guuid.New(), Valid: true},
+		GeneratedAt:  pgtype.Timestamptz{Time: generatedAt, Valid: true},
+		FlaggedCount: int32(flaggedCount),
+		Report:       report,
+	})
 	if oeErr := utils.Must(execRes, execErr); oeErr.Err != nil {
 		return oeErr
 	}
 
+	//there is nothing to prune most of the time, so zero affected rows are fine here
+	execRes, execErr = q.DeleteFailureReportsBefore(ctx, pgtype.Timestamptz{Time: retainSince, Valid: true})
+	if oeErr := utils.Optional(execRes, execErr); oeErr.Err != nil {
+		return oeErr
+	}
+
 	commitErr := tx.Commit(ctx)
 	if commitErr != nil {
-		return oe.DbError{Err: fmt.Errorf("committing transaction failed: %w", commitErr), Reconcilable: true}
+		return utils.ClassifyDbError(fmt.Errorf("committing transaction failed: %w", commitErr))
 	}
 
-	w.Logger.Info("successfully added migration job", zap.String("from", addReq.From), zap.String("to", addReq.To), zap.String("worker_id", addReq.MWorkerId))
+	w.Logger.Debug("successfully stored failure report", zap.Time("generatedAt", generatedAt), zap.Int64("pruned", execRes.RowsAffected()))
 	return oe.DbError{Err: nil}
 }
 
-// DeleteDbConnErrors deletes database connection error records for a given database URL, worker ID, and failure time.
-// Executes within a transaction and logs the result. Returns an error if the operation fails.
-func (w *Writer) DeleteDbConnErrors(ctx context.Context, dbUrl pgtype.Text, workerId pgtype.UUID, failTime pgtype.Timestamptz) oe.DbError {
+// PurgeDBConnErrors deletes up to batchSize database connection errors that happened before the given time and returns how many it deleted.
+// Each batch is its own short transaction, so purging a large backlog does not hold locks on the table for long.
+func (w *Writer) PurgeDBConnErrors(ctx context.Context, before time.Time, batchSize int) (int64, oe.DbError) {
 
 	tx, err := w.Pool.BeginTx(ctx, pgx.TxOptions{})
 	if err != nil {
-		return oe.DbError{Err: fmt.Errorf("beginning transaction: %w", err), Reconcilable: true}
+		return 0, utils.ClassifyDbError(fmt.Errorf("beginning transaction: %w", err))
 	}
 
 	defer tx.Rollback(ctx)
 
 	q := database.New(tx)
-	params := database.DeleteDBConnErrorParams{
-		DbUrl:    dbUrl,
-		WorkerID: workerId,
-		FailTime: failTime,
-	}
 
-	execRes, execErr := q.DeleteDBConnError(ctx, params)
-	if oeErr := utils.Must(execRes, execErr); oeErr.Err != nil {
-		return oeErr
+	//zero affected rows just means nothing was old enough
+	execRes, execErr := q.DeleteDBConnErrorsBatch(ctx, database.DeleteDBConnErrorsBatchParams{
+		Before:    pgtype.Timestamptz{Time: before, Valid: true},
+		BatchSize: int32(batchSize),
+	})
+	if oeErr := utils.Optional(execRes, execErr); oeErr.Err != nil {
+		return 0, oeErr
 	}
 
 	commitErr := tx.Commit(ctx)
 	if commitErr != nil {
-		return oe.DbError{Err: fmt.Errorf("committing transaction failed: %w", commitErr), Reconcilable: true}
+		return 0, utils.ClassifyDbError(fmt.Errorf("committing transaction failed: %w", commitErr))
+	}
+
+	w.Logger.Debug("successfully purged old db conn errors", zap.Time("before", before), zap.Int64("deleted", execRes.RowsAffected()))
+	return execRes.RowsAffected(), oe.DbError{Err: nil}
+}
+
+// RetireMigrationWorker removes a migration worker that no longer has a migration job, e.g. because its job was reassigned.
+// Like RemoveMigrationWorker, it does not require a join row to exist.
+func (w *Writer) RetireMigrationWorker(ctx context.Context, workerId string) oe.DbError {
+
+	if txErr := w.Transaction(ctx, "RetireMigrationWorker", func(uow *UnitOfWork) oe.DbError {
+		return uow.RetireMigrationWorker(workerId)
+	}); txErr.Err != nil {
+		return txErr
 	}
 
-	w.Logger.Debug("successfully deleted db connection errors", zap.String("db_url", dbUrl.String), zap.String("worker_id", workerId.String()), zap.Time("fail_time", failTime.Time))
+	w.Logger.Debug("successfully retired migration worker", zap.String("workerId", workerId))
 	return oe.DbError{Err: nil}
 }
 
-// Heartbeat updates the controller's heartbeat in the database, carrying over the scaling state.
-// Deletes the old heartbeat and creates a new one in a transaction. Returns an error if the operation fails.
-func (w *Writer) Heartbeat(ctx context.Context) oe.DbError {
+// RequeueMigrationJob detaches a migration job from its migration worker and queues it for another attempt at nextAttemptAt.
+// Both happen in one serializable transaction.
+func (w *Writer) RequeueMigrationJob(ctx context.Context, jobId string, nextAttemptAt time.Time, reason string) oe.DbError {
 
-	w.Logger.Debug("attempting to update heartbeat", zap.Time("timestamp", time.Now()))
+	if txErr := w.Transaction(ctx, "RequeueMigrationJob", func(uow *UnitOfWork) oe.DbError {
+		return uow.RequeueMigrationJob(jobId, nextAttemptAt, reason)
+	}); txErr.Err != nil {
+		return txErr
+	}
+
+	w.Logger.Info("requeued migration job", zap.String("jobId", jobId), zap.Time("nextAttemptAt", nextAttemptAt), zap.String("reason", reason))
+	return oe.DbError{Err: nil}
+}
+
+// DbProbeResult is the result of the controller connecting to a database instance directly
+type DbProbeResult struct {
+	Url       string
+	Reachable bool
+	Latency   time.Duration
+	Err       string
+}
+
+// StoreDbProbes stores the latest probe result of every database instance and, in the same transaction,
+// removes the results of instances that were not probed anymore.
+func (w *Writer) StoreDbProbes(ctx context.Context, results []DbProbeResult) oe.DbError {
 
 	tx, err := w.Pool.BeginTx(ctx, pgx.TxOptions{})
 	if err != nil {
-		return oe.DbError{Err: fmt.Errorf("beginning transaction: %w", err), Reconcilable: true}
+		return utils.ClassifyDbError(fmt.Errorf("beginning transaction: %w", err))
 	}
 
 	defer tx.Rollback(ctx)
 
 	q := database.New(tx)
 
-	state, queryErr := q.GetControllerState(ctx)
-	if queryErr != nil {
-		return oe.DbError{Err: fmt.Errorf("getting old controller state failed: %w", queryErr), Reconcilable: true}
+	urls := make([]string, 0, len(results))
+
+	for _, result := range results {
+
+		params := database.UpsertDbProbeParams{
+			Url:       result.Url,
+			Reachable: result.Reachable,
+			LatencyMs: pgtype.Float8{Float64: float64(result.Latency.Microseconds()) / 1000, Valid: result.Reachable},
+			Error:     pgtype.Text{String: result.Err, Valid: result.Err != ""},
+		}
+
+		execRes, execErr := q.UpsertDbProbe(ctx, params)
+		if oeErr := utils.Must(execRes, execErr); oeErr.Err != nil {
+			return oeErr
+		}
+
+		urls = append(urls, result.Url)
 	}
 
-	execRes, execErr := q.DeleteOldControllerHeartbeat(ctx)
-	if oeErr := utils.Must(execRes, execErr); oeErr.Err != nil {
+	//usually no instance was removed, so zero affected rows are fine here
+	execRes, execErr := q.DeleteDbProbesExcept(ctx, urls)
+	if oeErr := utils.Optional(execRes, execErr); oeErr.Err != nil {
 		return oeErr
 	}
 
-	//carry over the old state of whether the controller is currently scaling or not, we do not want to keep this state locally as the controller can crash at any time
-	params := database.CreateNewControllerHeartbeatParams{
-		Scaling: state.Scaling,
-		LastHeartbeat: pgtype.Timestamptz{
-			Time:             time.Now(),
-			InfinityModifier: 0,
-			Valid:            true,
-		},
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return utils.ClassifyDbError(fmt.Errorf("committing transaction failed: %w", commitErr))
 	}
 
-	execRes, execErr = q.CreateNewControllerHeartbeat(ctx, params)
+	w.Logger.Debug("successfully stored database probes", zap.Int("count", len(results)))
+	return oe.DbError{Err: nil}
+}
+
+// UpdateMapping moves a mapping to another url and/or start of its range, e.g. to repair a mapping invariant.
+func (w *Writer) UpdateMapping(ctx context.Context, mappingId, url, from string) oe.DbError {
+
+	tx, err := w.Pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return utils.ClassifyDbError(fmt.Errorf("beginning transaction: %w", err))
+	}
+
+	defer tx.Rollback(ctx)
+
+	parsed, err := guuid.Parse(mappingId)
+	if err != nil {
+		return oe.DbError{Err: fmt.Errorf("could not parse uuid"), Kind: oe.DbErrInvalid, Reconcilable: false}
+	}
+
+	q := database.New(tx)
+	execRes, execErr := q.UpdateMapping(ctx, database.UpdateMappingParams{
+		ID:   pgtype.UUID{Bytes: parsed, Valid: true},
+		Url:  url,
+		From: from,
+	})
 	if oeErr := utils.Must(execRes, execErr); oeErr.Err != nil {
 		return oeErr
 	}
 
 	commitErr := tx.Commit(ctx)
 	if commitErr != nil {
-		return oe.DbError{Err: fmt.Errorf("committing transaction failed: %w", commitErr), Reconcilable: true}
+		return utils.ClassifyDbError(fmt.Errorf("committing transaction failed: %w", commitErr))
 	}
 
-	w.Logger.Debug("successfully updated controller heartbeat", zap.Bool("scaling", state.Scaling), zap.Time("last_heartbeat", params.LastHeartbeat.Time))
+	w.Logger.Info("updated mapping", zap.String("mappingId", mappingId), zap.String("url", url), zap.String("from", from))
 	return oe.DbError{Err: nil}
 }
 
-// RegisterController registers a new controller instance. Handles controller takeover or first-time registration,
-// updates the heartbeat, and logs the event. Returns an error if the operation fails.
-func (w *Writer) RegisterController(ctx context.Context) oe.DbError {
+// DeleteMapping removes a single mapping, e.g. a duplicate that does not hold any data.
+func (w *Writer) DeleteMapping(ctx context.Context, mappingId string) oe.DbError {
 
 	tx, err := w.Pool.BeginTx(ctx, pgx.TxOptions{})
 	if err != nil {
-		return oe.DbError{Err: fmt.Errorf("beginning transaction: %w", err), Reconcilable: true}
+		return utils.ClassifyDbError(fmt.Errorf("beginning transaction: %w", err))
 	}
 
 	defer tx.Rollback(ctx)
 
-	q := database.New(tx)
+	parsed, err := guuid.Parse(mappingId)
+	if err != nil {
+		return oe.DbError{Err: fmt.Errorf("could not parse uuid"), Kind: oe.DbErrInvalid, Reconcilable: false}
+	}
 
-	state, queryErr := q.GetControllerState(ctx)
-	switch {
-	case queryErr == nil:
-		// Controller takeover: delete the old heartbeat
-		execRes, execErr := q.DeleteOldControllerHeartbeat(ctx)
-		if oeErr := utils.Must(execRes, execErr); oeErr.Err != nil {
-			return oeErr
-		}
+	q := database.New(tx)
+	execRes, execErr := q.DeleteMapping(ctx, pgtype.UUID{Bytes: parsed, Valid: true})
+	if oeErr := utils.Must(execRes, execErr); oeErr.Err != nil {
+		return oeErr
+	}
 
-	case errors.Is(queryErr, pgx.ErrNoRows):
-		// No previous controller found
-		w.Logger.Debug("there has not been a controller before, starting the bloodline")
-		state.Scaling = false
-	case queryErr != nil:
-		// Unexpected error
-		return oe.DbError{Err: fmt.Errorf("getting controller state failed, but err was not 'no rows': %w", queryErr), Reconcilable: true}
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return utils.ClassifyDbError(fmt.Errorf("committing transaction failed: %w", commitErr))
 	}
 
-	//carry over the old state of whether the controller is currently scaling or not, we do not want to keep this state locally as the controller can crash at any time
-	params := database.CreateNewControllerHeartbeatParams{
-		Scaling: state.Scaling,
-		LastHeartbeat: pgtype.Timestamptz{
-			Time:             time.Now(),
-			InfinityModifier: 0,
-			Valid:            true,
-		},
+	w.Logger.Info("deleted mapping", zap.String("mappingId", mappingId))
+	return oe.DbError{Err: nil}
+}
+
+// AuditEntry is a single action of the controller that is appended to the audit log.
+// Before and After are the serialized state of the subject around the action and may be nil.
+type AuditEntry struct {
+	Actor, Action, Subject, ControllerID, TraceID, Reason string
+	Before, After                                         []byte
+}
+
+// AppendAuditEntry appends an entry to the audit log.
+func (w *Writer) AppendAuditEntry(ctx context.Context, entry AuditEntry) oe.DbError {
+
+	tx, err := w.Pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return utils.ClassifyDbError(fmt.Errorf("beginning transaction: %w", err))
 	}
 
-	execRes, execErr := q.CreateNewControllerHeartbeat(ctx, params)
+	defer tx.Rollback(ctx)
+
+	q := database.New(tx)
+	execRes, execErr := q.CreateAuditEntry(ctx, database.CreateAuditEntryParams{
+		Actor:        entry.Actor,
+		Action:       entry.Action,
+		Subject:      entry.Subject,
+		ControllerID: entry.ControllerID,
+		TraceID:      pgtype.Text{String: entry.TraceID, Valid: entry.TraceID != ""},
+		Reason:       pgtype.Text{String: entry.Reason, Valid: entry.Reason != ""},
+		Before:       entry.Before,
+		After:        entry.After,
+	})
 	if oeErr := utils.Must(execRes, execErr); oeErr.Err != nil {
 		return oeErr
 	}
 
 	commitErr := tx.Commit(ctx)
 	if commitErr != nil {
-		return oe.DbError{Err: fmt.Errorf("committing transaction failed: %w", commitErr), Reconcilable: true}
+		return utils.ClassifyDbError(fmt.Errorf("committing transaction failed: %w", commitErr))
 	}
 
-	w.Logger.Debug("successfully updated controller heartbeat for new controller", zap.Bool("scaling", state.Scaling), zap.Time("last_heartbeat", params.LastHeartbeat.Time))
+	w.Logger.Debug("successfully appended audit entry", zap.String("action", entry.Action), zap.String("subject", entry.Subject))
 	return oe.DbError{Err: nil}
-
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/network"
 	dockerclient "github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
@@ -21,6 +22,9 @@ type DInterface struct {
 	mWorkerChan chan CreateRequest
 }
 
+// MWorkerIdLabel is the container label under which the id of a migration worker is stored, so its container can be found again
+const MWorkerIdLabel = "matrix.migration-worker.id"
+
 // CreateRequest represents a request to create migration worker.
 type CreateRequest struct {
 	ctx          context.Context
@@ -59,10 +63,19 @@ func (d *DInterface) Ping(ctx context.Context) error {
 }
 
 // Run starts the main loop of the DInterface, which listens for requests to create migration workers.
-func (d *DInterface) Run() {
+// It returns once the context is canceled.
+func (d *DInterface) Run(ctx context.Context) error {
 
 	for {
-		req := <-d.mWorkerChan //accept requests to create migration worker
+		var req CreateRequest
+
+		select {
+		case <-ctx.Done():
+			d.logger.Info("stopped accepting requests to start migration workers")
+			return nil
+		case req = <-d.mWorkerChan: //accept requests to create migration worker
+		}
+
 		d.logger.Info("received request to start new migration worker")
 
 		funcRes := make(chan error, 1)
@@ -101,6 +114,58 @@ func (d *DInterface) SendMWorkerRequest(ctx context.Context, workerId string) Cr
 
 }
 
+// MigrationWorkerRunning checks if there is a running container for the migration worker with the given id.
+func (d *DInterface) MigrationWorkerRunning(ctx context.Context, workerId string) (bool, error) {
+
+	containers, err := d.client.ContainerList(ctx, container.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", MWorkerIdLabel+"="+workerId)),
+	})
+	if err != nil {
+		return false, fmt.Errorf("could not list containers: %w", err)
+	}
+
+	for _, c := range containers {
+		if c.State == container.StateRunning {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// StopMigrationWorker stops and removes every container of the migration worker with the given id, running or not.
+// The worker gets M_WORKER_STOP_TIMEOUT seconds to shut down before it is killed. A worker without a container is already stopped.
+// The returned error means a container may still be running, a container that stopped but could not be removed is only logged.
+func (d *DInterface) StopMigrationWorker(ctx context.Context, workerId string) error {
+
+	containers, err := d.client.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", MWorkerIdLabel+"="+workerId)),
+	})
+	if err != nil {
+		return fmt.Errorf("could not list containers: %w", err)
+	}
+
+	stopTimeout := goutils.Log().ParseEnvIntDefault("M_WORKER_STOP_TIMEOUT", 10, d.logger)
+
+	for _, c := range containers {
+
+		if c.State == container.StateRunning {
+			if stopErr := d.client.ContainerStop(ctx, c.ID, container.StopOptions{Timeout: &stopTimeout}); stopErr != nil {
+				return fmt.Errorf("could not stop container %s: %w", c.ID, stopErr)
+			}
+		}
+
+		if removeErr := d.client.ContainerRemove(ctx, c.ID, container.RemoveOptions{}); removeErr != nil {
+			d.logger.Warn("could not remove stopped migration worker container", zap.String("containerId", c.ID), zap.Error(removeErr))
+		}
+	}
+
+	d.logger.Debug("stopped migration worker", zap.String("workerId", workerId), zap.Int("containers", len(containers)))
+
+	return nil
+}
+
 // startMigrationWorker creates and starts a Docker container for the migration worker.
 func (d *DInterface) startMigrationWorker(req CreateRequest) error {
 
@@ -139,6 +204,9 @@ func (d *DInterface) startMigrationWorker(req CreateRequest) error {
 func createContainerConfig(imageTag string, workerId string) *container.Config {
 	return &container.Config{
 		Image: imageTag,
+		Labels: map[string]string{
+			MWorkerIdLabel: workerId,
+		},
 		ExposedPorts: nat.PortSet{
 			"50052/tcp": struct{}{},
 		},
@@ -2,27 +2,61 @@ package errors
 
 import (
 	"errors"
-	"fmt"
 )
 
 var (
-	ErrRetryLimitReached = errors.New("retry limit was reached")
-	ErrControllerCrashed = errors.New("controller crashed")
-	ErrWhatTheHelly      = errors.New("this error should not be possible")
-	ErrCreateTimeout     = errors.New("request for container creation timed out")
+	ErrRetryLimitReached  = errors.New("retry limit was reached")
+	ErrControllerCrashed  = errors.New("controller crashed")
+	ErrWhatTheHelly       = errors.New("this error should not be possible")
+	ErrCreateTimeout      = errors.New("request for container creation timed out")
+	ErrDegradedMode       = errors.New("controller is in degraded read-only mode")
+	ErrNoRangeForKey      = errors.New("no range covers the key")
+	ErrDatabaseUnhealthy  = errors.New("database instance is marked unhealthy")
+	ErrCircuitOpen        = errors.New("circuit breaker for postgres is open")
+	ErrMigrationQueued    = errors.New("migration job was queued for a later attempt")
+	ErrSchemaIncompatible = errors.New("database schema is incompatible with this controller")
+	ErrLeadershipLost     = errors.New("controller row belongs to another controller")
+)
+
+// DbErrorKind is the class of a database error as determined by utils.ClassifyDbError
+type DbErrorKind string
+
+const (
+	DbErrUnknown       DbErrorKind = "unknown"
+	DbErrConstraint    DbErrorKind = "constraint-violation"
+	DbErrInvalid       DbErrorKind = "invalid-statement"
+	DbErrNoRows        DbErrorKind = "no-rows"
+	DbErrSerialization DbErrorKind = "serialization-failure"
+	DbErrDeadlock      DbErrorKind = "deadlock"
+	DbErrConnection    DbErrorKind = "connection"
+	DbErrShutdown      DbErrorKind = "admin-shutdown"
+	DbErrResources     DbErrorKind = "insufficient-resources"
+	DbErrQueryTimeout  DbErrorKind = "query-timeout"
+	DbErrCanceled      DbErrorKind = "canceled"
 )
 
 // DbError represents an error that occurred while interacting with the database.
-// It includes the original error and a flag indicating whether the error is reconcilable.
+// It includes the original error, its kind and a flag indicating whether the error is reconcilable, i.e. worth retrying.
 type DbError struct {
 	Err          error
+	Kind         DbErrorKind
 	Reconcilable bool
 }
 
 func (d DbError) Error() string {
 	if d.Reconcilable {
-		return fmt.Sprintf(d.Err.Error() + " - is reconscilable")
+		return d.Err.Error() + " - is reconscilable"
 	}
 
-	return fmt.Sprintf(d.Err.Error() + " - is not reconscilable")
+	return d.Err.Error() + " - is not reconscilable"
+}
+
+func (d DbError) Unwrap() error {
+	return d.Err
+}
+
+// TxRetryable reports whether the whole transaction that failed with this error can simply be run again from the start.
+// Postgres aborts transactions on serialization failures and deadlocks, retrying single statements does not help then.
+func (d DbError) TxRetryable() bool {
+	return d.Kind == DbErrSerialization || d.Kind == DbErrDeadlock
 }
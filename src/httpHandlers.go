@@ -1,45 +1,88 @@
 package main
 
 import (
+	"context"
+	"controller/src/database"
+	ownErrors "controller/src/errors"
 	"controller/src/utils"
 	"encoding/json"
+	"errors"
+	"fmt"
+	goutils "github.com/linusgith/goutils/pkg/env_utils"
 	"go.uber.org/zap"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 )
 
 // RunHttpServer starts the HTTP server for the controller.
 // It sets up handlers for migration, startup mapping, health checks, and system state.
-func (c *Controller) RunHttpServer() {
-	http.Handle("/migrate", c.migrationHandler())
-	http.Handle("/mapping/startup", c.startupMapping())
-	http.Handle("/health", c.health())
-	http.Handle("/state", c.systemStateHandler())
+// The server is shut down gracefully once the context is canceled.
+func (c *Controller) RunHttpServer(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.Handle("/migrate", c.migrationHandler())
+	mux.Handle("/mapping/startup", c.startupMapping())
+	mux.Handle("/health", c.health())
+	mux.Handle("/state", c.systemStateHandler())
+	mux.Handle("/mapping/lookup", c.rangeLookupHandler())
+	mux.Handle("/failures", c.failureReportHandler())
+	mux.Handle("/migrations", c.migrationJobsHandler())
+	mux.Handle("/mapping/repair", c.mappingRepairHandler())
+	mux.Handle("/audit", c.auditHandler())
+	mux.Handle("/tasks", c.tasksHandler())
+	mux.Handle("/metrics", c.metricsHandler())
 
 	var port string
 	var err error
 
 	port = os.Getenv("BASE_HTTP_PORT")
 
-	if c.isShadow {
+	if c.isShadow.Load() {
 		port, err = utils.SetShadowPort(port)
 		if err != nil {
 			c.logger.Warn("could not set appropriate http server port for shadow", zap.Error(err))
 		}
 	}
-	httpServeErr := http.ListenAndServe("0.0.0.0"+":"+port, nil)
-	if err != nil {
-		c.logger.Error("serving http traffic failed", zap.Error(httpServeErr))
-		return
+
+	server := &http.Server{
+		Addr:    "0.0.0.0" + ":" + port,
+		Handler: mux,
 	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+
 	c.logger.Info("Started http server", zap.String("port", port))
+
+	select {
+	case httpServeErr := <-serveErr:
+		c.logger.Error("serving http traffic failed", zap.Error(httpServeErr))
+		return httpServeErr
+	case <-ctx.Done():
+	}
+
+	shutdownTimeout := goutils.Log().ParseEnvDurationDefault("HTTP_SHUTDOWN_TIMEOUT", 5*time.Second, c.logger)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if shutdownErr := server.Shutdown(shutdownCtx); shutdownErr != nil {
+		return fmt.Errorf("shutting down http server failed: %w", shutdownErr)
+	}
+
+	c.logger.Info("Stopped http server")
+	return nil
 }
 
 // systemStateHandler returns an HTTP handler that retrieves the system state.
+// If postgres is unreachable, the last snapshot is served and marked as stale.
 func (c *Controller) systemStateHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		if c.isShadow {
+		if c.isShadow.Load() {
 			c.logger.Warn("use tried sending a request to the shadow, tell him to stop pwease")
 			w.WriteHeader(http.StatusForbidden)
 			return
@@ -47,7 +90,7 @@ func (c *Controller) systemStateHandler() http.HandlerFunc {
 
 		ctx := utils.GenerateCallTraceId(r.Context())
 
-		migrationInfos, stateErr := c.scheduler.GetSystemState(ctx)
+		systemState, stateErr := c.scheduler.GetSystemState(ctx)
 		if stateErr != nil {
 			c.logger.Warn("could not get system state for user request", zap.Any("traceId", ctx.Value("traceId")), zap.Error(stateErr))
 
@@ -55,7 +98,7 @@ func (c *Controller) systemStateHandler() http.HandlerFunc {
 			return
 		}
 
-		jsonBytes, parseErr := json.MarshalIndent(migrationInfos, "", " ")
+		jsonBytes, parseErr := json.MarshalIndent(systemState, "", " ")
 		if parseErr != nil {
 			c.logger.Warn("could not parse migration infos to json", zap.Error(parseErr))
 			w.WriteHeader(http.StatusInternalServerError)
@@ -78,8 +121,14 @@ func (c *Controller) systemStateHandler() http.HandlerFunc {
 func (c *Controller) migrationHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		if c.isShadow {
+		if c.isShadow.Load() {
 			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if degradedErr := c.scheduler.Writable(); degradedErr != nil {
+			c.refuseDegraded(w, degradedErr)
+			return
 		}
 
 		//Get the rangeId from the URL request, fuck request bodies
@@ -100,6 +149,30 @@ func (c *Controller) migrationHandler() http.HandlerFunc {
 		ctx := utils.GenerateCallTraceId(r.Context())
 
 		err := c.scheduler.RunMigration(ctx, from, to, goalUrl)
+		if errors.Is(err, ownErrors.ErrDegradedMode) {
+			c.refuseDegraded(w, err)
+			return
+		}
+		if errors.Is(err, ownErrors.ErrDatabaseUnhealthy) {
+			c.logger.Warn("refusing migration to unhealthy database", zap.String("goalUrl", goalUrl), zap.Error(err))
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusConflict)
+			_, httpErr := w.Write([]byte(err.Error()))
+			if httpErr != nil {
+				c.logger.Warn("could not send http response code to client", zap.Error(httpErr), zap.Int("responseCode", http.StatusConflict))
+			}
+			return
+		}
+		if errors.Is(err, ownErrors.ErrMigrationQueued) {
+			c.logger.Warn("migration was queued instead of started", zap.Error(err))
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusAccepted)
+			_, httpErr := w.Write([]byte(err.Error()))
+			if httpErr != nil {
+				c.logger.Warn("could not send http response code to client", zap.Error(httpErr), zap.Int("responseCode", http.StatusAccepted))
+			}
+			return
+		}
 		if err != nil {
 			c.logger.Error("could not run migration", zap.Error(err))
 			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
@@ -117,16 +190,56 @@ func (c *Controller) migrationHandler() http.HandlerFunc {
 }
 
 // health returns an HTTP handler that checks the health of the controller by pinging the database.
-// Responds with HTTP 200 if the database is reachable, otherwise responds with HTTP 424 (Failed Dependency).
+// Responds with HTTP 200 if the database is reachable, otherwise responds with HTTP 424 (Failed Dependency)
+// and explains that the controller is running in degraded read-only mode.
+// Violated mapping invariants of the last check are listed in the body, they do not fail the health check.
+// The same goes for a postgres circuit breaker that is not closed and for read replicas out of rotation, whose reads go to the primary.
 func (c *Controller) health() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
+		breaker := c.breaker.Status()
+
 		err := c.reconciler.PingDB(r.Context())
 		if err != nil {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 			w.WriteHeader(http.StatusFailedDependency)
+			_, writeErr := w.Write([]byte(ownErrors.ErrDegradedMode.Error() + ": " + err.Error() + "\n" + breakerLine(breaker)))
+			if writeErr != nil {
+				c.logger.Warn("could not write health response", zap.Error(writeErr))
+			}
+			return
+		}
+
+		body := ""
+		if breaker.State != database.BreakerClosed {
+			body += breakerLine(breaker)
+		}
+
+		for _, replica := range c.replicas.Status() {
+			if !replica.InUse {
+				body += replicaLine(replica)
+			}
+		}
+
+		if check, ok := c.scheduler.LatestMappingCheck(); ok && len(check.Violations) > 0 {
+			body += fmt.Sprintf("%d mapping invariant violations at %s:\n", len(check.Violations), check.CheckedAt.Format(time.RFC3339))
+			for _, violation := range check.Violations {
+				body += fmt.Sprintf("- %s: %s\n", violation.Kind, violation.Detail)
+			}
+		}
+
+		if body == "" {
+			w.WriteHeader(http.StatusOK)
 			return
 		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.WriteHeader(http.StatusOK)
+
+		_, writeErr := w.Write([]byte(body))
+		if writeErr != nil {
+			c.logger.Warn("could not write health response", zap.Error(writeErr))
+		}
 	}
 }
 
@@ -134,6 +247,11 @@ func (c *Controller) startupMapping() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
+		if degradedErr := c.scheduler.Writable(); degradedErr != nil {
+			c.refuseDegraded(w, degradedErr)
+			return
+		}
+
 		mapping, err := c.scheduler.CalculateStartupMapping(ctx)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -143,3 +261,331 @@ func (c *Controller) startupMapping() http.HandlerFunc {
 		c.scheduler.ExecuteStartUpMapping(ctx, mapping)
 	}
 }
+
+// rangeLookupHandler returns an HTTP handler that resolves the key given as query parameter to its range and database.
+// If postgres is unreachable, the lookup is answered from the last snapshot and marked as stale.
+func (c *Controller) rangeLookupHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			c.logger.Warn("malformed request was sent, key was empty")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		ctx := utils.GenerateCallTraceId(r.Context())
+
+		lookup, err := c.scheduler.LookupRange(ctx, key)
+		switch {
+		case errors.Is(err, ownErrors.ErrNoRangeForKey):
+			w.WriteHeader(http.StatusNotFound)
+			return
+		case err != nil:
+			c.logger.Warn("could not look up range for key", zap.String("key", key), zap.Any("traceId", ctx.Value("traceID")), zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		jsonBytes, parseErr := json.Marshal(lookup)
+		if parseErr != nil {
+			c.logger.Warn("could not parse range lookup to json", zap.Error(parseErr))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, writeErr := w.Write(jsonBytes)
+		if writeErr != nil {
+			c.logger.Warn("could not write json to http writer", zap.Error(writeErr))
+		}
+	}
+}
+
+// mappingRepairHandler returns an HTTP handler that repairs violated mapping invariants.
+// A GET request only proposes the fixes, a POST request applies all fixes that do not move or drop data.
+func (c *Controller) mappingRepairHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if c.isShadow.Load() {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var apply bool
+
+		switch r.Method {
+		case http.MethodGet:
+			apply = false
+		case http.MethodPost:
+			apply = true
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		ctx := utils.GenerateCallTraceId(r.Context())
+
+		repair, err := c.scheduler.RepairMappings(ctx, apply)
+		if errors.Is(err, ownErrors.ErrDegradedMode) {
+			c.refuseDegraded(w, err)
+			return
+		}
+		if err != nil {
+			c.logger.Warn("could not repair mappings", zap.Any("traceId", ctx.Value("traceID")), zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		jsonBytes, parseErr := json.MarshalIndent(repair, "", " ")
+		if parseErr != nil {
+			c.logger.Warn("could not parse mapping repair to json", zap.Error(parseErr))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, writeErr := w.Write(jsonBytes)
+		if writeErr != nil {
+			c.logger.Warn("could not write json to http writer", zap.Error(writeErr))
+		}
+	}
+}
+
+// migrationJobsHandler returns an HTTP handler that lists all migration jobs with their status, attempts and next attempt.
+// The optional status query parameter restricts the list to one status, e.g. "failed" or "queued".
+func (c *Controller) migrationJobsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if c.isShadow.Load() {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		ctx := utils.GenerateCallTraceId(r.Context())
+
+		jobs, err := c.scheduler.GetMigrationJobs(ctx, r.URL.Query().Get("status"))
+		if err != nil {
+			c.logger.Warn("could not get migration jobs", zap.Any("traceId", ctx.Value("traceID")), zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		jsonBytes, parseErr := json.MarshalIndent(jobs, "", " ")
+		if parseErr != nil {
+			c.logger.Warn("could not parse migration jobs to json", zap.Error(parseErr))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, writeErr := w.Write(jsonBytes)
+		if writeErr != nil {
+			c.logger.Warn("could not write json to http writer", zap.Error(writeErr))
+		}
+	}
+}
+
+// failureReportHandler returns an HTTP handler that serves the failure rate reports.
+// Without parameters, the report of the last failure rate check is returned, or HTTP 204 No Content if no check has completed yet.
+// With the since query parameter, either an RFC3339 timestamp or a duration like "6h", all persisted reports
+// generated since then are returned, oldest first, so trends can be followed over time.
+func (c *Controller) failureReportHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if c.isShadow.Load() {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var body any
+
+		sinceParam := r.URL.Query().Get("since")
+		if sinceParam == "" {
+
+			report, ok := c.reconciler.LatestFailureReport()
+			if !ok {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			body = report
+
+		} else {
+
+			since, parseErr := parseSince(sinceParam)
+			if parseErr != nil {
+				c.logger.Warn("malformed request was sent, since is neither a timestamp nor a duration", zap.String("since", sinceParam))
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			ctx := utils.GenerateCallTraceId(r.Context())
+
+			reports, historyErr := c.reconciler.FailureHistory(ctx, since)
+			if historyErr != nil {
+				c.logger.Warn("could not get failure report history", zap.Any("traceId", ctx.Value("traceID")), zap.Error(historyErr))
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			body = reports
+		}
+
+		jsonBytes, parseErr := json.MarshalIndent(body, "", " ")
+		if parseErr != nil {
+			c.logger.Warn("could not parse failure report to json", zap.Error(parseErr))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, writeErr := w.Write(jsonBytes)
+		if writeErr != nil {
+			c.logger.Warn("could not write json to http writer", zap.Error(writeErr))
+		}
+	}
+}
+
+// auditHandler returns an HTTP handler that pages through the audit log, newest entries first.
+// The optional query parameters are before (the NextBefore of the previous page), limit (default 50, at most 500)
+// and subject (e.g. a worker id, job id, mapping id or database url) to only list the actions taken on it.
+func (c *Controller) auditHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if c.isShadow.Load() {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		query := r.URL.Query()
+
+		var before int64
+		if beforeParam := query.Get("before"); beforeParam != "" {
+			parsed, parseErr := strconv.ParseInt(beforeParam, 10, 64)
+			if parseErr != nil || parsed < 0 {
+				c.logger.Warn("malformed request was sent, before is not a valid entry id", zap.String("before", beforeParam))
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			before = parsed
+		}
+
+		limit := auditDefaultPageSize
+		if limitParam := query.Get("limit"); limitParam != "" {
+			parsed, parseErr := strconv.Atoi(limitParam)
+			if parseErr != nil || parsed <= 0 {
+				c.logger.Warn("malformed request was sent, limit is not a positive number", zap.String("limit", limitParam))
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			limit = min(parsed, auditMaxPageSize)
+		}
+
+		ctx := utils.GenerateCallTraceId(r.Context())
+
+		page, err := c.audit.Page(ctx, before, query.Get("subject"), int32(limit))
+		if err != nil {
+			c.logger.Warn("could not get audit log", zap.Any("traceId", ctx.Value("traceID")), zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		jsonBytes, parseErr := json.MarshalIndent(page, "", " ")
+		if parseErr != nil {
+			c.logger.Warn("could not parse audit log to json", zap.Error(parseErr))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, writeErr := w.Write(jsonBytes)
+		if writeErr != nil {
+			c.logger.Warn("could not write json to http writer", zap.Error(writeErr))
+		}
+	}
+}
+
+// tasksHandler returns an HTTP handler that lists all reconcile tasks with their configuration and the outcome of their last run.
+// It is also served by the shadow, whose leader-only tasks are not scheduled.
+func (c *Controller) tasksHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		jsonBytes, parseErr := json.MarshalIndent(c.tasks.Status(), "", " ")
+		if parseErr != nil {
+			c.logger.Warn("could not parse task status to json", zap.Error(parseErr))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, writeErr := w.Write(jsonBytes)
+		if writeErr != nil {
+			c.logger.Warn("could not write json to http writer", zap.Error(writeErr))
+		}
+	}
+}
+
+const (
+	auditDefaultPageSize = 50
+	auditMaxPageSize     = 500
+)
+
+// parseSince accepts either an RFC3339 timestamp or a duration that is subtracted from the current time
+func parseSince(since string) (time.Time, error) {
+
+	if timestamp, err := time.Parse(time.RFC3339, since); err == nil {
+		return timestamp, nil
+	}
+
+	duration, err := time.ParseDuration(since)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Now().Add(-duration), nil
+}
+
+// breakerLine describes the state of the postgres circuit breaker in one line of the health response
+func breakerLine(status database.BreakerStatus) string {
+
+	if status.State == database.BreakerClosed {
+		return fmt.Sprintf("postgres circuit breaker: closed, %d consecutive failures\n", status.ConsecutiveFailures)
+	}
+
+	return fmt.Sprintf("postgres circuit breaker: %s since %s after %d consecutive failures, last error: %s\n",
+		status.State, status.OpenedAt.Format(time.RFC3339), status.ConsecutiveFailures, status.LastError)
+}
+
+// replicaLine describes a read replica that is out of rotation in one line of the health response
+func replicaLine(status database.ReplicaStatus) string {
+
+	if status.LastError != "" {
+		return fmt.Sprintf("read replica %s: out of rotation, last error: %s\n", status.Name, status.LastError)
+	}
+
+	if status.CheckedAt.IsZero() {
+		return fmt.Sprintf("read replica %s: out of rotation, lag not checked yet\n", status.Name)
+	}
+
+	return fmt.Sprintf("read replica %s: out of rotation, lag of %s at %s\n", status.Name, status.Lag, status.CheckedAt.Format(time.RFC3339))
+}
+
+// refuseDegraded answers a mutating request with HTTP 503 while postgres is unreachable
+func (c *Controller) refuseDegraded(w http.ResponseWriter, err error) {
+
+	c.logger.Warn("refusing mutating request in degraded mode", zap.Error(err))
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_, httpErr := w.Write([]byte(err.Error()))
+	if httpErr != nil {
+		c.logger.Warn("could not send http response code to client", zap.Error(httpErr), zap.Int("responseCode", http.StatusServiceUnavailable))
+	}
+}
@@ -0,0 +1,407 @@
+package lifecycle
+
+import (
+	"context"
+	"controller/src/utils"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Manager owns all long-running parts of the controller.
+// Loops are functions that are executed on a ticker, services are functions that block until their context is canceled
+// (like the http server). Both are restarted if they panic. Failing loops are handled by the Supervisor.
+// When the context given to Start is canceled (e.g. on SIGTERM), or the supervisor gives up, everything is shut down in order:
+// loops first, then services in reverse order of registration, then the registered closers in order of registration.
+type Manager struct {
+	logger          *zap.Logger
+	supervisor      *Supervisor
+	restartDelay    time.Duration
+	shutdownTimeout time.Duration
+
+	mu           sync.Mutex
+	started      bool
+	ctx          context.Context
+	cancel       context.CancelFunc
+	loopsCtx     context.Context
+	stopLoop     context.CancelFunc
+	loopsWg      sync.WaitGroup
+	defaultGroup *Group
+	services     []*service
+	closers      []closer
+	failErr      error
+}
+
+// Group is a set of loops that can be stopped together, e.g. all loops that only run while the controller is the leader.
+// If the group has a demote handler, the supervisor may stop the group and call the handler instead of exiting the process.
+type Group struct {
+	name     string
+	m        *Manager
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	onDemote func(reason error)
+	demoted  sync.Once
+}
+
+// Loop is a function that is executed once immediately and then on every tick of its interval until the manager shuts down
+type Loop struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context) error
+}
+
+type service struct {
+	name   string
+	run    func(ctx context.Context) error
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type closer struct {
+	name  string
+	close func(ctx context.Context) error
+}
+
+func New(logger *zap.Logger, supervisor *Supervisor, restartDelay, shutdownTimeout time.Duration) *Manager {
+	return &Manager{
+		logger:          logger,
+		supervisor:      supervisor,
+		restartDelay:    restartDelay,
+		shutdownTimeout: shutdownTimeout,
+	}
+}
+
+// Start binds the manager to the given context. Loops and services added before Start are started now,
+// everything added afterwards is started immediately.
+func (m *Manager) Start(ctx context.Context) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ctx, m.cancel = context.WithCancel(ctx)
+	m.loopsCtx, m.stopLoop = context.WithCancel(m.ctx)
+	m.started = true
+	m.defaultGroup = m.newGroup("default", nil)
+
+	for _, s := range m.services {
+		m.startService(s)
+	}
+}
+
+// AddLoop registers a loop that does not belong to any demotable group
+func (m *Manager) AddLoop(loop Loop) {
+	m.mu.Lock()
+	group := m.defaultGroup
+	m.mu.Unlock()
+
+	if group == nil {
+		panic("lifecycle: loops can only be added after Start")
+	}
+
+	group.AddLoop(loop)
+}
+
+// NewGroup creates a new group of loops. onDemote may be nil, in which case the group cannot be demoted.
+func (m *Manager) NewGroup(name string, onDemote func(reason error)) *Group {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.started {
+		panic("lifecycle: groups can only be created after Start")
+	}
+
+	return m.newGroup(name, onDemote)
+}
+
+// newGroup has to be called with the mutex held
+func (m *Manager) newGroup(name string, onDemote func(reason error)) *Group {
+	g := &Group{
+		name:     name,
+		m:        m,
+		onDemote: onDemote,
+	}
+	g.ctx, g.cancel = context.WithCancel(m.loopsCtx)
+
+	return g
+}
+
+// Supervisor returns the supervisor that decides about failing loops
+func (m *Manager) Supervisor() *Supervisor {
+	return m.supervisor
+}
+
+// AddLoop starts the loop as part of this group
+func (g *Group) AddLoop(loop Loop) {
+	g.m.loopsWg.Add(1)
+	g.wg.Add(1)
+
+	go func() {
+		defer g.m.loopsWg.Done()
+		defer g.wg.Done()
+
+		g.m.runLoop(g, loop)
+	}()
+}
+
+// Stop cancels all loops of the group and waits for them to return
+func (g *Group) Stop() {
+	g.cancel()
+
+	if !waitTimeout(&g.wg, g.m.shutdownTimeout) {
+		g.m.logger.Warn("loops of group did not stop in time", zap.String("group", g.name), zap.Duration("timeout", g.m.shutdownTimeout))
+	}
+}
+
+// demote stops the group and hands over to its demote handler. It happens at most once per group.
+// Must not be called from one of the group's loops directly, since it waits for them to return.
+func (g *Group) demote(reason error) {
+	g.demoted.Do(func() {
+		if !g.m.supervisor.AllowDemotion() {
+			g.m.Fail(g.name, fmt.Errorf("too many demotions, last reason: %w", reason))
+			return
+		}
+
+		g.m.logger.Warn("demoting group", zap.String("group", g.name), zap.Error(reason))
+
+		g.Stop()
+		g.onDemote(reason)
+	})
+}
+
+// AddService registers a blocking function which has to return once its context is canceled.
+// Returning an error before that shuts down the whole manager.
+func (m *Manager) AddService(name string, run func(ctx context.Context) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := &service{name: name, run: run, done: make(chan struct{})}
+	m.services = append(m.services, s)
+
+	if m.started {
+		m.startService(s)
+	}
+}
+
+// OnShutdown registers a function that is called after all loops and services have stopped, e.g. to close the database pool
+func (m *Manager) OnShutdown(name string, close func(ctx context.Context) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closers = append(m.closers, closer{name: name, close: close})
+}
+
+// Context returns the context that is canceled once the manager begins shutting down
+func (m *Manager) Context() context.Context {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.ctx
+}
+
+// Fail records the error and starts shutting the manager down
+func (m *Manager) Fail(name string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.failErr == nil {
+		m.failErr = fmt.Errorf("%s failed: %w", name, err)
+	}
+
+	m.cancel()
+}
+
+// Wait blocks until the manager is shutting down, then stops everything in order.
+// It returns the error that caused the shutdown, or nil if it was requested from outside.
+func (m *Manager) Wait() error {
+	<-m.ctx.Done()
+
+	m.logger.Info("shutting down")
+
+	m.stopLoop()
+	if !waitTimeout(&m.loopsWg, m.shutdownTimeout) {
+		m.logger.Warn("loops did not stop in time", zap.Duration("timeout", m.shutdownTimeout))
+	}
+
+	m.mu.Lock()
+	services := m.services
+	closers := m.closers
+	failErr := m.failErr
+	m.mu.Unlock()
+
+	for i := len(services) - 1; i >= 0; i-- {
+		s := services[i]
+		if s.cancel == nil {
+			continue
+		}
+
+		s.cancel()
+
+		select {
+		case <-s.done:
+			m.logger.Info("stopped service", zap.String("service", s.name))
+		case <-time.After(m.shutdownTimeout):
+			m.logger.Warn("service did not stop in time", zap.String("service", s.name), zap.Duration("timeout", m.shutdownTimeout))
+		}
+	}
+
+	for _, c := range closers {
+		closeCtx, cancel := context.WithTimeout(context.Background(), m.shutdownTimeout)
+		if err := c.close(closeCtx); err != nil {
+			m.logger.Warn("closing failed", zap.String("closer", c.name), zap.Error(err))
+		}
+		cancel()
+	}
+
+	m.logger.Info("shutdown complete")
+
+	return failErr
+}
+
+// startService has to be called with the mutex held
+func (m *Manager) startService(s *service) {
+	//services get their own context, so they can be stopped one after another
+	var svcCtx context.Context
+	svcCtx, s.cancel = context.WithCancel(context.Background())
+
+	go func() {
+		defer close(s.done)
+
+		for {
+			panicked, err := m.guard(s.name, func() error { return s.run(svcCtx) })
+
+			if svcCtx.Err() != nil {
+				return
+			}
+
+			if panicked {
+				if !sleepCtx(svcCtx, m.restartDelay) {
+					return
+				}
+				m.logger.Info("restarting service after panic", zap.String("service", s.name))
+				continue
+			}
+
+			if err == nil {
+				err = errors.New("service stopped unexpectedly")
+			}
+
+			m.Fail(s.name, err)
+			return
+		}
+	}()
+}
+
+func (m *Manager) runLoop(g *Group, loop Loop) {
+
+	ctx := g.ctx
+
+	m.logger.Info("starting loop", zap.String("loop", loop.Name), zap.String("group", g.name), zap.Duration("interval", loop.Interval))
+
+	for {
+		panicked, err := m.guard(loop.Name, func() error {
+			return tick(ctx, loop, func() { m.supervisor.Succeeded(loop.Name) })
+		})
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if panicked {
+			if !sleepCtx(ctx, m.restartDelay) {
+				return
+			}
+			m.logger.Info("restarting loop after panic", zap.String("loop", loop.Name))
+			continue
+		}
+
+		if err == nil {
+			return
+		}
+
+		decision := m.supervisor.Failed(loop.Name, err, g.onDemote != nil)
+
+		switch decision.Action {
+		case ActionRestart:
+			if !sleepCtx(ctx, decision.Backoff) {
+				return
+			}
+			m.logger.Info("restarting loop after failure", zap.String("loop", loop.Name), zap.Int("consecutiveFailures", decision.Failures))
+			continue
+		case ActionDemote:
+			//the group waits for this loop to return, so the demotion has to happen elsewhere
+			go g.demote(err)
+		default:
+			m.Fail(loop.Name, err)
+		}
+
+		return
+	}
+}
+
+// tick runs the loop function once and then once per interval until the context is canceled or the function fails.
+// succeeded is called after every successful run. Every run gets its own trace id, like an http request.
+func tick(ctx context.Context, loop Loop, succeeded func()) error {
+	ticker := time.NewTicker(loop.Interval)
+	defer ticker.Stop()
+
+	for {
+		err := loop.Run(utils.GenerateCallTraceId(ctx))
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+
+		if err == nil {
+			succeeded()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// guard runs fn and recovers from a panic in it
+func (m *Manager) guard(name string, fn func() error) (panicked bool, err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			m.logger.Error("recovered from panic", zap.String("name", name), zap.Any("panic", rec), zap.ByteString("stack", debug.Stack()))
+			panicked = true
+		}
+	}()
+
+	return false, fn()
+}
+
+// sleepCtx sleeps for the given duration and returns false if the context was canceled in the meantime
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// waitTimeout waits for the wait group and returns false if that took longer than the timeout
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,176 @@
+package lifecycle
+
+import (
+	"context"
+	oe "controller/src/errors"
+	"errors"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// Severity describes how bad a failure of a loop is
+type Severity int
+
+const (
+	// SeverityTransient failures are expected to go away on their own, e.g. a short postgres outage
+	SeverityTransient Severity = iota
+	// SeverityFatal failures will not go away by retrying, e.g. a constraint violation while writing
+	SeverityFatal
+)
+
+func (s Severity) String() string {
+	if s == SeverityFatal {
+		return "fatal"
+	}
+	return "transient"
+}
+
+// Action is what the supervisor decided to do about a failed loop
+type Action int
+
+const (
+	// ActionRestart restarts the loop after the backoff of the decision
+	ActionRestart Action = iota
+	// ActionDemote stops the group of the loop and hands leadership over to the shadow
+	ActionDemote
+	// ActionExit shuts the whole process down, this is the last resort
+	ActionExit
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionRestart:
+		return "restart"
+	case ActionDemote:
+		return "demote"
+	default:
+		return "exit"
+	}
+}
+
+// Decision is the result of the supervisor evaluating a failure
+type Decision struct {
+	Action   Action
+	Backoff  time.Duration
+	Severity Severity
+	Failures int
+}
+
+// Classify sorts an error into transient or fatal.
+// Database errors are classified by their Reconcilable flag, everything else is considered transient.
+func Classify(err error) Severity {
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return SeverityTransient
+	}
+
+	var dbErr oe.DbError
+	if errors.As(err, &dbErr) && !dbErr.Reconcilable {
+		return SeverityFatal
+	}
+
+	return SeverityTransient
+}
+
+// Supervisor decides how the lifecycle manager reacts to failing loops.
+// Transient failures restart the loop with exponential backoff. If a loop keeps failing, or fails fatally,
+// and it belongs to a group that can be demoted (the leader loops), leadership is given up.
+// The process is only exited if demotion is not possible or happened too often within the demotion window.
+type Supervisor struct {
+	logger         *zap.Logger
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	maxFailures    int
+	maxDemotions   int
+	demotionWindow time.Duration
+
+	mu        sync.Mutex
+	failures  map[string]int
+	demotions []time.Time
+}
+
+func NewSupervisor(logger *zap.Logger, initialBackoff, maxBackoff time.Duration, maxFailures, maxDemotions int, demotionWindow time.Duration) *Supervisor {
+	return &Supervisor{
+		logger:         logger,
+		initialBackoff: initialBackoff,
+		maxBackoff:     maxBackoff,
+		maxFailures:    maxFailures,
+		maxDemotions:   maxDemotions,
+		demotionWindow: demotionWindow,
+		failures:       make(map[string]int),
+	}
+}
+
+// Failed records a failure of the named loop and decides what to do about it
+func (s *Supervisor) Failed(name string, err error, canDemote bool) Decision {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures[name]++
+	failures := s.failures[name]
+	severity := Classify(err)
+
+	decision := Decision{Severity: severity, Failures: failures}
+
+	switch {
+	case severity == SeverityTransient && failures <= s.maxFailures:
+		decision.Action = ActionRestart
+		decision.Backoff = s.backoff(failures)
+	case canDemote:
+		decision.Action = ActionDemote
+	case severity == SeverityTransient:
+		//nothing to hand over, so we keep trying instead of killing the process
+		decision.Action = ActionRestart
+		decision.Backoff = s.maxBackoff
+	default:
+		decision.Action = ActionExit
+	}
+
+	s.logger.Warn("loop failed",
+		zap.String("loop", name),
+		zap.Error(err),
+		zap.Stringer("severity", severity),
+		zap.Int("consecutiveFailures", failures),
+		zap.Stringer("action", decision.Action),
+		zap.Duration("backoff", decision.Backoff),
+	)
+
+	return decision
+}
+
+// Succeeded resets the consecutive failure count of the named loop
+func (s *Supervisor) Succeeded(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.failures, name)
+}
+
+// AllowDemotion records a demotion and returns false if there were too many demotions in the demotion window
+func (s *Supervisor) AllowDemotion() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	recent := s.demotions[:0]
+	for _, t := range s.demotions {
+		if now.Sub(t) < s.demotionWindow {
+			recent = append(recent, t)
+		}
+	}
+	s.demotions = append(recent, now)
+
+	return len(s.demotions) <= s.maxDemotions
+}
+
+// backoff has to be called with the mutex held
+func (s *Supervisor) backoff(failures int) time.Duration {
+	backoff := s.initialBackoff
+	for i := 1; i < failures && backoff < s.maxBackoff; i++ {
+		backoff *= 2
+	}
+
+	return min(backoff, s.maxBackoff)
+}
@@ -5,16 +5,20 @@ import (
 	"controller/src/components"
 	"controller/src/database"
 	"controller/src/docker"
+	"controller/src/lifecycle"
 	"controller/src/utils"
 	"fmt"
 	"github.com/goforj/godump"
+	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5/pgxpool"
 	goutils "github.com/linusgith/goutils/pkg/env_utils"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"gopkg.in/natefinch/lumberjack.v2"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -78,8 +82,9 @@ func createDevelopmentLogger() *zap.Logger {
 
 func main() {
 
-	//Setting a context without a timeout since this main function should (optimally) run forever
-	ctx := context.Background()
+	//The context is canceled on SIGINT/SIGTERM, which makes the lifecycle manager shut everything down in order
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	var logger *zap.Logger
 
@@ -111,7 +116,31 @@ func main() {
 		//TODO retries
 	}
 
-	_, reconciler, dInterface, controller := setupStructs(pool, logger)
+	//Refuse to start on a schema this build does not know, instead of failing on the first query that touches it
+	applyMigrations := strings.ToLower(goutils.Log().ParseEnvStringDefault("SCHEMA_AUTO_MIGRATE", "false", logger)) == "true"
+	schemaLockTimeout := goutils.Log().ParseEnvDurationDefault("SCHEMA_LOCK_TIMEOUT", time.Minute, logger)
+
+	if _, schemaErr := database.EnsureSchema(ctx, pool, logger, applyMigrations, schemaLockTimeout); schemaErr != nil {
+		logger.Fatal("database schema is not usable, stopping...", zap.Error(schemaErr))
+		return
+	}
+
+	replicaPools, err := utils.SetupReplicaConns(logger, ctx)
+	if err != nil {
+		logger.Fatal("establishing connection to read replicas failed, stopping...", zap.Error(err))
+		return
+	}
+
+	scheduler, reconciler, dInterface, controller := setupStructs(pool, replicaPools, logger)
+
+	//Replicas only take reads after a lag check, so the first one runs before anything reads
+	if controller.replicas.Len() > 0 {
+		if lagErr := controller.replicas.CheckLag(ctx); lagErr != nil {
+			logger.Warn("could not check the lag of all read replicas, reads fall back to the primary", zap.Error(lagErr))
+		}
+	}
+
+	registerTasks(controller.tasks, controller, scheduler, reconciler, logger)
 
 	//test docker daemon connection
 	err = dInterface.Ping(ctx)
@@ -120,122 +149,414 @@ func main() {
 		return
 	}
 
-	//runs the docker interface so it can accept requests via the channels
-	go dInterface.Run()
+	restartDelay := goutils.Log().ParseEnvDurationDefault("LOOP_RESTART_DELAY", time.Second, logger)
+	shutdownTimeout := goutils.Log().ParseEnvDurationDefault("SHUTDOWN_TIMEOUT", 10*time.Second, logger)
 
-	//Run the http server
-	go func() {
-		controller.RunHttpServer()
-	}()
+	supervisor := lifecycle.NewSupervisor(
+		logger.With(zap.String("component", "supervisor")),
+		goutils.Log().ParseEnvDurationDefault("SUPERVISOR_INITIAL_BACKOFF", time.Second, logger),
+		goutils.Log().ParseEnvDurationDefault("SUPERVISOR_MAX_BACKOFF", time.Minute, logger),
+		goutils.Log().ParseEnvIntDefault("SUPERVISOR_MAX_FAILURES", 5, logger),
+		goutils.Log().ParseEnvIntDefault("SUPERVISOR_MAX_DEMOTIONS", 3, logger),
+		goutils.Log().ParseEnvDurationDefault("SUPERVISOR_DEMOTION_WINDOW", 10*time.Minute, logger),
+	)
 
-	//Make the controller heartbeat to the database
-	if !controller.isShadow {
+	manager := lifecycle.New(logger.With(zap.String("component", "lifecycle")), supervisor, restartDelay, shutdownTimeout)
 
-		if registerErr := reconciler.RegisterController(ctx); registerErr != nil {
-			logger.Fatal("could not register controller, stopping", zap.Error(registerErr))
-		}
+	//Closers run after all loops and services stopped, so the pools are closed last
+	manager.OnShutdown("replicas", func(context.Context) error {
+		controller.replicas.Close()
+		return nil
+	})
 
-		go controller.heartbeat(ctx)
+	manager.OnShutdown("postgres", func(context.Context) error {
+		pool.Close()
+		return nil
+	})
 
-	} else {
-		time.Sleep(3 * time.Second)
-		//If this controller is the shadow, it should get stuck in this function
-		controller.checkControllerUp(ctx)
+	manager.Start(ctx)
+
+	//Services are stopped in reverse order: first the http server, then the docker interface
+	manager.AddService("docker", dInterface.Run)
+	manager.AddService("http", controller.RunHttpServer)
+
+	//Tasks that are not leader-only, like the state snapshot, run regardless of leadership
+	controller.tasks.Schedule(manager, false)
+
+	if !controller.isShadow.Load() {
+
+		if registerErr := reconciler.RegisterController(manager.Context()); registerErr != nil {
+			//Someone else may still be leading, so we wait as the shadow instead of stopping
+			logger.Error("could not register controller, continuing as shadow", zap.Error(registerErr))
+			controller.isShadow.Store(true)
+		}
 	}
 
-	timeout := goutils.Log().ParseEnvDurationDefault("WORKER_HEARTBEAT_TIMEOUT", 5*time.Second, logger)
+	if controller.isShadow.Load() {
+		//If this controller is the shadow, it stays in here until it takes over
+		go controller.follow(manager)
+	} else {
+		controller.lead(manager)
+	}
 
-	// Function to evaluate worker state
-	go func() {
+	if waitErr := manager.Wait(); waitErr != nil {
+		logger.Error("controller stopped because of an error", zap.Error(waitErr))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+}
 
-		checkInterval := goutils.Log().ParseEnvDurationDefault("CHECK_WORKER_BACKOFF", 5*time.Second, logger)
+// registerTasks registers all reconcile tasks of the controller with the task registry.
+// Leader-only tasks are scheduled by lead, the others once at startup. Errors returned by the tasks are handled by the supervisor.
+func registerTasks(tasks *components.TaskRegistry, controller *Controller, scheduler components.Scheduler, reconciler components.Reconciler, logger *zap.Logger) {
+
+	//Keeps the snapshot that reads are served from while postgres is unreachable. It runs regardless of leadership
+	//and never fails, since an unreachable database is exactly what it is supposed to bridge.
+	snapshotInterval := goutils.Log().ParseEnvDurationDefault("STATE_SNAPSHOT_INTERVAL", 5*time.Second, logger)
+	tasks.Register(configureTask(components.ReconcileTask{
+		Name:     "state-snapshot",
+		Interval: snapshotInterval,
+		Timeout:  snapshotInterval,
+		Run: func(ctx context.Context) error {
+			if _, snapshotErr := scheduler.RefreshSnapshot(ctx); snapshotErr != nil {
+				logger.Warn("could not refresh state snapshot, postgres seems to be unreachable", zap.Error(snapshotErr))
+			}
+			return nil
+		},
+	}, logger))
+
+	//Keeps the read replicas that lag behind too far or cannot be reached out of rotation. Every controller reads from them,
+	//so it runs regardless of leadership, and only if there are replicas at all.
+	if controller.replicas.Len() > 0 {
+		replicaLagInterval := goutils.Log().ParseEnvDurationDefault("REPLICA_LAG_CHECK_INTERVAL", 5*time.Second, logger)
+		tasks.Register(configureTask(components.ReconcileTask{
+			Name:     "replica-lag",
+			Interval: replicaLagInterval,
+			Timeout:  replicaLagInterval,
+			Run: func(ctx context.Context) error {
+				if lagErr := controller.replicas.CheckLag(ctx); lagErr != nil {
+					logger.Warn("could not check the lag of all read replicas", zap.Error(lagErr))
+				}
+				return nil
+			},
+		}, logger))
+	}
 
-		for {
+	//Make the controller heartbeat to the database. It is not jittered, the shadow relies on its regularity
+	heartbeatInterval := goutils.Log().ParseEnvDurationDefault("HEARTBEAT_BACKOFF", 5*time.Second, logger)
+	tasks.Register(configureTask(components.ReconcileTask{
+		Name:       "heartbeat",
+		Interval:   heartbeatInterval,
+		Timeout:    heartbeatInterval,
+		LeaderOnly: true,
+		Run:        controller.heartbeat,
+	}, logger))
 
-			start := time.Now()
-			err := reconciler.EvaluateWorkerState(ctx, timeout)
+	// Function to evaluate worker state
+	tasks.Register(configureTask(components.ReconcileTask{
+		Name:       "worker-state",
+		Interval:   goutils.Log().ParseEnvDurationDefault("CHECK_WORKER_BACKOFF", 5*time.Second, logger),
+		Jitter:     time.Second,
+		Timeout:    30 * time.Second,
+		LeaderOnly: true,
+		Run: func(ctx context.Context) error {
+
+			err := reconciler.EvaluateWorkerState(ctx)
 			if err != nil {
-				//Since there is no writing happening, we can kill the controller here so the shadow can step in
-				logger.Fatal("fatal error evaluating worker state", zap.Error(err))
+				return fmt.Errorf("fatal error evaluating worker state: %w", err)
 			}
 
 			err = reconciler.EvaluateMigrationWorkerState(ctx)
 			if err != nil {
-				logger.Fatal("fatal error evaluating migration worker state")
+				return fmt.Errorf("fatal error evaluating migration worker state: %w", err)
 			}
 
-			end := time.Now()
-			//calculate the time it took for the last check to be concluded and then subtract that from the interval and sleep for the resulting amount of time -> this way the interval should always be the same length
-			timeToSleep := checkInterval - (end.Sub(start))
+			return nil
+		},
+	}, logger))
+
+	stuckTimeout := goutils.Log().ParseEnvDurationDefault("STUCK_MIGRATION_TIMEOUT", 10*time.Minute, logger)
+
+	// Function to detect migration jobs that make no progress although their worker is alive
+	tasks.Register(configureTask(components.ReconcileTask{
+		Name:       "stuck-migrations",
+		Interval:   goutils.Log().ParseEnvDurationDefault("CHECK_STUCK_MIGRATION_BACKOFF", 30*time.Second, logger),
+		Jitter:     5 * time.Second,
+		Timeout:    time.Minute,
+		LeaderOnly: true,
+		Run: func(ctx context.Context) error {
+			if stuckErr := reconciler.CheckStuckMigrations(ctx, stuckTimeout); stuckErr != nil {
+				return fmt.Errorf("fatal error checking for stuck migrations: %w", stuckErr)
+			}
+			return nil
+		},
+	}, logger))
+
+	// Function to hand requeued migration jobs to a migration worker once their backoff has passed
+	tasks.Register(configureTask(components.ReconcileTask{
+		Name:       "migration-dispatch",
+		Interval:   goutils.Log().ParseEnvDurationDefault("MIGRATION_DISPATCH_BACKOFF", 10*time.Second, logger),
+		Jitter:     2 * time.Second,
+		Timeout:    time.Minute,
+		LeaderOnly: true,
+		Run: func(ctx context.Context) error {
+			if dispatchErr := reconciler.DispatchQueuedMigrations(ctx); dispatchErr != nil {
+				return fmt.Errorf("fatal error dispatching queued migrations: %w", dispatchErr)
+			}
+			return nil
+		},
+	}, logger))
+
+	// Function to validate that the mappings cover the key space exactly once
+	tasks.Register(configureTask(components.ReconcileTask{
+		Name:       "mapping-invariants",
+		Interval:   goutils.Log().ParseEnvDurationDefault("MAPPING_CHECK_INTERVAL", 30*time.Second, logger),
+		Jitter:     5 * time.Second,
+		Timeout:    30 * time.Second,
+		LeaderOnly: true,
+		Run: func(ctx context.Context) error {
+			if _, checkErr := scheduler.CheckMappings(ctx); checkErr != nil {
+				return fmt.Errorf("fatal error checking mapping invariants: %w", checkErr)
+			}
+			return nil
+		},
+	}, logger))
+
+	probeTimeout := goutils.Log().ParseEnvDurationDefault("DB_PROBE_TIMEOUT", 2*time.Second, logger)
+
+	// Function to connect to every database instance directly and record reachability and latency
+	tasks.Register(configureTask(components.ReconcileTask{
+		Name:       "db-probe",
+		Interval:   goutils.Log().ParseEnvDurationDefault("DB_PROBE_INTERVAL", 15*time.Second, logger),
+		Jitter:     2 * time.Second,
+		Timeout:    probeTimeout + 30*time.Second,
+		LeaderOnly: true,
+		Run: func(ctx context.Context) error {
+			if probeErr := reconciler.ProbeDatabases(ctx, probeTimeout); probeErr != nil {
+				return fmt.Errorf("fatal error probing database instances: %w", probeErr)
+			}
+			return nil
+		},
+	}, logger))
+
+	//Function to delete connection errors that left the failure rate window, so the table does not grow forever
+	tasks.Register(configureTask(components.ReconcileTask{
+		Name:       "conn-error-retention",
+		Interval:   goutils.Log().ParseEnvDurationDefault("CONN_ERR_RETENTION_BACKOFF", time.Minute, logger),
+		Jitter:     10 * time.Second,
+		Timeout:    5 * time.Minute,
+		LeaderOnly: true,
+		Run: func(ctx context.Context) error {
+			if _, purgeErr := reconciler.PurgeConnErrors(ctx); purgeErr != nil {
+				return fmt.Errorf("fatal error purging old connection errors: %w", purgeErr)
+			}
+			return nil
+		},
+	}, logger))
+
+	autoEvacuate := strings.ToLower(goutils.Log().ParseEnvStringDefault("DB_AUTO_EVACUATE", "false", logger)) == "true"
+
+	//Function to evaluate failure rate in mongo-worker relationships and take unhealthy databases out of placement
+	tasks.Register(configureTask(components.ReconcileTask{
+		Name:       "failure-rate",
+		Interval:   goutils.Log().ParseEnvDurationDefault("CHECK_FAILURE_RATE_BACKOFF", 5*time.Minute, logger),
+		Jitter:     30 * time.Second,
+		Timeout:    5 * time.Minute,
+		LeaderOnly: true,
+		Run: func(ctx context.Context) error {
+			report, checkFailureRateErr := reconciler.CheckFailureRate(ctx)
+			if checkFailureRateErr != nil {
+				return fmt.Errorf("fatal error checking failure rates: %w", checkFailureRateErr)
+			}
 
-			time.Sleep(timeToSleep)
-		}
+			remediation, remediateErr := reconciler.RemediateDatabases(ctx, report)
+			if remediateErr != nil {
+				return fmt.Errorf("fatal error remediating unhealthy databases: %w", remediateErr)
+			}
 
-	}()
+			if !autoEvacuate {
+				return nil
+			}
 
-	//Function to evaluate failure rate in mongo-worker relationships
-	go func() {
-		checkFailureRateErr := reconciler.CheckFailureRate(ctx)
-		if checkFailureRateErr != nil {
-			logger.Fatal("fatal error checking failure rates")
-		}
-		time.Sleep(5 * time.Minute)
-	}()
+			//an evacuation that fails is not retried by the task, the database stays out of placement either way
+			for _, url := range remediation.MarkedUnhealthy {
+				if evacuateErr := scheduler.EvacuateDatabase(ctx, url); evacuateErr != nil {
+					logger.Warn("could not evacuate unhealthy database", zap.String("url", url), zap.Error(evacuateErr))
+				}
+			}
+
+			return nil
+		},
+	}, logger))
+}
 
-	select {}
+// configureTask lets the jitter and timeout of a task be overridden with TASK_<NAME>_JITTER and TASK_<NAME>_TIMEOUT,
+// e.g. TASK_WORKER_STATE_TIMEOUT for the task "worker-state". The interval keeps its own environment variable.
+func configureTask(task components.ReconcileTask, logger *zap.Logger) components.ReconcileTask {
+
+	prefix := "TASK_" + strings.ToUpper(strings.ReplaceAll(task.Name, "-", "_"))
+
+	task.Jitter = goutils.Log().ParseEnvDurationDefault(prefix+"_JITTER", task.Jitter, logger)
+	task.Timeout = goutils.Log().ParseEnvDurationDefault(prefix+"_TIMEOUT", task.Timeout, logger)
+
+	return task
 }
 
 // setupStructs sets up all structs needed for functionality in the worker.
 // The loggers in reader, writer, and docker should only be used for debug level statements
-func setupStructs(pool *pgxpool.Pool, logger *zap.Logger) (components.Scheduler, components.Reconciler, docker.DInterface, Controller) {
+func setupStructs(pool *pgxpool.Pool, replicaPools []*pgxpool.Pool, logger *zap.Logger) (components.Scheduler, components.Reconciler, docker.DInterface, *Controller) {
 
 	dbWriter := database.Writer{
 		Logger: logger.With(zap.String("util", "writer")),
 		Pool:   pool,
 	}
 
+	replicas := database.NewReplicaRouter(
+		logger.With(zap.String("component", "replicas")),
+		replicaPools,
+		goutils.Log().ParseEnvDurationDefault("REPLICA_MAX_LAG", 5*time.Second, logger),
+	)
+
 	dbReader := database.Reader{
-		Logger: logger.With(zap.String("util", "reader")),
-		Pool:   pool,
+		Logger:   logger.With(zap.String("util", "reader")),
+		Pool:     pool,
+		Replicas: replicas,
 	}
 
+	breaker := database.NewCircuitBreaker(
+		logger.With(zap.String("component", "breaker")),
+		goutils.Log().ParseEnvIntDefault("DB_BREAKER_FAILURE_THRESHOLD", 5, logger),
+		goutils.Log().ParseEnvDurationDefault("DB_BREAKER_OPEN_TIMEOUT", 10*time.Second, logger),
+		goutils.Log().ParseEnvIntDefault("DB_BREAKER_HALF_OPEN_PROBES", 1, logger),
+	)
+
 	writerPerfectionist := database.NewWriterPerfectionist(
 		&dbWriter,
+		breaker,
 	)
 
 	readerPerfectionist := database.NewReaderPerfectionist(
 		&dbReader,
+		breaker,
 	)
 
-	dockerInterface, err := docker.New(logger)
+	//A heartbeat that is retried for longer than the shadows check interval is worthless, so it gives up sooner
+	writerPerfectionist.OverridePolicy("Heartbeat", utils.RetryPolicyFromEnv("HEARTBEAT_", utils.RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 50 * time.Millisecond,
+		MaxBackoff:     500 * time.Millisecond,
+		Strategy:       utils.BackoffExponential,
+	}, logger))
+
+	//Audit entries are written by many actions at once, the jitter keeps their retries apart
+	writerPerfectionist.OverridePolicy("AppendAuditEntry", utils.RetryPolicyFromEnv("AUDIT_", utils.RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 20 * time.Millisecond,
+		MaxBackoff:     2 * time.Second,
+		Strategy:       utils.BackoffDecorrelated,
+	}, logger))
+
+	clock := components.NewDbClock(
+		logger.With(zap.String("component", "clock")),
+		readerPerfectionist,
+		goutils.Log().ParseEnvDurationDefault("CLOCK_SKEW_TOLERANCE", 2*time.Second, logger),
+		goutils.Log().ParseEnvIntDefault("CLOCK_SKEW_WINDOW", 20, logger),
+	)
+
+	workerHealth := components.NewWorkerHealthTracker(components.WorkerHealthConfig{
+		SuspectGrace:      goutils.Log().ParseEnvDurationDefault("WORKER_SUSPECT_GRACE", 10*time.Second, logger),
+		QuarantineGrace:   goutils.Log().ParseEnvDurationDefault("WORKER_QUARANTINE_GRACE", 20*time.Second, logger),
+		RecoveryThreshold: goutils.Log().ParseEnvIntDefault("WORKER_RECOVERY_THRESHOLD", 3, logger),
+		FlapWindow:        goutils.Log().ParseEnvDurationDefault("WORKER_FLAP_WINDOW", 10*time.Minute, logger),
+		FlapThreshold:     goutils.Log().ParseEnvIntDefault("WORKER_FLAP_THRESHOLD", 3, logger),
+	})
+
+	migrationProgress := components.NewMigrationProgressTracker()
+
+	failureReports := components.NewFailureReports()
+
+	//the scheduler and the reconciler have to agree on when a migration worker counts as dead
+	workerHeartbeatTimeout := goutils.Log().ParseEnvDurationDefault("WORKER_HEARTBEAT_TIMEOUT", 5*time.Second, logger)
+
+	hostname, err := os.Hostname()
 	if err != nil {
-		logger.Error("could not create docker interface", zap.Error(err))
+		logger.Warn("could not get hostname, controller instance in audit log falls back to \"unknown\"", zap.Error(err))
+		hostname = "unknown"
 	}
 
-	scheduler := components.NewScheduler(
-		logger.With(zap.String("component", "scheduler")),
-		&dbReader,
-		readerPerfectionist,
-		&dbWriter,
-		writerPerfectionist,
-		dockerInterface,
-	)
+	controllerId := goutils.Log().ParseEnvStringDefault("CONTROLLER_ID", hostname, logger)
 
-	reconciler := components.NewReconciler(
-		logger.With(zap.String("component", "reconciler")),
-		&dbReader,
-		readerPerfectionist,
-		&dbWriter,
+	auditor := components.NewAuditor(
+		logger.With(zap.String("component", "audit")),
 		writerPerfectionist,
-		dockerInterface,
+		readerPerfectionist,
+		controllerId,
 	)
 
-	gauntlet := Controller{
+	dockerInterface, err := docker.New(logger)
+	if err != nil {
+		logger.Error("could not create docker interface", zap.Error(err))
+	}
+
+	scheduler := components.NewScheduler(components.SchedulerDeps{
+		Logger:           logger.With(zap.String("component", "scheduler")),
+		Reader:           readerPerfectionist,
+		Writer:           writerPerfectionist,
+		Docker:           dockerInterface,
+		Clock:            clock,
+		Health:           workerHealth,
+		Progress:         migrationProgress,
+		Audit:            auditor,
+		Failures:         failureReports,
+		HeartbeatTimeout: workerHeartbeatTimeout,
+	})
+
+	reconciler := components.NewReconciler(components.ReconcilerDeps{
+		Logger:           logger.With(zap.String("component", "reconciler")),
+		Reader:           readerPerfectionist,
+		Writer:           writerPerfectionist,
+		Docker:           dockerInterface,
+		Clock:            clock,
+		Health:           workerHealth,
+		Progress:         migrationProgress,
+		Audit:            auditor,
+		Failures:         failureReports,
+		HeartbeatTimeout: workerHeartbeatTimeout,
+		Leadership: components.LeadershipConfig{
+			//the hostname alone is not unique if a shadow runs on the same host, or the same controller restarts quickly
+			ControllerId:     controllerId + "/" + uuid.NewString(),
+			HeartbeatTimeout: goutils.Log().ParseEnvDurationDefault("CONTROLLER_HEARTBEAT_TIMEOUT", 10*time.Second, logger),
+		},
+		FailureRate: components.FailureRateConfig{
+			Window:            goutils.Log().ParseEnvDurationDefault("FAILURE_RATE_WINDOW", 30*time.Minute, logger),
+			HalfLife:          goutils.Log().ParseEnvDurationDefault("FAILURE_RATE_HALF_LIFE", 10*time.Minute, logger),
+			Bucket:            goutils.Log().ParseEnvDurationDefault("FAILURE_RATE_BUCKET", time.Minute, logger),
+			PurgeBatchSize:    goutils.Log().ParseEnvIntDefault("CONN_ERR_PURGE_BATCH_SIZE", 5000, logger),
+			WorkerThreshold:   utils.ParseEnvFloatDefault("FAILURE_RATE_WORKER_THRESHOLD", 3, logger),
+			DatabaseThreshold: utils.ParseEnvFloatDefault("FAILURE_RATE_DATABASE_THRESHOLD", 3, logger),
+			PairThreshold:     utils.ParseEnvFloatDefault("FAILURE_RATE_PAIR_THRESHOLD", 3, logger),
+
+			DatabaseMinWorkers:        goutils.Log().ParseEnvIntDefault("DB_UNHEALTHY_MIN_WORKERS", 2, logger),
+			DatabaseRecoveryThreshold: utils.ParseEnvFloatDefault("DB_RECOVERY_THRESHOLD", 1, logger),
+			Retention:                 goutils.Log().ParseEnvDurationDefault("FAILURE_REPORT_RETENTION", 7*24*time.Hour, logger),
+		},
+		Retry: components.MigrationRetryConfig{
+			MaxAttempts: goutils.Log().ParseEnvIntDefault("MIGRATION_MAX_ATTEMPTS", 5, logger),
+			Backoff:     goutils.Log().ParseEnvDurationDefault("MIGRATION_RETRY_BACKOFF", 30*time.Second, logger),
+			MaxBackoff:  goutils.Log().ParseEnvDurationDefault("MIGRATION_RETRY_MAX_BACKOFF", 10*time.Minute, logger),
+		},
+	})
+
+	gauntlet := &Controller{
 		scheduler:  scheduler,
 		reconciler: reconciler,
+		audit:      auditor,
+		breaker:    breaker,
+		replicas:   replicas,
+		tasks:      components.NewTaskRegistry(logger.With(zap.String("component", "tasks"))),
 		logger:     logger.With(zap.String("component", "httpHandler")),
-		isShadow:   strings.ToLower(goutils.NoLog().ParseEnvStringPanic("SHADOW")) == "true",
 	}
+	gauntlet.isShadow.Store(strings.ToLower(goutils.NoLog().ParseEnvStringPanic("SHADOW")) == "true")
 
 	return scheduler, reconciler, dockerInterface, gauntlet
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"controller/src/database"
+	"fmt"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+)
+
+// metricsHandler returns an HTTP handler that serves the metrics of the controller in the Prometheus text format
+func (c *Controller) metricsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		var body strings.Builder
+
+		breaker := c.breaker.Status()
+
+		writeMetric(&body, "controller_db_circuit_state", "gauge", "State of the postgres circuit breaker: 0 closed, 1 half-open, 2 open.", breakerStateValue(breaker.State))
+		writeMetric(&body, "controller_db_circuit_consecutive_failures", "gauge", "Consecutive failed postgres calls seen by the circuit breaker.", float64(breaker.ConsecutiveFailures))
+		writeMetric(&body, "controller_db_circuit_opened_total", "counter", "Times the postgres circuit breaker opened.", float64(breaker.OpenedTotal))
+		writeMetric(&body, "controller_db_circuit_rejected_total", "counter", "Postgres calls rejected by the open circuit breaker.", float64(breaker.RejectedTotal))
+
+		writeReplicaMetrics(&body, c.replicas.Status())
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		_, writeErr := w.Write([]byte(body.String()))
+		if writeErr != nil {
+			c.logger.Warn("could not write metrics response", zap.Error(writeErr))
+		}
+	}
+}
+
+// writeMetric appends a single metric without labels, including its help and type lines
+func writeMetric(body *strings.Builder, name, metricType, help string, value float64) {
+	_, _ = fmt.Fprintf(body, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name, metricType, name, value)
+}
+
+// writeReplicaMetrics appends the lag and rotation of every read replica, labeled with its host and port
+func writeReplicaMetrics(body *strings.Builder, replicas []database.ReplicaStatus) {
+
+	if len(replicas) == 0 {
+		return
+	}
+
+	_, _ = fmt.Fprintf(body, "# HELP controller_db_replica_lag_seconds Replay lag of the read replica at its last successful check.\n# TYPE controller_db_replica_lag_seconds gauge\n")
+	for _, replica := range replicas {
+		_, _ = fmt.Fprintf(body, "controller_db_replica_lag_seconds{replica=%q} %g\n", replica.Name, replica.Lag.Seconds())
+	}
+
+	_, _ = fmt.Fprintf(body, "# HELP controller_db_replica_in_rotation Whether the read replica takes reads: 1 in rotation, 0 reads go to the primary.\n# TYPE controller_db_replica_in_rotation gauge\n")
+	for _, replica := range replicas {
+		inRotation := 0
+		if replica.InUse {
+			inRotation = 1
+		}
+		_, _ = fmt.Fprintf(body, "controller_db_replica_in_rotation{replica=%q} %d\n", replica.Name, inRotation)
+	}
+}
+
+func breakerStateValue(state database.BreakerState) float64 {
+	switch state {
+	case database.BreakerHalfOpen:
+		return 1
+	case database.BreakerOpen:
+		return 2
+	default:
+		return 0
+	}
+}
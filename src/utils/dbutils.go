@@ -5,10 +5,14 @@ import (
 	oe "controller/src/errors"
 	"errors"
 	"fmt"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	goutils "github.com/linusgith/goutils/pkg/env_utils"
 	"go.uber.org/zap"
+	"io"
+	"net"
+	"strings"
 )
 
 func SetupDBConn(logger *zap.Logger, ctx context.Context) (*pgxpool.Pool, error) {
@@ -32,34 +36,141 @@ func SetupDBConn(logger *zap.Logger, ctx context.Context) (*pgxpool.Pool, error)
 	return pool, nil
 }
 
-func Must(execRes pgconn.CommandTag, execErr error) oe.DbError {
-	if execErr != nil {
-		var pgErr *pgconn.PgError
-		if errors.As(execErr, &pgErr) {
-			switch pgErr.Code {
-			case "23505":
-				return oe.DbError{Err: fmt.Errorf("UNIQUE violation - code 23505: %w", pgErr), Reconcilable: false}
-			case "23503":
-				return oe.DbError{Err: fmt.Errorf("FOREIGN KEY violation - code 23503: %w", pgErr), Reconcilable: false}
-			case "23502":
-				return oe.DbError{Err: fmt.Errorf("NOT NULL violation - code 23502: %w", pgErr), Reconcilable: false}
-			default:
-				return oe.DbError{Err: fmt.Errorf("unknown pg error occurred: %w", execErr), Reconcilable: true}
+// SetupReplicaConns connects to the read replicas in REPLICA_PG_CONNS, a comma separated list of connection strings.
+// Without the variable there are no replicas. A replica that cannot be pinged is still returned,
+// it stays out of rotation until a lag check reaches it.
+func SetupReplicaConns(logger *zap.Logger, ctx context.Context) ([]*pgxpool.Pool, error) {
+
+	replicaConns := goutils.Log().ParseEnvStringDefault("REPLICA_PG_CONNS", "", logger)
+
+	var pools []*pgxpool.Pool
+
+	for _, replicaConn := range strings.Split(replicaConns, ",") {
+
+		replicaConn = strings.TrimSpace(replicaConn)
+		if replicaConn == "" {
+			continue
+		}
+
+		pool, err := pgxpool.New(ctx, replicaConn)
+		if err != nil {
+			for _, opened := range pools {
+				opened.Close()
 			}
+			logger.Error("Unable to connect to replica", zap.Error(err))
+			return nil, err
+		}
+
+		host := pool.Config().ConnConfig.Host
+		if err = pool.Ping(ctx); err != nil {
+			logger.Warn("Unable to ping replica", zap.String("host", host), zap.Error(err))
 		} else {
-			return oe.DbError{
-				Err:          fmt.Errorf("unknown execution error occurred: %w", execErr),
-				Reconcilable: true,
-			}
+			logger.Info("Connected to PG replica", zap.String("host", host))
 		}
+
+		pools = append(pools, pool)
+	}
+
+	return pools, nil
+}
+
+// ClassifyDbError sorts an error returned by pgx into a kind and decides whether it is reconcilable, i.e. worth retrying.
+// Serialization failures, deadlocks, lost connections, shutting down servers, exhausted resources and query timeouts are
+// transient. Constraint violations, invalid statements and missing rows are not. A context that was canceled or ran out is
+// not reconcilable either, since the caller gave up. Errors that are not recognized are treated as reconcilable.
+func ClassifyDbError(err error) oe.DbError {
+
+	if err == nil {
+		return oe.DbError{Err: nil}
+	}
+
+	//already classified, e.g. by a statement inside a transaction
+	var dbErr oe.DbError
+	if errors.As(err, &dbErr) {
+		return oe.DbError{Err: err, Kind: dbErr.Kind, Reconcilable: dbErr.Reconcilable}
+	}
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return oe.DbError{Err: fmt.Errorf("context canceled: %w", err), Kind: oe.DbErrCanceled, Reconcilable: false}
+	case errors.Is(err, context.DeadlineExceeded):
+		return oe.DbError{Err: fmt.Errorf("context deadline exceeded: %w", err), Kind: oe.DbErrCanceled, Reconcilable: false}
+	case errors.Is(err, pgx.ErrNoRows):
+		return oe.DbError{Err: err, Kind: oe.DbErrNoRows, Reconcilable: false}
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		kind, reconcilable := classifyPgCode(pgErr.Code)
+		return oe.DbError{Err: fmt.Errorf("%s - code %s: %w", kind, pgErr.Code, err), Kind: kind, Reconcilable: reconcilable}
+	}
+
+	//errors without a postgres code come from the connection: either the statement never reached the server,
+	//the connection broke or a timeout was hit on the way
+	var connectErr *pgconn.ConnectError
+	var netErr net.Error
+	if pgconn.SafeToRetry(err) || pgconn.Timeout(err) || errors.As(err, &connectErr) || errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return oe.DbError{Err: fmt.Errorf("connection to postgres failed: %w", err), Kind: oe.DbErrConnection, Reconcilable: true}
+	}
+
+	return oe.DbError{Err: fmt.Errorf("unknown execution error occurred: %w", err), Kind: oe.DbErrUnknown, Reconcilable: true}
+}
+
+// classifyPgCode maps a postgres error code (SQLSTATE) to a kind, see https://www.postgresql.org/docs/current/errcodes-appendix.html
+func classifyPgCode(code string) (oe.DbErrorKind, bool) {
+
+	switch code {
+	case "40001":
+		return oe.DbErrSerialization, true
+	case "40P01":
+		return oe.DbErrDeadlock, true
+	case "57P01", "57P02", "57P03":
+		return oe.DbErrShutdown, true
+	case "57014":
+		return oe.DbErrQueryTimeout, true
+	}
+
+	if len(code) < 2 {
+		return oe.DbErrUnknown, true
+	}
+
+	switch code[:2] {
+	case "08":
+		return oe.DbErrConnection, true
+	case "53":
+		return oe.DbErrResources, true
+	case "23":
+		return oe.DbErrConstraint, false
+	case "22", "42":
+		return oe.DbErrInvalid, false
+	}
+
+	return oe.DbErrUnknown, true
+}
+
+// Must classifies the outcome of a statement that has to affect at least one row.
+// Zero affected rows are an error that is not reconcilable.
+func Must(execRes pgconn.CommandTag, execErr error) oe.DbError {
+	if execErr != nil {
+		return ClassifyDbError(execErr)
 	}
 
 	if execRes.RowsAffected() == 0 {
 		return oe.DbError{
 			Err:          fmt.Errorf("no execution error but no rows affected: %s", execRes.String()),
+			Kind:         oe.DbErrNoRows,
 			Reconcilable: false,
 		}
 	}
 
 	return oe.DbError{Err: nil}
 }
+
+// Optional classifies the outcome of a statement for which zero affected rows are fine, e.g. an idempotent delete.
+func Optional(execRes pgconn.CommandTag, execErr error) oe.DbError {
+	if execErr != nil {
+		return ClassifyDbError(execErr)
+	}
+
+	return oe.DbError{Err: nil}
+}
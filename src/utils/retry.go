@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"context"
+	goutils "github.com/linusgith/goutils/pkg/env_utils"
+	"go.uber.org/zap"
+	"math/rand/v2"
+	"time"
+)
+
+// BackoffStrategy decides how the wait between two attempts of a RetryPolicy grows
+type BackoffStrategy string
+
+const (
+	// BackoffExponential doubles the wait after every attempt
+	BackoffExponential BackoffStrategy = "exp"
+	// BackoffLinear adds the initial backoff after every attempt
+	BackoffLinear BackoffStrategy = "lin"
+	// BackoffDecorrelated picks a random wait between the initial backoff and three times the previous wait,
+	// which spreads out retries of many callers that failed at the same time
+	BackoffDecorrelated BackoffStrategy = "decorrelated"
+)
+
+// RetryPolicy describes how often and with which waits an operation is retried.
+// Every wait is capped at MaxBackoff. Retryable decides whether an error is worth another attempt, nil retries every error.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Strategy       BackoffStrategy
+	Retryable      func(err error) bool
+}
+
+// RetryPolicyFromEnv reads a policy from the environment variables <prefix>MAX_RETRIES, <prefix>INIT_RETRY_BACKOFF,
+// <prefix>MAX_RETRY_BACKOFF and <prefix>BACKOFF_TYPE, falling back to the given defaults. Retryable is kept from the defaults.
+func RetryPolicyFromEnv(prefix string, defaults RetryPolicy, logger *zap.Logger) RetryPolicy {
+
+	policy := defaults
+
+	policy.MaxAttempts = goutils.Log().ParseEnvIntDefault(prefix+"MAX_RETRIES", defaults.MaxAttempts, logger)
+	policy.InitialBackoff = goutils.Log().ParseEnvDurationDefault(prefix+"INIT_RETRY_BACKOFF", defaults.InitialBackoff, logger)
+	policy.MaxBackoff = goutils.Log().ParseEnvDurationDefault(prefix+"MAX_RETRY_BACKOFF", defaults.MaxBackoff, logger)
+
+	strategy := BackoffStrategy(goutils.Log().ParseEnvStringDefault(prefix+"BACKOFF_TYPE", string(defaults.Strategy), logger))
+
+	switch strategy {
+	case BackoffExponential, BackoffLinear, BackoffDecorrelated:
+		policy.Strategy = strategy
+	default:
+		logger.Warn("invalid backoff strategy provided, using default", zap.String("provided", string(strategy)), zap.String("default", string(defaults.Strategy)))
+	}
+
+	if policy.MaxAttempts < 1 {
+		logger.Warn("retry policy needs at least one attempt, using 1", zap.String("env", prefix+"MAX_RETRIES"), zap.Int("provided", policy.MaxAttempts))
+		policy.MaxAttempts = 1
+	}
+
+	return policy
+}
+
+// Backoff returns the wait before the next attempt after the given attempt failed, attempts start at 1.
+// previous is the wait before the failed attempt and only used by BackoffDecorrelated.
+func (p RetryPolicy) Backoff(attempt int, previous time.Duration) time.Duration {
+
+	var backoff time.Duration
+
+	switch p.Strategy {
+	case BackoffLinear:
+		backoff = p.InitialBackoff * time.Duration(attempt)
+	case BackoffDecorrelated:
+		upper := max(previous*3, p.InitialBackoff)
+		backoff = p.InitialBackoff
+		if upper > p.InitialBackoff {
+			backoff += rand.N(upper - p.InitialBackoff)
+		}
+	default:
+		backoff = p.InitialBackoff
+		for i := 1; i < attempt && (p.MaxBackoff <= 0 || backoff < p.MaxBackoff); i++ {
+			backoff *= 2
+		}
+	}
+
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+
+	return backoff
+}
+
+// Retry runs fn until it succeeds, returns an error the policy does not retry, or MaxAttempts is reached.
+// The waits between attempts end early if the context is canceled, in which case the last error is returned.
+func Retry[T any](ctx context.Context, logger *zap.Logger, operation string, policy RetryPolicy, fn func(ctx context.Context) (T, error)) (T, error) {
+
+	var result T
+	var err error
+	var backoff time.Duration
+
+	for attempt := 1; attempt <= policy.MaxAttempts; attempt++ {
+
+		result, err = fn(ctx)
+		if err == nil {
+			return result, nil
+		}
+
+		if policy.Retryable != nil && !policy.Retryable(err) {
+			return result, err
+		}
+
+		if attempt == policy.MaxAttempts {
+			break
+		}
+
+		backoff = policy.Backoff(attempt, backoff)
+
+		logger.Warn("database operation failed; retrying...", zap.String("operation", operation), zap.Int("try", attempt), zap.Duration("backoff", backoff), zap.Error(err))
+
+		if !Sleep(ctx, backoff) {
+			logger.Warn("database operation failed, context ended while waiting to retry", zap.String("operation", operation), zap.Int("try", attempt), zap.Error(err))
+			return result, err
+		}
+	}
+
+	logger.Error("database operation failed, retry limit reached", zap.String("operation", operation), zap.Int("tries", policy.MaxAttempts), zap.Error(err))
+	return result, err
+}
+
+// Sleep waits for the given duration and returns false if the context ended before
+func Sleep(ctx context.Context, d time.Duration) bool {
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
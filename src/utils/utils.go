@@ -3,21 +3,12 @@ package utils
 import (
 	"controller/src/docker"
 	"controller/src/errors"
-	"math"
+	"go.uber.org/zap"
+	"os"
 	"strconv"
 	"time"
 )
 
-// CalculateAndExecuteBackoff calculates the backoff duration based on the iteration number and initial backoff duration.
-func CalculateAndExecuteBackoff(iteration int, initBackoff time.Duration) {
-	backoffInMs := float64(initBackoff.Milliseconds())
-	backoffAsFloat := math.Pow(backoffInMs, float64(iteration))
-
-	backoff := time.Duration(backoffAsFloat) * time.Millisecond
-
-	time.Sleep(backoff)
-}
-
 // SetShadowPort increments the provided port string by 1 and returns the new port as a string.
 // It returns an error if the port string cannot be converted to an integer.
 // It is used to set a shadow port for a container, ensuring that the port is unique and does not conflict with existing ports.
@@ -41,3 +32,20 @@ func ChanWihTimeout(cr docker.CreateRequest) error {
 		return errors.ErrCreateTimeout
 	}
 }
+
+// ParseEnvFloatDefault reads a float from the given environment variable and falls back to the default if it is unset or invalid.
+func ParseEnvFloatDefault(env string, defaultValue float64, logger *zap.Logger) float64 {
+	value, ok := os.LookupEnv(env)
+	if !ok {
+		logger.Debug("environment variable not set, using default", zap.String("env", env), zap.Float64("default", defaultValue))
+		return defaultValue
+	}
+
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		logger.Warn("could not parse environment variable as float, using default", zap.String("env", env), zap.String("value", value), zap.Float64("default", defaultValue))
+		return defaultValue
+	}
+
+	return parsed
+}